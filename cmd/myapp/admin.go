@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// testUserNames are the accounts the frontend test suites sign up with.
+var testUserNames = []string{"userTest", "studyTest", "quizeTest", "routerTest"}
+
+func getAdminUserID(r *http.Request) (int, error) {
+	idStr := mux.Vars(r)["userID"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return id, fmt.Errorf("Invalid id given %s", idStr)
+	}
+	return id, nil
+}
+
+// getAdminTargetID returns the {userID} of the request. Admins can't change
+// their own account here, so they can't lock themselves out.
+func (s *APIServer) getAdminTargetID(r *http.Request) (int, error) {
+	id, err := getAdminUserID(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if admin, _ := userFromContext(r.Context()); admin != nil && admin.ID == id && r.Method != "GET" {
+		return 0, fmt.Errorf("Admins can't change their own account here")
+	}
+
+	return id, nil
+}
+
+// getAdminTarget returns the user named by {userID}.
+func (s *APIServer) getAdminTarget(r *http.Request) (*User, error) {
+	id, err := s.getAdminTargetID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dataBase.GetAccount(id)
+}
+
+// adminView is the account of a user without the tracks.
+func adminView(user User) User {
+	user = user.Public()
+	user.Tracks = nil
+	return user
+}
+
+func (s *APIServer) handleAdminUsers(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		users, err := s.dataBase.GetUsers()
+		if err != nil {
+			return err
+		}
+
+		query := strings.ToLower(r.URL.Query().Get("q"))
+		role := r.URL.Query().Get("role")
+
+		users = slices.DeleteFunc(users, func(user User) bool {
+			if role != "" && user.Role != role {
+				return true
+			}
+			if query == "" {
+				return false
+			}
+			return !slices.ContainsFunc([]string{user.UserName, user.EMail, user.FirstName, user.LastName}, func(field string) bool {
+				return strings.Contains(strings.ToLower(field), query)
+			})
+		})
+
+		for i := range users {
+			users[i] = adminView(users[i])
+		}
+
+		return WriteJSON(w, http.StatusOK, users)
+	default:
+		return fmt.Errorf("Method not allowed")
+	}
+}
+
+func (s *APIServer) handleAdminUser(w http.ResponseWriter, r *http.Request) error {
+	user, err := s.getAdminTarget(r)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "GET":
+		return WriteJSON(w, http.StatusOK, adminView(*user))
+	case "DELETE":
+		if err := s.eraser.Erase(user.ID); err != nil {
+			return err
+		}
+
+		return WriteJSON(w, http.StatusOK, struct {
+			Status string `json:"status"`
+		}{
+			Status: "erased",
+		})
+	default:
+		return fmt.Errorf("Method not allowed")
+	}
+}
+
+// handleAdminSuspend blocks or unblocks an account. Suspending ends every
+// session, so the user is logged out at once.
+func (s *APIServer) handleAdminSuspend(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	var req SuspendReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	id, err := s.getAdminTargetID(r)
+	if err != nil {
+		return err
+	}
+
+	var updated User
+	err = s.dataBase.UpdateUserFunc(id, func(user *User) error {
+		user.Suspended = req.Suspended
+		if user.Suspended {
+			user.Sessions = nil
+		}
+
+		updated = *user
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, adminView(updated))
+}
+
+func (s *APIServer) handleAdminRole(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	var req RoleReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	if !slices.Contains(roles, req.Role) {
+		return fmt.Errorf("Unknown role: %v", req.Role)
+	}
+
+	id, err := s.getAdminTargetID(r)
+	if err != nil {
+		return err
+	}
+
+	var updated User
+	err = s.dataBase.UpdateUserFunc(id, func(user *User) error {
+		user.Role = req.Role
+		updated = *user
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, adminView(updated))
+}
+
+// handleAdminResetTestUsers deletes the test suite accounts, so the next run
+// can sign them up again from scratch.
+func (s *APIServer) handleAdminResetTestUsers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	var deleted = []string{}
+	for _, name := range testUserNames {
+		user, err := s.dataBase.GetUserByLogin(name)
+		if err != nil || user.UserName != name {
+			continue
+		}
+
+		if err := s.dataBase.DeleteUser(user.ID); err != nil {
+			return err
+		}
+		deleted = append(deleted, name)
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Deleted []string `json:"deleted"`
+	}{deleted})
+}
+
+func (s *APIServer) handleSnapshots(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		snapshots, err := s.snapshots.List()
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, snapshots)
+	case "POST":
+		info, err := s.snapshots.Create()
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, info)
+	default:
+		return fmt.Errorf("Method not allowed")
+	}
+}
+
+func (s *APIServer) handleSnapshotRestore(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	var req = struct {
+		UserID *int `json:"userID"`
+	}{}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+	}
+
+	name := mux.Vars(r)["name"]
+	if err := s.snapshots.Restore(name, req.UserID); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Restored string `json:"restored"`
+		UserID   *int   `json:"userID,omitempty"`
+	}{name, req.UserID})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// signUpAs signs user i up and gives it role.
+func signUpAs(t *testing.T, handler http.Handler, store Store, i int, role string) *testClient {
+	c, err := signUp(handler, i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.UpdateUserFunc(c.auth.Id, func(user *User) error {
+		user.Role = role
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestAdminRoutesNeedAdmin(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	handler := newTestServer(t, store).Handler()
+
+	user := signUpAs(t, handler, store, 0, RoleUser)
+	teacher := signUpAs(t, handler, store, 1, RoleTeacher)
+	admin := signUpAs(t, handler, store, 2, RoleAdmin)
+	adminKey, _ := admin.newAPIKey(t, CreateAPIKeyReq{Label: "admin"})
+
+	var routes = []struct {
+		method string
+		path   string
+		body   any
+	}{
+		{"GET", "/admin/users", nil},
+		{"GET", fmt.Sprintf("/admin/users/%d", user.auth.Id), nil},
+		{"PUT", fmt.Sprintf("/admin/users/%d/suspend", user.auth.Id), SuspendReq{Suspended: true}},
+		{"PUT", fmt.Sprintf("/admin/users/%d/role", user.auth.Id), RoleReq{Role: RoleAdmin}},
+		{"GET", fmt.Sprintf("/admin/users/%d/consent", user.auth.Id), nil},
+		{"POST", "/admin/testUsers/reset", nil},
+		{"GET", "/admin/snapshots", nil},
+		{"GET", "/admin/rollovers", nil},
+	}
+
+	for _, route := range routes {
+		for name, c := range map[string]*testClient{"user": user, "teacher": teacher, "admin API key": adminKey} {
+			if code := c.code(route.method, route.path, route.body); code != http.StatusForbidden {
+				t.Errorf("%v %v as %v: got %d, want %d", route.method, route.path, name, code, http.StatusForbidden)
+			}
+		}
+	}
+
+	if code := admin.code("GET", "/admin/users", nil); code != http.StatusOK {
+		t.Errorf("GET /admin/users as admin: got %d, want %d", code, http.StatusOK)
+	}
+
+	if got, err := store.GetUserByID(user.auth.Id); err != nil || got.Suspended || got.Role != RoleUser {
+		t.Errorf("The refused requests changed the user: %+v, %v", got, err)
+	}
+}
+
+// A suspension logs the user out at once: the access token, the refresh
+// token and new logins all stop working.
+func TestAdminSuspendTakesEffect(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	handler := newTestServer(t, store).Handler()
+
+	user := signUpAs(t, handler, store, 0, RoleUser)
+	admin := signUpAs(t, handler, store, 1, RoleAdmin)
+
+	if err := user.do("GET", user.path(""), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	suspend := fmt.Sprintf("/admin/users/%d/suspend", user.auth.Id)
+	if err := admin.do("PUT", suspend, SuspendReq{Suspended: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := user.code("GET", user.path(""), nil); code != http.StatusUnauthorized {
+		t.Errorf("Access token after the suspension: got %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := user.code("POST", "/refreshToken", RefreshReq{RefreshToken: user.auth.RefreshToken}); code != http.StatusBadRequest {
+		t.Errorf("Refresh after the suspension: got %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := user.code("PUT", "/register", LogInReq{UsernameEMail: "user0", Password: "password"}); code != http.StatusBadRequest {
+		t.Errorf("Log in after the suspension: got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	if err := admin.do("PUT", suspend, SuspendReq{Suspended: false}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := user.do("PUT", "/register", LogInReq{UsernameEMail: "user0", Password: "password"}, nil); err != nil {
+		t.Errorf("Log in after lifting the suspension: %v", err)
+	}
+
+	// Admins can't lock themselves out.
+	if code := admin.code("PUT", fmt.Sprintf("/admin/users/%d/suspend", admin.auth.Id), SuspendReq{Suspended: true}); code != http.StatusBadRequest {
+		t.Errorf("Admin suspending itself: got %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+// A suspension sticks while the user changes the account at the same time.
+// Run it with -race.
+func TestConcurrentSuspend(t *testing.T) {
+	const changes = 5
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		handler := newTestServer(t, slowReads{store}).Handler()
+		user := signUpAs(t, handler, store, 0, RoleUser)
+		admin := signUpAs(t, handler, store, 1, RoleAdmin)
+
+		var wg sync.WaitGroup
+		for i := 0; i < changes; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				user.code("POST", user.path("/consent"), ConsentReq{PolicyVersion: policyVersion(), Categories: []string{}})
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := admin.do("PUT", fmt.Sprintf("/admin/users/%d/suspend", user.auth.Id), SuspendReq{Suspended: true}, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		got, err := store.GetUserByID(user.auth.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Suspended || len(got.Sessions) != 0 {
+			t.Errorf("User is suspended %v with %d sessions, want suspended without sessions", got.Suspended, len(got.Sessions))
+		}
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,7 +12,6 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
 )
 
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
@@ -22,7 +22,15 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 
 type APIServer struct {
 	listenAddr string
-	dataBase   LocalStorage
+	dataBase   Store
+	snapshots  *Snapshotter
+	eraser     *Eraser
+	roller     *Roller
+	tokens     *TokenIssuer
+	mailer     Mailer
+	limiter    *RateLimiter
+	logins     *LoginGuard
+	clock      Clock
 }
 
 type APIError struct {
@@ -39,10 +47,18 @@ func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	}
 }
 
-func NewAPISErver(listenAddr string, store LocalStorage) *APIServer {
+func NewAPISErver(listenAddr string, store Store, snapshots *Snapshotter, eraser *Eraser, roller *Roller, tokens *TokenIssuer, mailer Mailer) *APIServer {
 	return &APIServer{
 		listenAddr: listenAddr,
 		dataBase:   store,
+		snapshots:  snapshots,
+		eraser:     eraser,
+		roller:     roller,
+		tokens:     tokens,
+		mailer:     mailer,
+		limiter:    NewRateLimiter(),
+		logins:     NewLoginGuard(),
+		clock:      systemClock,
 	}
 }
 
@@ -50,7 +66,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*") // Allow all origins
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		if r.Method == http.MethodOptions {
 			// Handle preflight request
 			return
@@ -60,71 +76,95 @@ func corsMiddleware(next http.Handler) http.Handler {
 }
 
 func (s *APIServer) Run() {
-
-	router := mux.NewRouter()
-	s.dataBase, _ = OpenStorage("./storage.json")
-
-	router.HandleFunc("/audio", handleAudioRequest)
-	router.HandleFunc("/verifyUserName", makeHTTPHandleFunc(s.handleVerifyUserName))
-	router.HandleFunc("/acceptCokies", makeHTTPHandleFunc(s.cookiesAccepted))
-	router.HandleFunc("/register", makeHTTPHandleFunc(s.handleRegister))
-	router.HandleFunc("/getUserByToken", makeHTTPHandleFunc(s.handleGetUserByToken))
-	router.HandleFunc("/getUsersToken", makeHTTPHandleFunc(s.handleGetUsersToken))
-	router.HandleFunc("/user", makeHTTPHandleFunc(s.handleUser))
-	router.HandleFunc("/user/{id}", makeHTTPHandleFunc(s.handeUser))
-	router.HandleFunc("/newCardData/{fromLanguage}-{toLanguage}/{expretion}", makeHTTPHandleFunc(s.handleGetNewCardData))
-	router.HandleFunc("/user/{id}/track/{key}/card", makeHTTPHandleFunc(s.handleUserCard))
-	router.HandleFunc("/user/{id}/track/{key}/canStudy", makeHTTPHandleFunc(s.handleCanStudy))
-	router.HandleFunc("/user/{id}/track/{key}/cardVerify", makeHTTPHandleFunc(s.handleUserCardVerify))
-	router.HandleFunc("/user/{id}/track/{key}/card/{cardID}", makeHTTPHandleFunc(s.handleUserCardByID))
-	router.HandleFunc("/user/{id}/track", makeHTTPHandleFunc(s.handleTrack))
-	router.HandleFunc("/user/{id}/track/{key}", makeHTTPHandleFunc(s.handleTrackDelete))
-	router.HandleFunc("/user/{id}/track/{key}/settings", makeHTTPHandleFunc(s.handleTrackSettingsByKey))
-	// router.HandleFunc("/user/{id}/track/{key}/writing", makeHTTPHandleFunc(s.handleTrackSettingsByKey))
-	// router.HandleFunc("/user/{id}/track/{key}/listening", makeHTTPHandleFunc(s.handleTrackSettingsByKey))
-	// router.HandleFunc("/user/{id}/track/{key}/memory", makeHTTPHandleFunc(s.handleTrackSettingsByKey))
-	router.HandleFunc("/user/{id}/track/{key}/test/{testName}", makeHTTPHandleFunc(s.handleTest))
-	router.HandleFunc("/user/{id}/track/{key}/study/", makeHTTPHandleFunc(s.handleGetStudy))
-
 	log.Println(("JSON API server running on port: "), s.listenAddr)
 
-	handler := corsMiddleware(router)
-
-	if err := http.ListenAndServe(s.listenAddr, handler); err != nil {
+	if err := http.ListenAndServe(s.listenAddr, s.Handler()); err != nil {
 		log.Fatal("Server failed:", err)
 	}
 
 }
 
+// Handler routes every endpoint of the API.
+func (s *APIServer) Handler() http.Handler {
+
+	router := mux.NewRouter()
+
+	router.HandleFunc("/audio", handleAudioRequest)
+	router.Handle("/verifyUserName", s.limiter.Limit(authPolicy, makeHTTPHandleFunc(s.handleVerifyUserName)))
+	router.Handle("/register", s.limiter.Limit(authPolicy, makeHTTPHandleFunc(s.handleRegister)))
+	router.HandleFunc("/getUserByToken", makeHTTPHandleFunc(s.handleGetUserByToken))
+	router.Handle("/refreshToken", s.limiter.Limit(authPolicy, makeHTTPHandleFunc(s.handleRefreshToken)))
+	router.HandleFunc("/logOut", makeHTTPHandleFunc(s.handleLogOut))
+	router.Handle("/verifyEMail", s.limiter.Limit(authPolicy, makeHTTPHandleFunc(s.handleVerifyEMail)))
+	router.Handle("/passwordReset/request", s.limiter.Limit(authPolicy, makeHTTPHandleFunc(s.handleRequestPasswordReset)))
+	router.Handle("/passwordReset", s.limiter.Limit(authPolicy, makeHTTPHandleFunc(s.handleResetPassword)))
+
+	// Everything below needs a bearer token and only reaches the user it
+	// belongs to.
+	private := router.NewRoute().Subrouter()
+	private.Use(s.authMiddleware, s.limiter.Middleware(userPolicy))
+
+	private.Handle("/acceptCokies", sessionOnly(makeHTTPHandleFunc(s.cookiesAccepted)))
+	private.Handle("/verifyEMail/send", sessionOnly(s.limiter.Limit(authPolicy, makeHTTPHandleFunc(s.handleSendVerification))))
+	private.HandleFunc("/user", makeHTTPHandleFunc(s.handleUser))
+	private.HandleFunc("/user/{id}", makeHTTPHandleFunc(s.handeUser))
+	private.HandleFunc("/user/{id}/settings", makeHTTPHandleFunc(s.handleUserSettings))
+	private.Handle("/user/{id}/password", sessionOnly(s.limiter.Limit(authPolicy, makeHTTPHandleFunc(s.handlePassword))))
+	private.Handle("/user/{id}/consent", sessionOnly(makeHTTPHandleFunc(s.handleConsent)))
+	private.Handle("/user/{id}/consent/history", sessionOnly(makeHTTPHandleFunc(s.handleConsentHistory)))
+	private.Handle("/user/{id}/apiKeys", sessionOnly(makeHTTPHandleFunc(s.handleAPIKeys)))
+	private.Handle("/user/{id}/apiKeys/{keyID}", sessionOnly(makeHTTPHandleFunc(s.handleAPIKey)))
+	private.Handle("/user/{id}/export", sessionOnly(s.limiter.Limit(authPolicy, makeHTTPHandleFunc(s.handleExport))))
+	private.Handle("/user/{id}/erasure", sessionOnly(makeHTTPHandleFunc(s.handleErasure)))
+	private.Handle("/newCardData/{fromLanguage}-{toLanguage}/{expretion}", s.limiter.Limit(dictionaryPolicy, makeHTTPHandleFunc(s.handleGetNewCardData)))
+	private.HandleFunc("/user/{id}/track/{key}/card", makeHTTPHandleFunc(s.handleUserCard))
+	private.HandleFunc("/user/{id}/track/{key}/canStudy", makeHTTPHandleFunc(s.handleCanStudy))
+	private.HandleFunc("/user/{id}/track/{key}/cardVerify", makeHTTPHandleFunc(s.handleUserCardVerify))
+	private.HandleFunc("/user/{id}/track/{key}/card/{cardID}", makeHTTPHandleFunc(s.handleUserCardByID))
+	private.HandleFunc("/user/{id}/track/{key}/card/{cardID}/reviews", makeHTTPHandleFunc(s.handleCardReviews))
+	private.HandleFunc("/user/{id}/track/{key}/reviews", makeHTTPHandleFunc(s.handleTrackReviews))
+	private.HandleFunc("/user/{id}/track", makeHTTPHandleFunc(s.handleTrack))
+	private.HandleFunc("/user/{id}/track/{key}", makeHTTPHandleFunc(s.handleTrackDelete))
+	private.HandleFunc("/user/{id}/track/{key}/settings", makeHTTPHandleFunc(s.handleTrackSettingsByKey))
+	private.HandleFunc("/user/{id}/track/{key}/backlog", makeHTTPHandleFunc(s.handleBacklog))
+	private.HandleFunc("/user/{id}/track/{key}/leeches", makeHTTPHandleFunc(s.handleLeeches))
+	// private.HandleFunc("/user/{id}/track/{key}/writing", makeHTTPHandleFunc(s.handleTrackSettingsByKey))
+	// private.HandleFunc("/user/{id}/track/{key}/listening", makeHTTPHandleFunc(s.handleTrackSettingsByKey))
+	// private.HandleFunc("/user/{id}/track/{key}/memory", makeHTTPHandleFunc(s.handleTrackSettingsByKey))
+	private.HandleFunc("/user/{id}/track/{key}/test/{testName}", makeHTTPHandleFunc(s.handleTest))
+	private.HandleFunc("/user/{id}/track/{key}/study/", makeHTTPHandleFunc(s.handleGetStudy))
+
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.authMiddleware, sessionOnly, requireRole(RoleAdmin), s.limiter.Middleware(userPolicy))
+
+	admin.HandleFunc("/users", makeHTTPHandleFunc(s.handleAdminUsers))
+	admin.HandleFunc("/users/{userID}", makeHTTPHandleFunc(s.handleAdminUser))
+	admin.HandleFunc("/users/{userID}/suspend", makeHTTPHandleFunc(s.handleAdminSuspend))
+	admin.HandleFunc("/users/{userID}/role", makeHTTPHandleFunc(s.handleAdminRole))
+	admin.HandleFunc("/users/{userID}/consent", makeHTTPHandleFunc(s.handleAdminConsentHistory))
+	admin.HandleFunc("/testUsers/reset", makeHTTPHandleFunc(s.handleAdminResetTestUsers))
+	admin.HandleFunc("/snapshots", makeHTTPHandleFunc(s.handleSnapshots))
+	admin.HandleFunc("/snapshots/{name}/restore", makeHTTPHandleFunc(s.handleSnapshotRestore))
+	admin.HandleFunc("/rollovers", makeHTTPHandleFunc(s.handleRollovers))
+
+	return corsMiddleware(s.limiter.Limit(clientPolicy, router))
+}
+
 func (s *APIServer) cookiesAccepted(w http.ResponseWriter, r *http.Request) error {
 
 	if r.Method == "POST" {
 
-		var req = struct {
-			Id int `json:"id"`
-		}{}
-
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		id, err := getID(r)
+		if err != nil {
 			return err
 		}
 
-		index := slices.IndexFunc(s.dataBase.Storage, func(user User) bool {
-			return user.ID == req.Id
-		})
-
-		if index == -1 {
-			return fmt.Errorf("ID is invalid")
+		// The old cookie banner accepts everything for the current policy.
+		status, err := s.recordConsent(id, ConsentRecord{PolicyVersion: policyVersion(), Categories: consentCategories, Granted: true, Source: "acceptCokies"})
+		if err != nil {
+			return err
 		}
-
-		s.dataBase.Storage[index].CokiesAccepted = true
-
-		s.dataBase.UpdateData()
-		return WriteJSON(w, http.StatusOK, struct {
-			Token string `json:"token"`
-		}{
-
-			s.dataBase.Storage[index].Token,
-		})
+		return WriteJSON(w, http.StatusOK, status)
 	} else {
 		return fmt.Errorf("Method not allowed")
 	}
@@ -147,12 +187,17 @@ func (s *APIServer) handleVerifyCard(w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 
-	track, err := s.dataBase.GetTrack(r)
+	track, err := s.getTrack(r)
+	if err != nil {
+		return err
+	}
+
+	today, err := s.userToday(r)
 	if err != nil {
 		return err
 	}
 
-	newCard := NewCard(track.DefineNewID(), req.Card.Data, req.Card.Notes, req.Card.TranslatedData, req.Card.Examples, req.Card.PronunciationPath)
+	newCard := NewCard(track.DefineNewID(), req.Card.Data, req.Card.Notes, req.Card.TranslatedData, req.Card.Examples, req.Card.PronunciationPath, today)
 	newCard.PronunciationPath = fmt.Sprintf("http://localhost:3000/audio?filename=%s.mp3", newCard.Data)
 
 	card, err := track.VerifynewCard(newCard)
@@ -180,11 +225,7 @@ func (s *APIServer) handleVerifyUserName(w http.ResponseWriter, r *http.Request)
 			return err
 		}
 
-		index := slices.IndexFunc(s.dataBase.Storage, func(user User) bool {
-			return user.UserName == req.Username
-		})
-
-		if index != -1 {
+		if user, err := s.dataBase.GetUserByLogin(req.Username); err == nil && user.UserName == req.Username {
 			return WriteJSON(w, http.StatusOK, response)
 		}
 
@@ -199,7 +240,7 @@ func (s *APIServer) handleVerifyUserName(w http.ResponseWriter, r *http.Request)
 func (s *APIServer) handleUser(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case "GET":
-		return s.handleGetUsers(w, r)
+		return s.handleGetUserByID(w, r)
 	default:
 		return fmt.Errorf("Method not allowed")
 	}
@@ -216,59 +257,91 @@ func (s *APIServer) handleRegister(w http.ResponseWriter, r *http.Request) error
 	}
 }
 
-func (s *APIServer) handleGetUsersToken(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
-	case "PUT":
-		return s.GetUsersToken(r, w)
+	case "POST":
+		var req RefreshReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+
+		auth, err := s.tokens.Refresh(s.dataBase, req.RefreshToken)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, auth)
 	default:
 		return fmt.Errorf("Method not allowed")
 	}
 }
 
-func (s *APIServer) handleGetUserByToken(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handleLogOut(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
-	case "PUT":
-		return s.GetUserByToken(r, w)
+	case "POST":
+		var req RefreshReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+
+		if err := s.tokens.Revoke(s.dataBase, req.RefreshToken); err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, struct {
+			Status string `json:"status"`
+		}{
+			Status: "logged out",
+		})
 	default:
 		return fmt.Errorf("Method not allowed")
 	}
 }
 
-func (s *APIServer) GetUserByToken(r *http.Request, w http.ResponseWriter) error {
+func (s *APIServer) handlePassword(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "PUT":
+		var req ChangePasswordReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
 
-	var token GetUserByTokenReq
+		id, err := getID(r)
+		if err != nil {
+			return err
+		}
 
-	if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
-		return err
+		auth, err := ChangePassword(s.dataBase, s.tokens, id, req)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, auth)
+	default:
+		return fmt.Errorf("Method not allowed")
 	}
+}
 
-	user, err := s.dataBase.GetUserByToken(token.Token)
-	if err != nil {
-		return err
+func (s *APIServer) handleGetUserByToken(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "PUT":
+		return s.GetUserByToken(r, w)
+	default:
+		return fmt.Errorf("Method not allowed")
 	}
-
-	return WriteJSON(w, http.StatusOK, user)
-
 }
 
-func (s *APIServer) GetUsersToken(r *http.Request, w http.ResponseWriter) error {
+func (s *APIServer) GetUserByToken(r *http.Request, w http.ResponseWriter) error {
 
-	var req struct {
-		ID int `json:"id"`
-	}
+	var token GetUserByTokenReq
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
 		return err
 	}
 
-	user, err := s.dataBase.GetUserByID(req.ID)
+	user, err := s.tokens.Authenticate(s.dataBase, token.Token)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		Token string `json:"token"`
-	}{user.Token})
+	return WriteJSON(w, http.StatusOK, user.Public())
 
 }
 
@@ -292,12 +365,12 @@ func (s *APIServer) handleGetCards(w http.ResponseWriter, r *http.Request) error
 
 	if r.Method == "GET" {
 
-		card, err := s.dataBase.GetTrack(r)
+		card, err := s.getTrack(r)
 		if err != nil {
 			return err
 		}
 
-		copy := card.Copy().Storage
+		copy := card.Storage
 		slices.Reverse(copy)
 		return WriteJSON(w, http.StatusOK, copy)
 	} else {
@@ -313,10 +386,27 @@ func (s *APIServer) handleLogIn(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	id, err := s.dataBase.LogIn(req)
+	// Failed logins are counted per account, a locked account is refused
+	// before its password is checked.
+	var lockout time.Duration
+	account, err := s.dataBase.GetUserByLogin(req.UsernameEMail)
+	if err == nil {
+		var wait time.Duration
+		if wait, lockout = s.logins.Attempt(account.ID); wait > 0 {
+			writeTooManyRequests(w, wait)
+			return nil
+		}
+	}
+
+	id, err := LogInUser(s.dataBase, s.tokens, req)
 	if err != nil {
+		if lockout > 0 && errors.Is(err, errIncorrectPassword) {
+			writeTooManyRequests(w, lockout)
+			return nil
+		}
 		return err
 	}
+	s.logins.Succeeded(id.Id)
 
 	return WriteJSON(w, http.StatusOK, id)
 
@@ -330,11 +420,17 @@ func (s *APIServer) handleSingUp(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	id, err := s.dataBase.SingUp(req)
+	id, err := SingUpUser(s.dataBase, s.tokens, req)
 	if err != nil {
 		return err
 	}
 
+	if req.EMail != "" {
+		if err := s.sendVerificationMail(id.Id); err != nil {
+			log.Println("Sending verification mail failed:", err)
+		}
+	}
+
 	return WriteJSON(w, http.StatusOK, id)
 
 }
@@ -346,24 +442,39 @@ func (s *APIServer) handlePostCard(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
-	track, err := s.dataBase.GetTrack(r)
+	userID, key, err := getTrackPath(r)
 	if err != nil {
 		return err
 	}
 
-	newCard := NewCard(track.DefineNewID(), req.Card.Data, req.Card.Notes, req.Card.TranslatedData, req.Card.Examples, req.Card.PronunciationPath)
+	today, err := s.today(userID)
+	if err != nil {
+		return err
+	}
 
-	newCard.PronunciationPath = fmt.Sprintf("http://localhost:3000/audio?filename=%s.mp3", newCard.Data)
+	// The new ID and the removal of the old card are decided on the track
+	// as it is when the change is written, so concurrent posts can't collide.
+	var card Card
+	err = s.dataBase.UpdateTrack(userID, key, func(track *Track) error {
+		if req.OldID != -1 && !containsCard(track.Storage, req.OldID) {
+			return notFound("Card does't exist")
+		}
 
-	card, err := track.AddNewCard(newCard, req.OldID)
+		newCard := NewCard(track.DefineNewID(), req.Card.Data, req.Card.Notes, req.Card.TranslatedData, req.Card.Examples, req.Card.PronunciationPath, today)
 
-	track.MissingTests()
-	var resp = NewCardResponse{Card: card, Added: true}
-	resp.Card = card
+		newCard.PronunciationPath = fmt.Sprintf("http://localhost:3000/audio?filename=%s.mp3", newCard.Data)
+
+		var err error
+		card, err = track.AddNewCard(newCard, req.OldID)
+		if err != nil {
+			return err
+		}
+
+		track.MissingTests(today)
+		return nil
+	})
 	if err != nil {
-		resp.Added = false
-	} else {
-		s.dataBase.UpdateData()
+		return err
 	}
 
 	return WriteJSON(w, http.StatusOK, card)
@@ -403,8 +514,6 @@ func handleAudioRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Define the path to the audio files
-	audioDir := "./audio/"
 	audioPath := filepath.Join(audioDir, filename)
 
 	// Check if the file exists
@@ -446,7 +555,7 @@ func (s *APIServer) handleUserCardByID(w http.ResponseWriter, r *http.Request) e
 
 func (s *APIServer) handleGetCardByID(w http.ResponseWriter, r *http.Request) error {
 
-	card, err := s.dataBase.GetCard(r)
+	card, err := s.getCard(r)
 	if err != nil {
 		return err
 	}
@@ -457,12 +566,37 @@ func (s *APIServer) handleGetCardByID(w http.ResponseWriter, r *http.Request) er
 
 func (s *APIServer) handleDeleteCardByID(w http.ResponseWriter, r *http.Request) error {
 
-	card, err := s.dataBase.DeleteCard(r)
+	userID, key, err := getTrackPath(r)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, card)
+	cardID, err := getCardID(r)
+	if err != nil {
+		return fmt.Errorf("Card wasn't found")
+	}
+
+	today, err := s.today(userID)
+	if err != nil {
+		return err
+	}
+
+	err = s.dataBase.UpdateTrack(userID, key, func(track *Track) error {
+		if !containsCard(track.Storage, cardID) {
+			return notFound("Card does't exist")
+		}
+
+		track.Storage = slices.DeleteFunc(track.Storage, func(card Card) bool {
+			return card.ID == cardID
+		})
+		track.MissingTests(today)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, nil)
 
 }
 
@@ -515,24 +649,27 @@ func (s *APIServer) handlePostCardByID(w http.ResponseWriter, r *http.Request) e
 		return err
 	}
 
-	card, err := s.dataBase.GetCard(r)
+	userID, key, err := getTrackPath(r)
 	if err != nil {
 		return err
 	}
 
+	card, err := s.getCard(r)
+	if err != nil {
+		return err
+	}
+
+	req.ID = card.ID
 	*card = req.Copy()
-	go s.dataBase.UpdateData()
+	if err := s.dataBase.UpdateCards(userID, key, *card); err != nil {
+		return err
+	}
 
 	return WriteJSON(w, http.StatusOK, card)
 
 }
 
 // Get /account
-func (s *APIServer) handleGetUsers(w http.ResponseWriter, r *http.Request) error {
-
-	return WriteJSON(w, http.StatusOK, s.dataBase.Storage)
-}
-
 func (s *APIServer) handeUser(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case "GET":
@@ -546,41 +683,63 @@ func (s *APIServer) handeUser(w http.ResponseWriter, r *http.Request) error {
 
 func (s *APIServer) handleGetUserByID(w http.ResponseWriter, r *http.Request) error {
 
-	account, err := s.dataBase.GetUser(r)
+	account, err := s.getUser(r)
 	if err != nil {
 		return err
 	}
 
-	user := account.Copy()
+	user := account.Public()
 	user.Tracks = nil
 
 	return WriteJSON(w, http.StatusOK, user)
 
 }
 
-func (s *APIServer) handleDeleteUserByID(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handleUserSettings(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		user, err := s.getUser(r)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, user.Settings)
+	case "POST":
+		var settings Settings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			return err
+		}
 
-	account, err := s.dataBase.GetUser(r)
-	if err != nil {
-		return err
-	}
+		if err := checkSettings(settings); err != nil {
+			return err
+		}
 
-	s.dataBase.Storage = slices.DeleteFunc(s.dataBase.Storage, func(user User) bool {
-		return user.ID == account.ID
-	})
+		id, err := getID(r)
+		if err != nil {
+			return err
+		}
 
-	s.dataBase.UpdateData()
+		err = s.dataBase.UpdateUserFunc(id, func(user *User) error {
+			user.Settings = settings
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, settings)
+	default:
+		return fmt.Errorf("Method not allowed")
+	}
+}
 
-	return WriteJSON(w, http.StatusOK, struct {
-		Status string `json:"status"`
-	}{
-		Status: "deleted",
-	})
+// handleDeleteUserByID schedules the erasure of the account, it is only
+// deleted once the grace period is over.
+func (s *APIServer) handleDeleteUserByID(w http.ResponseWriter, r *http.Request) error {
+	return s.handleRequestErasure(w, r)
 }
 
 func (s *APIServer) handleGetTrackStorageByKey(w http.ResponseWriter, r *http.Request) error {
 
-	track, err := s.dataBase.GetTrack(r)
+	track, err := s.getTrack(r)
 	if err != nil {
 		return err
 	}
@@ -604,12 +763,18 @@ func (s *APIServer) handleTrackStorageByKey(w http.ResponseWriter, r *http.Reque
 
 func (s *APIServer) handleGetTest(w http.ResponseWriter, r *http.Request) error {
 
-	track, err := s.dataBase.GetTrack(r)
+	track, err := s.getTrack(r)
+	if err != nil {
+		return err
+	}
+
+	today, err := s.userToday(r)
 	if err != nil {
 		return err
 	}
 
-	test, err := track.GetTest(r)
+	name, _ := getTestName(r)
+	test, err := track.GetTest(name, today)
 
 	if err != nil {
 		return err
@@ -627,59 +792,134 @@ func (s *APIServer) handlePostTest(w http.ResponseWriter, r *http.Request) error
 		return err
 	}
 
-	track, err := s.dataBase.GetTrack(r)
-	if err != nil {
-		return err
+	for _, cardGrade := range statusRequest.Grades {
+		if cardGrade.Grade != "" && !slices.Contains(grades, cardGrade.Grade) {
+			return fmt.Errorf("Unknown grade %v, use again, hard, good or easy", cardGrade.Grade)
+		}
+		if cardGrade.ResponseMs < 0 {
+			return fmt.Errorf("Response time of card %d is negative", cardGrade.ID)
+		}
+		if !slices.Contains(statusRequest.IDs, cardGrade.ID) {
+			return fmt.Errorf("Card %d is graded but isn't in IDs", cardGrade.ID)
+		}
 	}
 
-	name, _ := getTestName(r)
-	test, err := track.defineTest(r)
-
+	userID, key, err := getTrackPath(r)
 	if err != nil {
 		return err
 	}
 
-	var cards = track.getCardsByIDs(statusRequest.IDs)
-	err = test.DefineStatusUpdate(statusRequest, track.Settings.DaylyTestTries, cards)
-
+	user, err := s.dataBase.GetAccount(userID)
 	if err != nil {
 		return err
 	}
 
-	err = track.updateTestDates(name, statusRequest.IDs, test.Status)
+	now := s.clock.Now()
+	today := user.Settings.Today(now)
+	name, _ := getTestName(r)
+
+	// The result is applied to the track as it is when it is written, so
+	// concurrent test posts and the rollover don't undo each other. The
+	// reviews are kept in the same step.
+	var test Test
+	err = s.dataBase.UpdateTrackReviews(userID, key, func(track *Track) ([]Review, error) {
+		trackTest, err := track.defineTest(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var failed = trackTest.FailedCards
+		var cards = track.getCardsByIDs(statusRequest.IDs)
+		if err := trackTest.DefineStatusUpdate(statusRequest, track.Settings.DaylyTestTries, cards, today); err != nil {
+			return nil, err
+		}
+
+		scheduler, err := newScheduler(user, track.Settings)
+		if err != nil {
+			return nil, err
+		}
+
+		test = *trackTest
+		return track.updateTestDates(name, statusRequest, trackTest.Status, failed, scheduler, now, today)
+	})
 	if err != nil {
 		return err
 	}
 
-	s.dataBase.UpdateData()
-	store, _ := OpenStorage("./storage.json")
-	s.dataBase = store
-
 	return WriteJSON(w, http.StatusOK, TestResponse{test.Status, test.DaylyTestTries, fmt.Sprintf("You have %v tries left. Study) \nTest status: %v", test.DaylyTestTries, test.Status)})
 
 }
 
-func (t *Track) updateTestDates(testName string, IDs []int, testStatus string) error {
+// updateTestDates schedules the tested cards once the test is passed or
+// failed, each with its grade from the request, and returns the reviews
+// made at now, on the user's day today. failed are the cards of the failed
+// test before this one. The answers of a tried test are reviewed too, but
+// leave the cards as they are.
+func (t *Track) updateTestDates(testName string, req *CreateTestStatusRequest, testStatus string, failed []Card, scheduler Scheduler, now time.Time, today Date) ([]Review, error) {
+	if testStatus != "passed" && testStatus != "failed" && testStatus != "tried" {
+		return nil, nil
+	}
 
+	var cardGrades = map[int]CardGrade{}
+	for _, cardGrade := range req.Grades {
+		cardGrades[cardGrade.ID] = cardGrade
+	}
+
+	var reviews []Review
 	for i, _ := range t.Storage {
 		card := &t.Storage[i]
-		if slices.Contains(IDs, card.ID) {
+		if slices.Contains(req.IDs, card.ID) {
 			test, err := card.getTest(testName)
 			if err != nil {
-				return err
+				return nil, err
+			}
+
+			answer := cardGrades[card.ID]
+			if answer.Grade == "" {
+				answer.Grade = GradeAgain
+				if testStatus == "passed" {
+					answer.Grade = GradeGood
+				}
 			}
-			if testStatus == "passed" {
-				test.Repeated++
-				test.defineRepeatDate()
 
-			} else if testStatus == "failed" {
-				test.Repeated = 0
-				test.defineRepeatDate()
+			prevInterval := test.Interval
+			if testStatus == "tried" {
+				reviews = append(reviews, Review{
+					Track:        t.Name,
+					CardID:       card.ID,
+					Direction:    testName,
+					At:           now,
+					Grade:        answer.Grade,
+					ResponseMs:   answer.ResponseMs,
+					PrevInterval: prevInterval,
+					NextInterval: prevInterval,
+				})
+				continue
 			}
 
+			scheduler.Schedule(test, answer.Grade, today)
+			if answer.Grade != GradeAgain && t.Settings.FailedTestCardsPriopity && containsCard(failed, card.ID) {
+				shortenInterval(test, today)
+			}
+			test.LastReview = today
+
+			if answer.Grade == GradeAgain {
+				t.Settings.Leeches.apply(card, test.Lapses)
+			}
+
+			reviews = append(reviews, Review{
+				Track:        t.Name,
+				CardID:       card.ID,
+				Direction:    testName,
+				At:           now,
+				Grade:        answer.Grade,
+				ResponseMs:   answer.ResponseMs,
+				PrevInterval: prevInterval,
+				NextInterval: test.Interval,
+			})
 		}
 	}
-	return nil
+	return reviews, nil
 }
 
 func (t *Track) getCardsByIDs(IDs []int) []Card {
@@ -694,36 +934,6 @@ func (t *Track) getCardsByIDs(IDs []int) []Card {
 	return cards
 }
 
-func (t *TestData) defineRepeatDate() {
-
-	date := time.Now()
-
-	switch t.Repeated {
-	case 0:
-		date = date.AddDate(0, 0, 1)
-	case 1:
-		date = date.AddDate(0, 0, 1)
-	case 2:
-		date = date.AddDate(0, 0, 1)
-	case 3:
-		date = date.AddDate(0, 0, 3)
-	case 4:
-		date = date.AddDate(0, 0, 5)
-	case 5:
-		date = date.AddDate(0, 0, 7)
-	case 6:
-		date = date.AddDate(0, 0, 14)
-	case 7:
-		date = date.AddDate(0, 0, 30)
-	case 8:
-		date = date.AddDate(0, 0, 60)
-	case 9:
-		date = date.AddDate(0, 0, 240)
-	}
-
-	t.ReapeatDate = date.Format("2006.01.02")
-}
-
 func (c *Card) getTest(testName string) (*TestData, error) {
 	switch testName {
 	case "listening":
@@ -760,12 +970,17 @@ func (s *APIServer) handleTest(w http.ResponseWriter, r *http.Request) error {
 
 func (s *APIServer) handleGetStudy(w http.ResponseWriter, r *http.Request) error {
 
-	track, err := s.dataBase.GetTrack(r)
+	track, err := s.getTrack(r)
 	if err != nil {
 		return err
 	}
 
-	cardsToStudy, err := track.GetStudy()
+	today, err := s.userToday(r)
+	if err != nil {
+		return err
+	}
+
+	cardsToStudy, err := track.GetStudy(today)
 	if err != nil {
 		return err
 	}
@@ -776,12 +991,17 @@ func (s *APIServer) handleGetStudy(w http.ResponseWriter, r *http.Request) error
 
 func (s *APIServer) handleCanStudy(w http.ResponseWriter, r *http.Request) error {
 
-	track, err := s.dataBase.GetTrack(r)
+	track, err := s.getTrack(r)
+	if err != nil {
+		return err
+	}
+
+	today, err := s.userToday(r)
 	if err != nil {
 		return err
 	}
 
-	cardsToStudy, err := track.GetStudy()
+	cardsToStudy, err := track.GetStudy(today)
 	if err != nil {
 		return err
 	}
@@ -801,12 +1021,17 @@ func (s *APIServer) handleCanStudy(w http.ResponseWriter, r *http.Request) error
 
 func (s *APIServer) handleGetTrackSettingsByKey(w http.ResponseWriter, r *http.Request) error {
 
-	track, err := s.dataBase.GetTrack(r)
+	track, err := s.getTrack(r)
+	if err != nil {
+		return err
+	}
+
+	today, err := s.userToday(r)
 	if err != nil {
 		return err
 	}
 
-	track.MissingTests()
+	track.MissingTests(today)
 	return WriteJSON(w, http.StatusOK, GetTrackSettings{track.Settings, TestsStatuses{
 		track.Listening, track.Writing, track.ToLanguage, track.FromLanguage,
 	}})
@@ -832,41 +1057,40 @@ func (s *APIServer) handlePostTrackSettingsByKey(w http.ResponseWriter, r *http.
 		return err
 	}
 
-	track, err := s.dataBase.GetTrack(r)
+	if err := checkSchedulerSettings(*createTrackSettingsReq); err != nil {
+		return err
+	}
+
+	userID, key, err := getTrackPath(r)
 	if err != nil {
 		return err
 	}
 
-	track.Settings = *createTrackSettingsReq
-	go s.dataBase.UpdateData()
+	if err := s.dataBase.UpdateTrackSettings(userID, key, *createTrackSettingsReq); err != nil {
+		return err
+	}
 
-	trackCopy := track.Copy()
-	trackCopy.Storage = nil
-	return WriteJSON(w, http.StatusOK, trackCopy)
+	track, err := s.dataBase.GetTrack(userID, key)
+	if err != nil {
+		return err
+	}
+
+	track.Storage = nil
+	return WriteJSON(w, http.StatusOK, track)
 
 }
 
 func (s *APIServer) handleDeleteTrackByKey(w http.ResponseWriter, r *http.Request) error {
 
-	user, err := s.dataBase.GetUser(r)
+	userID, key, err := getTrackPath(r)
 	if err != nil {
 		return err
 	}
 
-	key, err := GetKey(r)
-	if err != nil {
+	if err := s.dataBase.DeleteTrack(userID, key); err != nil {
 		return err
 	}
 
-	user.Tracks = slices.DeleteFunc(user.Tracks, func(t Track) bool { return key == t.Name })
-
-	user.TracksKeys = slices.DeleteFunc(user.TracksKeys, func(k string) bool {
-
-		return key == k
-	})
-
-	go s.dataBase.UpdateData()
-
 	return WriteJSON(w, http.StatusOK, key)
 
 }
@@ -916,7 +1140,16 @@ func (s *APIServer) handleCreateTrack(w http.ResponseWriter, r *http.Request) er
 
 	track := NewTrack(createTrackReq)
 
-	err := s.dataBase.CreateTrack(track, r)
+	if err := checkSchedulerSettings(track.Settings); err != nil {
+		return err
+	}
+
+	userID, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	err = s.dataBase.CreateTrack(userID, track)
 
 	if err != nil {
 		return err
@@ -927,10 +1160,66 @@ func (s *APIServer) handleCreateTrack(w http.ResponseWriter, r *http.Request) er
 
 func (s *APIServer) handleGetTracks(w http.ResponseWriter, r *http.Request) error {
 
-	account, err := s.dataBase.GetUser(r)
+	userID, err := getID(r)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, account.Tracks)
+	tracks, err := s.dataBase.GetTracks(userID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, tracks)
+}
+
+func (s *APIServer) getUser(r *http.Request) (*User, error) {
+	id, err := getID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dataBase.GetAccount(id)
+}
+
+// today returns the current day of the user.
+func (s *APIServer) today(userID int) (Date, error) {
+	user, err := s.dataBase.GetAccount(userID)
+	if err != nil {
+		return Date{}, err
+	}
+
+	return user.Settings.Today(s.clock.Now()), nil
+}
+
+func (s *APIServer) userToday(r *http.Request) (Date, error) {
+	id, err := getID(r)
+	if err != nil {
+		return Date{}, err
+	}
+
+	return s.today(id)
+}
+
+func (s *APIServer) getTrack(r *http.Request) (*Track, error) {
+	userID, key, err := getTrackPath(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dataBase.GetTrack(userID, key)
+}
+
+func (s *APIServer) getCard(r *http.Request) (*Card, error) {
+	userID, key, err := getTrackPath(r)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := getCardID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.dataBase.GetCard(userID, key, id)
 }
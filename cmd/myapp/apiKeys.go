@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	apiKeyPrefix = "vk."
+	maxAPIKeys   = 20
+	// apiKeyUseInterval limits how often LastUsedAt is written.
+	apiKeyUseInterval = time.Minute
+)
+
+// APIKey lets scripts use the API without logging in. ReadOnly keys may only
+// GET, and keys with Tracks only reach those tracks. Only a hash of the key
+// is kept.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Label      string     `json:"label"`
+	Hash       string     `json:"hash,omitempty"`
+	ReadOnly   bool       `json:"readOnly"`
+	Tracks     []string   `json:"tracks"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+func (k APIKey) Copy() APIKey {
+	k.Tracks = slices.Clone(k.Tracks)
+	if k.LastUsedAt != nil {
+		lastUsedAt := *k.LastUsedAt
+		k.LastUsedAt = &lastUsedAt
+	}
+	return k
+}
+
+// authenticateAPIKey checks a key of the form "vk.userID.keyID.secret".
+func authenticateAPIKey(store Store, token string) (*User, *APIKey, error) {
+	parts := strings.Split(strings.TrimPrefix(token, apiKeyPrefix), ".")
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("Invalid API key")
+	}
+
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid API key")
+	}
+
+	user, err := store.GetAccount(userID)
+	if err != nil || user.Suspended {
+		return nil, nil, fmt.Errorf("Invalid API key")
+	}
+
+	i := slices.IndexFunc(user.APIKeys, func(key APIKey) bool {
+		return key.ID == parts[1] && subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(parts[2]))) == 1
+	})
+	if i == -1 {
+		return nil, nil, fmt.Errorf("Invalid API key")
+	}
+
+	key := user.APIKeys[i].Copy()
+	if now := time.Now(); key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyUseInterval {
+		// Only the time of this key is written, on the account as it is
+		// now, so the use can't undo a change made since it was read.
+		err := store.UpdateUserFunc(user.ID, func(user *User) error {
+			i := slices.IndexFunc(user.APIKeys, func(k APIKey) bool {
+				return k.ID == key.ID
+			})
+			if i == -1 {
+				return fmt.Errorf("Invalid API key")
+			}
+
+			user.APIKeys[i].LastUsedAt = &now
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		key.LastUsedAt = &now
+	}
+
+	return user, &key, nil
+}
+
+func apiKeyFromContext(r *http.Request) (*APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey).(*APIKey)
+	return key, ok
+}
+
+// checkAPIKeyScope refuses requests outside the scope of the API key they
+// were made with. Track limited keys only reach routes naming one of their
+// tracks, apart from reading the account.
+func checkAPIKeyScope(r *http.Request, key *APIKey) error {
+	if key.ReadOnly && r.Method != "GET" && r.Method != "HEAD" {
+		return fmt.Errorf("API key is read-only")
+	}
+
+	track, ok := mux.Vars(r)["key"]
+	if !ok && r.Method == "DELETE" {
+		return fmt.Errorf("API keys can't delete the account")
+	}
+
+	if len(key.Tracks) == 0 {
+		return nil
+	}
+
+	if !ok {
+		if r.Method == "GET" && (r.URL.Path == "/user" || r.URL.Path == "/user/"+mux.Vars(r)["id"]) {
+			return nil
+		}
+		return fmt.Errorf("API key is limited to tracks %v", strings.Join(key.Tracks, ", "))
+	}
+
+	if !slices.Contains(key.Tracks, track) {
+		return fmt.Errorf("API key is limited to tracks %v", strings.Join(key.Tracks, ", "))
+	}
+	return nil
+}
+
+// sessionOnly refuses requests made with an API key, for routes managing the
+// account itself.
+func sessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := apiKeyFromContext(r); ok {
+			WriteJSON(w, http.StatusForbidden, APIError{Error: "API keys can't be used here"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *APIServer) handleAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		user, err := s.getUser(r)
+		if err != nil {
+			return err
+		}
+
+		var keys = make([]APIKey, len(user.APIKeys))
+		for i, key := range user.APIKeys {
+			keys[i] = key.Copy()
+			keys[i].Hash = ""
+		}
+		return WriteJSON(w, http.StatusOK, keys)
+	case "POST":
+		return s.handleCreateAPIKey(w, r)
+	default:
+		return fmt.Errorf("Method not allowed")
+	}
+}
+
+func (s *APIServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	var req CreateAPIKeyReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	user, err := s.getUser(r)
+	if err != nil {
+		return err
+	}
+
+	for _, track := range req.Tracks {
+		if !slices.Contains(user.TracksKeys, track) {
+			return fmt.Errorf("Track %v does't exist", track)
+		}
+	}
+
+	id, err := randomToken(9)
+	if err != nil {
+		return err
+	}
+	secret, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	var key = APIKey{
+		ID:        id,
+		Label:     req.Label,
+		Hash:      hashSecret(secret),
+		ReadOnly:  req.ReadOnly,
+		Tracks:    req.Tracks,
+		CreatedAt: time.Now(),
+	}
+	if key.Tracks == nil {
+		key.Tracks = []string{}
+	}
+
+	err = s.dataBase.UpdateUserFunc(user.ID, func(user *User) error {
+		if len(user.APIKeys) >= maxAPIKeys {
+			return fmt.Errorf("You can't have more than %d API keys", maxAPIKeys)
+		}
+
+		user.APIKeys = append(user.APIKeys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	key.Hash = ""
+	return WriteJSON(w, http.StatusOK, struct {
+		APIKey
+		Key string `json:"key"`
+	}{key, fmt.Sprintf("%s%d.%s.%s", apiKeyPrefix, user.ID, id, secret)})
+}
+
+func (s *APIServer) handleAPIKey(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "DELETE" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	keyID := mux.Vars(r)["keyID"]
+	err = s.dataBase.UpdateUserFunc(id, func(user *User) error {
+		i := slices.IndexFunc(user.APIKeys, func(key APIKey) bool {
+			return key.ID == keyID
+		})
+		if i == -1 {
+			return notFound("API key doesn't exist")
+		}
+
+		user.APIKeys = slices.Delete(user.APIKeys, i, i+1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{
+		Status: "revoked",
+	})
+}
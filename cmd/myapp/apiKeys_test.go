@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// newAPIKey creates a key for c and returns a client using it.
+func (c *testClient) newAPIKey(t *testing.T, req CreateAPIKeyReq) (*testClient, APIKey) {
+	var created struct {
+		APIKey
+		Key string `json:"key"`
+	}
+	if err := c.do("POST", c.path("/apiKeys"), req, &created); err != nil {
+		t.Fatal(err)
+	}
+
+	var keyClient = *c
+	keyClient.auth = Authentification{Id: c.auth.Id, Token: created.Key}
+	return &keyClient, created.APIKey
+}
+
+func TestAPIKeyScope(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	c, err := signUp(newTestServer(t, store).Handler(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.createTrack(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.do("POST", c.path("/track"), CreateTrackRequest{FromLanguage: "English", ToLanguage: "German", DaylyTestTries: 3, DaylyTestCards: 1, DaylyStudyCards: 5}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	full, _ := c.newAPIKey(t, CreateAPIKeyReq{Label: "full"})
+	readOnly, _ := c.newAPIKey(t, CreateAPIKeyReq{Label: "read", ReadOnly: true})
+	limited, _ := c.newAPIKey(t, CreateAPIKeyReq{Label: "track", Tracks: []string{testTrack}})
+
+	card := newCardRequest{Card: F{Data: "word", TranslatedData: []string{"translation"}}, OldID: -1}
+	var tests = []struct {
+		name   string
+		client *testClient
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{"full key reads", full, "GET", c.path("/track/" + testTrack + "/card"), nil, http.StatusOK},
+		{"full key writes", full, "POST", c.path("/track/" + testTrack + "/card"), card, http.StatusOK},
+		{"full key deletes the account", full, "DELETE", c.path(""), nil, http.StatusForbidden},
+		{"read-only key reads", readOnly, "GET", c.path("/track/" + testTrack + "/card"), nil, http.StatusOK},
+		{"read-only key writes", readOnly, "POST", c.path("/track/" + testTrack + "/card"), card, http.StatusForbidden},
+		{"read-only key changes settings", readOnly, "POST", c.path("/settings"), Settings{}, http.StatusForbidden},
+		{"track key reads its track", limited, "GET", c.path("/track/" + testTrack + "/card"), nil, http.StatusOK},
+		{"track key writes its track", limited, "POST", c.path("/track/" + testTrack + "/card"), card, http.StatusOK},
+		{"track key reads the account", limited, "GET", c.path(""), nil, http.StatusOK},
+		{"track key reads another track", limited, "GET", c.path("/track/English-German/card"), nil, http.StatusForbidden},
+		{"track key lists the tracks", limited, "GET", c.path("/track"), nil, http.StatusForbidden},
+		{"track key changes settings", limited, "POST", c.path("/settings"), Settings{}, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := test.client.code(test.method, test.path, test.body); code != test.want {
+				t.Errorf("%v %v: got %d, want %d", test.method, test.path, code, test.want)
+			}
+		})
+	}
+}
+
+// Routes managing the account itself only take a session, whatever the
+// scope of the key.
+func TestAPIKeySessionOnlyRoutes(t *testing.T) {
+	c, err := signUp(newTestServer(t, NewMemoryStorage(nil)).Handler(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := c.newAPIKey(t, CreateAPIKeyReq{Label: "full"})
+
+	var routes = []struct {
+		method string
+		path   string
+		body   any
+	}{
+		{"GET", c.path("/apiKeys"), nil},
+		{"POST", c.path("/apiKeys"), CreateAPIKeyReq{Label: "another"}},
+		{"GET", c.path("/consent"), nil},
+		{"GET", c.path("/consent/history"), nil},
+		{"PUT", c.path("/password"), ChangePasswordReq{OldPassword: "password", NewPassword: "changed"}},
+		{"GET", c.path("/export"), nil},
+		{"POST", c.path("/erasure"), nil},
+		{"POST", "/verifyEMail/send", nil},
+	}
+
+	for _, route := range routes {
+		if code := key.code(route.method, route.path, route.body); code != http.StatusForbidden {
+			t.Errorf("%v %v with an API key: got %d, want %d", route.method, route.path, code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestAPIKeyRevokeAndLastUsed(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	c, err := signUp(newTestServer(t, store).Handler(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used, usedKey := c.newAPIKey(t, CreateAPIKeyReq{Label: "used"})
+	_, otherKey := c.newAPIKey(t, CreateAPIKeyReq{Label: "other"})
+
+	if err := used.do("GET", c.path(""), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the key that was used gets its time.
+	user, err := store.GetUserByID(c.auth.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range user.APIKeys {
+		if wantUsed := key.ID == usedKey.ID; (key.LastUsedAt != nil) != wantUsed {
+			t.Errorf("Key %v has LastUsedAt %v, want it set %v", key.Label, key.LastUsedAt, wantUsed)
+		}
+	}
+
+	if err := c.do("DELETE", c.path("/apiKeys/"+usedKey.ID), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code := used.code("GET", c.path(""), nil); code != http.StatusUnauthorized {
+		t.Errorf("Revoked key: got %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	if user, err = store.GetUserByID(c.auth.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(user.APIKeys) != 1 || user.APIKeys[0].ID != otherKey.ID {
+		t.Errorf("Keys left %+v, want only %v", user.APIKeys, otherKey.Label)
+	}
+}
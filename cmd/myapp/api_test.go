@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testTrack  = "Ukrainian-English"
+	testAppURL = "https://app.example.com"
+)
+
+func TestMain(m *testing.M) {
+	passwordCost = bcrypt.MinCost
+	os.Setenv("APP_URL", testAppURL)
+	os.Exit(m.Run())
+}
+
+func newTestTokens() *TokenIssuer {
+	return &TokenIssuer{
+		keys:       []signingKey{{"test", []byte(strings.Repeat("k", 32))}},
+		AccessTTL:  time.Hour,
+		RefreshTTL: time.Hour,
+	}
+}
+
+func newTestServer(t *testing.T, store Store) *APIServer {
+	tokens := newTestTokens()
+
+	eraser, err := NewEraserFromEnv(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roller, err := NewRollerFromEnv(store, systemClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewAPISErver(":0", store, nil, eraser, roller, tokens, &FileMailer{dir: t.TempDir()})
+}
+
+// slowReads widens the gap between reading a track and writing it back, so
+// a handler writing back a stale copy reliably loses updates.
+type slowReads struct {
+	Store
+}
+
+func (s slowReads) GetTrack(userID int, key string) (*Track, error) {
+	track, err := s.Store.GetTrack(userID, key)
+	time.Sleep(time.Millisecond)
+	return track, err
+}
+
+func (s slowReads) GetUserByID(id int) (*User, error) {
+	user, err := s.Store.GetUserByID(id)
+	time.Sleep(time.Millisecond)
+	return user, err
+}
+
+// testClient calls the API as one user from an IP of its own, so the rate
+// limits of one client don't slow down the others.
+type testClient struct {
+	handler http.Handler
+	ip      string
+	auth    Authentification
+}
+
+func (c *testClient) path(path string) string {
+	return fmt.Sprintf("/user/%d%s", c.auth.Id, path)
+}
+
+func (c *testClient) serve(method, path string, body any) (*httptest.ResponseRecorder, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	r := httptest.NewRequest(method, path, bytes.NewReader(data))
+	r.RemoteAddr = c.ip + ":1234"
+	if c.auth.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.auth.Token)
+	}
+
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, r)
+	return w, nil
+}
+
+// code makes a request and returns only its status code.
+func (c *testClient) code(method, path string, body any) int {
+	w, err := c.serve(method, path, body)
+	if err != nil {
+		return 0
+	}
+	return w.Code
+}
+
+func (c *testClient) do(method, path string, body any, out any) error {
+	w, err := c.serve(method, path, body)
+	if err != nil {
+		return err
+	}
+
+	if w.Code != http.StatusOK {
+		var apiErr APIError
+		json.Unmarshal(w.Body.Bytes(), &apiErr)
+		return fmt.Errorf("%v %v: %d %v", method, path, w.Code, apiErr.Error)
+	}
+	if out != nil {
+		return json.Unmarshal(w.Body.Bytes(), out)
+	}
+	return nil
+}
+
+func signUp(handler http.Handler, i int) (*testClient, error) {
+	var c = &testClient{handler: handler, ip: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1)}
+
+	req := SingUp{FirstName: "First", LastName: "Last", Username: fmt.Sprintf("user%d", i), EMail: fmt.Sprintf("user%d@example.com", i), Password: "password"}
+	if err := c.do("POST", "/register", req, &c.auth); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *testClient) createTrack(tries int) error {
+	return c.do("POST", c.path("/track"), CreateTrackRequest{FromLanguage: "Ukrainian", ToLanguage: "English", DaylyTestTries: tries, DaylyTestCards: 1, DaylyStudyCards: 5}, nil)
+}
+
+func (c *testClient) postCard(word string, oldID int) (Card, error) {
+	var card Card
+	err := c.do("POST", c.path("/track/"+testTrack+"/card"), newCardRequest{Card: F{Data: word, TranslatedData: []string{"translation"}}, OldID: oldID}, &card)
+	return card, err
+}
+
+// TestConcurrentRequests signs users up, posts cards and posts test results
+// in parallel while the rollover runs. Run it with -race.
+func TestConcurrentRequests(t *testing.T) {
+	const users = 6
+	const cardsPerUser = 12
+	const tries = 5
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		handler := newTestServer(t, slowReads{store}).Handler()
+
+		var clients = make([]*testClient, users)
+		var wg sync.WaitGroup
+		for i := range clients {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				c, err := signUp(handler, i)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				clients[i] = c
+			}(i)
+		}
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
+
+		for _, c := range clients {
+			if err := c.createTrack(tries); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, c := range clients {
+			for j := 0; j < cardsPerUser; j++ {
+				wg.Add(1)
+				go func(c *testClient, j int) {
+					defer wg.Done()
+					if _, err := c.postCard(fmt.Sprintf("word%d", j), -1); err != nil {
+						t.Error(err)
+					}
+				}(c, j)
+			}
+
+			wg.Add(2)
+			go func(c *testClient) {
+				defer wg.Done()
+				if _, err := store.RollOver(c.auth.Id, Settings{}.Today(time.Now())); err != nil {
+					t.Error(err)
+				}
+			}(c)
+			go func(c *testClient) {
+				defer wg.Done()
+				if err := c.do("GET", c.path("/track/"+testTrack+"/card"), nil, nil); err != nil {
+					t.Error(err)
+				}
+			}(c)
+		}
+		wg.Wait()
+
+		for _, c := range clients {
+			track, err := store.GetTrack(c.auth.Id, testTrack)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids = map[int]bool{}
+			for _, card := range track.Storage {
+				ids[card.ID] = true
+			}
+			if len(track.Storage) != cardsPerUser || len(ids) != cardsPerUser {
+				t.Errorf("User %d has %d cards with %d IDs, want %d", c.auth.Id, len(track.Storage), len(ids), cardsPerUser)
+			}
+		}
+
+		// Every try counts and is reviewed, the last one fails the test and
+		// schedules the cards once.
+		for _, c := range clients {
+			for j := 0; j < tries; j++ {
+				wg.Add(1)
+				go func(c *testClient) {
+					defer wg.Done()
+					req := CreateTestStatusRequest{Passed: false, IDs: []int{1, 2}}
+					if err := c.do("POST", c.path("/track/"+testTrack+"/test/fromLanguage"), req, nil); err != nil {
+						t.Error(err)
+					}
+				}(c)
+			}
+		}
+		wg.Wait()
+
+		for _, c := range clients {
+			track, err := store.GetTrack(c.auth.Id, testTrack)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test := track.FromLanguage; test.Status != "failed" || test.DaylyTestTries != 0 {
+				t.Errorf("User %d: test is %v with %d tries left, want failed with 0", c.auth.Id, test.Status, test.DaylyTestTries)
+			}
+			for _, card := range track.getCardsByIDs([]int{1, 2}) {
+				if card.FromLanguage.Lapses != 1 {
+					t.Errorf("User %d: card %d has %d lapses, want 1", c.auth.Id, card.ID, card.FromLanguage.Lapses)
+				}
+			}
+
+			reviews, err := store.GetReviews(c.auth.Id, ReviewFilter{Track: testTrack})
+			if err != nil || len(reviews) != 2*tries {
+				t.Errorf("User %d: got %d reviews, %v, want %d", c.auth.Id, len(reviews), err, 2*tries)
+			}
+		}
+	})
+}
+
+// TestConcurrentCardReplace replaces one card from several requests at
+// once: one of them wins, the others find the card gone.
+func TestConcurrentCardReplace(t *testing.T) {
+	const posts = 4
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		c, err := signUp(newTestServer(t, slowReads{store}).Handler(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.createTrack(3); err != nil {
+			t.Fatal(err)
+		}
+
+		card, err := c.postCard("word", -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var replaced []Card
+		for i := 0; i < posts; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if newCard, err := c.postCard(fmt.Sprintf("word%d", i), card.ID); err == nil {
+					mu.Lock()
+					replaced = append(replaced, newCard)
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if len(replaced) != 1 {
+			t.Fatalf("%d of %d replacements succeeded, want 1", len(replaced), posts)
+		}
+
+		track, err := store.GetTrack(c.auth.Id, testTrack)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(track.Storage) != 1 || track.Storage[0].ID != replaced[0].ID || track.Storage[0].ID == card.ID {
+			t.Errorf("Track holds %+v, want only the replacement %d", track.Storage, replaced[0].ID)
+		}
+	})
+}
+
+// TestConcurrentAccountChanges changes one account from several requests
+// at once: API keys, consents, settings and the erasure, none of the
+// changes may undo another. Run it with -race.
+func TestConcurrentAccountChanges(t *testing.T) {
+	const changes = 5
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		c, err := signUp(newTestServer(t, slowReads{store}).Handler(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var requests = []func() error{
+			func() error {
+				return c.do("POST", c.path("/settings"), Settings{TimeZone: "Europe/Kyiv"}, nil)
+			},
+			func() error {
+				return c.do("POST", c.path("/erasure"), nil, nil)
+			},
+		}
+		for i := 0; i < changes; i++ {
+			requests = append(requests, func() error {
+				return c.do("POST", c.path("/apiKeys"), CreateAPIKeyReq{Label: fmt.Sprint(i)}, nil)
+			}, func() error {
+				return c.do("POST", c.path("/consent"), ConsentReq{PolicyVersion: policyVersion(), Categories: []string{}}, nil)
+			})
+		}
+
+		var wg sync.WaitGroup
+		for _, request := range requests {
+			wg.Add(1)
+			go func(request func() error) {
+				defer wg.Done()
+				if err := request(); err != nil {
+					t.Error(err)
+				}
+			}(request)
+		}
+		wg.Wait()
+
+		user, err := store.GetUserByID(c.auth.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(user.APIKeys) != changes || len(user.Consents) != changes {
+			t.Errorf("User has %d API keys and %d consents, want %d each", len(user.APIKeys), len(user.Consents), changes)
+		}
+		if user.Settings.TimeZone != "Europe/Kyiv" || user.Erasure == nil || len(user.Sessions) != 1 {
+			t.Errorf("Got time zone %q, erasure %v and %d sessions, want all changes kept", user.Settings.TimeZone, user.Erasure, len(user.Sessions))
+		}
+	})
+}
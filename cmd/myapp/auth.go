@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Authentification struct {
+	Id           int       `json:"id"`
+	UserName     string    `json:"userName"`
+	EMail        string    `json:"eMail"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RefreshToken string    `json:"refreshToken"`
+}
+
+var errIncorrectPassword = errors.New("Incorect password")
+
+func SingUpUser(store Store, tokens *TokenIssuer, req SingUp) (Authentification, error) {
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return Authentification{}, err
+	}
+
+	user, err := store.CreateAccount(*NewUser(req.FirstName, req.LastName, req.EMail, req.Username, hash))
+
+	if err != nil {
+		return Authentification{}, err
+	}
+	return tokens.NewSession(store, user.ID, nil)
+}
+
+func LogInUser(store Store, tokens *TokenIssuer, req LogInReq) (Authentification, error) {
+	user, err := store.GetUserByLogin(req.UsernameEMail)
+	if err != nil {
+		return Authentification{}, err
+	}
+
+	ok, legacy := checkPassword(user.Password, req.Password)
+	if !ok {
+		return Authentification{}, errIncorrectPassword
+	}
+
+	var rehashed string
+	if legacy {
+		if rehashed, err = hashPassword(req.Password); err != nil {
+			return Authentification{}, err
+		}
+	}
+
+	// The password was checked outside the update, bcrypt is slow. It still
+	// has to be the one checked when the session is written.
+	checked := user.Password
+	return tokens.NewSession(store, user.ID, func(user *User) error {
+		if user.Password != checked {
+			return errIncorrectPassword
+		}
+		if legacy {
+			user.Password = rehashed
+		}
+		return nil
+	})
+}
+
+// ChangePassword sets a new password and ends every session of the user,
+// the device changing it gets a new one.
+func ChangePassword(store Store, tokens *TokenIssuer, userID int, req ChangePasswordReq) (Authentification, error) {
+	user, err := store.GetAccount(userID)
+	if err != nil {
+		return Authentification{}, err
+	}
+
+	if ok, _ := checkPassword(user.Password, req.OldPassword); !ok {
+		return Authentification{}, errIncorrectPassword
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return Authentification{}, err
+	}
+
+	checked := user.Password
+	return tokens.NewSession(store, user.ID, func(user *User) error {
+		if user.Password != checked {
+			return errIncorrectPassword
+		}
+
+		user.Password = hash
+		user.Sessions = nil
+		return nil
+	})
+}
+
+// passwordCost is the bcrypt cost of new hashes, tests lower it.
+var passwordCost = bcrypt.DefaultCost
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// checkPassword compares password with the stored one. Accounts created
+// before hashing was added still hold the plain text, legacy reports those
+// so they can be rehashed after a successful log in.
+func checkPassword(stored, password string) (ok, legacy bool) {
+	if _, err := bcrypt.Cost([]byte(stored)); err != nil {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	apiKeyContextKey
+)
+
+func userFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userContextKey).(*User)
+	return user, ok
+}
+
+// authMiddleware lets a request through only with a valid bearer token, a
+// session token or an API key, and puts its user into the request context.
+// A path naming another user's {id} is refused, and so is anything outside
+// the scope of an API key.
+func (s *APIServer) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			WriteJSON(w, http.StatusUnauthorized, APIError{Error: "Missing bearer token"})
+			return
+		}
+
+		var ctx = r.Context()
+		var user *User
+		var err error
+
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			var key *APIKey
+			user, key, err = authenticateAPIKey(s.dataBase, token)
+			ctx = context.WithValue(ctx, apiKeyContextKey, key)
+		} else {
+			user, err = s.tokens.Authenticate(s.dataBase, token)
+		}
+		if err != nil {
+			WriteJSON(w, http.StatusUnauthorized, APIError{Error: err.Error()})
+			return
+		}
+
+		if id, ok := mux.Vars(r)["id"]; ok && id != strconv.Itoa(user.ID) {
+			WriteJSON(w, http.StatusForbidden, APIError{Error: "Access denied"})
+			return
+		}
+
+		r = r.WithContext(context.WithValue(ctx, userContextKey, user))
+
+		if key, ok := apiKeyFromContext(r); ok {
+			if err := checkAPIKeyScope(r, key); err != nil {
+				WriteJSON(w, http.StatusForbidden, APIError{Error: err.Error()})
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireRole lets through only users with one of roles. It runs after
+// authMiddleware.
+func requireRole(roles ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user, ok := userFromContext(r.Context()); !ok || !slices.Contains(roles, user.Role) {
+				WriteJSON(w, http.StatusForbidden, APIError{Error: "Access denied"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
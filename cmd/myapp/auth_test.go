@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestUserRoutesNeedOwner calls every route of user B as user A, which gets
+// 403 and leaves B's data alone.
+func TestUserRoutesNeedOwner(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	handler := newTestServer(t, store).Handler()
+
+	a, err := signUp(handler, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := signUp(handler, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.createTrack(1); err != nil {
+		t.Fatal(err)
+	}
+	card, err := b.postCard("word", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	track := "/track/" + testTrack
+	cardPath := fmt.Sprintf("%v/card/%d", track, card.ID)
+	var routes = []struct {
+		method string
+		path   string
+		body   any
+	}{
+		{"GET", "", nil},
+		{"DELETE", "", nil},
+		{"GET", "/settings", nil},
+		{"POST", "/settings", Settings{}},
+		{"PUT", "/password", ChangePasswordReq{OldPassword: "password", NewPassword: "stolen password"}},
+		{"GET", "/consent", nil},
+		{"GET", "/consent/history", nil},
+		{"GET", "/apiKeys", nil},
+		{"POST", "/apiKeys", CreateAPIKeyReq{Label: "stolen"}},
+		{"GET", "/export", nil},
+		{"GET", "/erasure", nil},
+		{"POST", "/erasure", nil},
+		{"GET", "/track", nil},
+		{"DELETE", track, nil},
+		{"GET", track + "/card", nil},
+		{"POST", track + "/card", newCardRequest{Card: F{Data: "other", TranslatedData: []string{"translation"}}, OldID: -1}},
+		{"GET", cardPath, nil},
+		{"DELETE", cardPath, nil},
+		{"GET", cardPath + "/reviews", nil},
+		{"GET", track + "/reviews", nil},
+		{"POST", track + "/settings", TrackSettings{}},
+		{"GET", track + "/backlog", nil},
+		{"GET", track + "/leeches", nil},
+		{"GET", track + "/test/fromLanguage", nil},
+		{"POST", track + "/test/fromLanguage", CreateTestStatusRequest{Passed: true, IDs: []int{card.ID}}},
+	}
+
+	for _, route := range routes {
+		if code := a.code(route.method, b.path(route.path), route.body); code != http.StatusForbidden {
+			t.Errorf("%v %v as another user: got %d, want %d", route.method, b.path(route.path), code, http.StatusForbidden)
+		}
+	}
+
+	var anonymous = &testClient{handler: handler, ip: "10.1.0.1"}
+	if code := anonymous.code("GET", b.path(track+"/card"), nil); code != http.StatusUnauthorized {
+		t.Errorf("GET %v without a token: got %d, want %d", b.path(track+"/card"), code, http.StatusUnauthorized)
+	}
+
+	user, err := store.GetUserByID(b.auth.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Erasure != nil || len(user.APIKeys) != 0 || len(user.Tracks) != 1 || len(user.Tracks[0].Storage) != 1 {
+		t.Errorf("The refused requests changed user B: %+v", user)
+	}
+	if ok, _ := checkPassword(user.Password, "password"); !ok {
+		t.Error("The refused requests changed the password of user B")
+	}
+}
+
+// Accounts from before hashing hold the plain text password, a log in
+// replaces it with a hash.
+func TestLegacyPasswordRehash(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	tokens := newTestTokens()
+
+	user, err := store.CreateAccount(*NewUser("First", "Last", "old@example.com", "old", "plain password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LogInUser(store, tokens, LogInReq{UsernameEMail: "old", Password: "wrong"}); !errors.Is(err, errIncorrectPassword) {
+		t.Errorf("Logging in with a wrong password: %v", err)
+	}
+	if got, _ := store.GetAccount(user.ID); got.Password != "plain password" {
+		t.Errorf("A failed log in changed the password to %q", got.Password)
+	}
+
+	if _, err := LogInUser(store, tokens, LogInReq{UsernameEMail: "old", Password: "plain password"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetAccount(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bcrypt.Cost([]byte(got.Password)); err != nil {
+		t.Fatalf("The password wasn't rehashed: %q", got.Password)
+	}
+	if ok, legacy := checkPassword(got.Password, "plain password"); !ok || legacy {
+		t.Errorf("checkPassword on the new hash = %v, %v, want true, false", ok, legacy)
+	}
+
+	for _, password := range []string{"plain password", got.Password} {
+		_, err := LogInUser(store, tokens, LogInReq{UsernameEMail: "old", Password: password})
+		if (password == got.Password) != (err != nil) {
+			t.Errorf("Logging in with %q after the rehash: %v", password, err)
+		}
+	}
+}
+
+// No response holds the password hash or secrets of an account.
+func TestPasswordNotInResponses(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	server := newTestServer(t, store)
+	handler := server.Handler()
+
+	admin := signUpAs(t, handler, store, 0, RoleAdmin)
+	c, err := signUp(handler, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.newAPIKey(t, CreateAPIKeyReq{Label: "script"})
+
+	var routes = []struct {
+		client *testClient
+		method string
+		path   string
+		body   any
+	}{
+		{c, "PUT", "/register", LogInReq{UsernameEMail: "user1", Password: "password"}},
+		{c, "PUT", "/getUserByToken", GetUserByTokenReq{Token: c.auth.Token}},
+		{c, "GET", "/user", nil},
+		{c, "GET", c.path(""), nil},
+		{c, "GET", c.path("/settings"), nil},
+		{c, "GET", c.path("/apiKeys"), nil},
+		{c, "PUT", c.path("/password"), ChangePasswordReq{OldPassword: "password", NewPassword: "password"}},
+		{admin, "GET", "/admin/users", nil},
+		{admin, "GET", fmt.Sprintf("/admin/users/%d", c.auth.Id), nil},
+	}
+
+	var bodies []string
+	for _, route := range routes {
+		w, err := route.client.serve(route.method, route.path, route.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("%v %v: got %d, %v", route.method, route.path, w.Code, w.Body)
+		}
+		bodies = append(bodies, fmt.Sprintf("%v %v: %v", route.method, route.path, w.Body))
+	}
+
+	user, err := store.GetAccount(c.auth.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secrets = []string{user.Password, `"password"`, `"hash"`, `"refreshHash"`}
+	for _, session := range user.Sessions {
+		secrets = append(secrets, session.RefreshHash)
+	}
+	for _, key := range user.APIKeys {
+		secrets = append(secrets, key.Hash)
+	}
+
+	for _, body := range bodies {
+		for _, secret := range secrets {
+			if secret != "" && strings.Contains(body, secret) {
+				t.Errorf("%v holds %v", body, secret)
+			}
+		}
+	}
+}
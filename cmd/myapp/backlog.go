@@ -0,0 +1,213 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+const (
+	BacklogOverdue   = "overdue"
+	BacklogStability = "stability"
+
+	maxPreviewDays     = 365
+	defaultPreviewDays = 14
+)
+
+var backlogOrders = []string{BacklogOverdue, BacklogStability}
+
+// BacklogPolicy decides which cards are due on a day when more are due than
+// the user wants to do, like after a week away. The zero policy makes every
+// due and overdue card due today.
+type BacklogPolicy struct {
+	// MaxDueCards caps the cards due per day in each direction, 0 for no
+	// cap. The cards over it are moved to the next day with room.
+	MaxDueCards int `json:"maxDueCards"`
+	// SpreadDays spreads the overdue cards evenly over that many days.
+	SpreadDays int `json:"spreadDays"`
+	// Order is which cards go first: the most overdue (the default) or the
+	// ones with the lowest stability.
+	Order string `json:"order"`
+}
+
+func checkBacklogPolicy(policy BacklogPolicy) error {
+	if policy.MaxDueCards < 0 || policy.SpreadDays < 0 {
+		return fmt.Errorf("Backlog limits can't be negative")
+	}
+
+	if policy.Order != "" && !slices.Contains(backlogOrders, policy.Order) {
+		return fmt.Errorf("Unknown backlog order %v, use overdue or stability", policy.Order)
+	}
+	return nil
+}
+
+// planBacklog sets the repeat dates of the cards due today or earlier in
+// every direction following the backlog policy of the track. Cards that
+// already are due later only count towards MaxDueCards, suspended cards
+// aren't planned.
+func (t *Track) planBacklog(today Date) {
+	policy := t.Settings.Backlog
+
+	for _, name := range testNames {
+		var backlog []*TestData
+		var load = map[Date]int{}
+		for i := range t.Storage {
+			if t.Storage[i].Suspended {
+				continue
+			}
+			data, _ := t.Storage[i].getTest(name)
+			if data.ReapeatDate.After(today) {
+				load[data.ReapeatDate]++
+			} else {
+				backlog = append(backlog, data)
+			}
+		}
+
+		slices.SortStableFunc(backlog, func(a, b *TestData) int {
+			if policy.Order == BacklogStability {
+				if c := cmp.Compare(backlogStability(a), backlogStability(b)); c != 0 {
+					return c
+				}
+			}
+			return cmp.Compare(a.ReapeatDate.DaysSince(today), b.ReapeatDate.DaysSince(today))
+		})
+
+		// share is how many overdue cards each of the SpreadDays takes.
+		var share int
+		if policy.SpreadDays > 1 {
+			var overdue int
+			for _, data := range backlog {
+				if data.ReapeatDate.Before(today) {
+					overdue++
+				}
+			}
+			share = (overdue + policy.SpreadDays - 1) / policy.SpreadDays
+		}
+
+		var spread = map[int]int{}
+		for _, data := range backlog {
+			overdue := data.ReapeatDate.Before(today)
+
+			var day int
+			for ; ; day++ {
+				if policy.MaxDueCards > 0 && load[today.AddDays(day)] >= policy.MaxDueCards {
+					continue
+				}
+				if overdue && share > 0 && day < policy.SpreadDays && spread[day] >= share {
+					continue
+				}
+				break
+			}
+
+			if overdue {
+				spread[day]++
+			}
+			data.ReapeatDate = today.AddDays(day)
+			load[data.ReapeatDate]++
+		}
+	}
+}
+
+// backlogStability is the stability of a card for the fsrs scheduler and
+// its interval for the others.
+func backlogStability(data *TestData) float64 {
+	if data.Stability > 0 {
+		return data.Stability
+	}
+	return float64(data.Interval)
+}
+
+// BacklogDay is the number of cards due on a day in each direction.
+type BacklogDay struct {
+	Date  Date           `json:"date"`
+	Cards map[string]int `json:"cards"`
+	Total int            `json:"total"`
+}
+
+// previewBacklog returns the cards due on each of the next days if the
+// track followed policy from today on.
+func (t Track) previewBacklog(policy BacklogPolicy, today Date, days int) []BacklogDay {
+	t = t.Copy()
+	t.Settings.Backlog = policy
+	t.planBacklog(today)
+
+	// Listening and writing are left out when the track doesn't use them.
+	var names []string
+	for _, name := range testNames {
+		if _, err := t.defineTest(name); err == nil {
+			names = append(names, name)
+		}
+	}
+
+	var preview = make([]BacklogDay, days)
+	for i := range preview {
+		preview[i] = BacklogDay{Date: today.AddDays(i), Cards: map[string]int{}}
+		for _, name := range names {
+			preview[i].Cards[name] = 0
+		}
+	}
+
+	for _, card := range t.Storage {
+		if card.Suspended {
+			continue
+		}
+		for _, name := range names {
+			data, _ := card.getTest(name)
+			if day := data.ReapeatDate.DaysSince(today); day >= 0 && day < days {
+				preview[day].Cards[name]++
+				preview[day].Total++
+			}
+		}
+	}
+	return preview
+}
+
+// handleBacklog shows the daily load of the track for ?days= days (14 by
+// default). GET uses the policy of the track, POST the policy in the body,
+// to try it before saving it.
+func (s *APIServer) handleBacklog(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "POST" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	var days = defaultPreviewDays
+	if str := r.URL.Query().Get("days"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 1 || n > maxPreviewDays {
+			return fmt.Errorf("Days has to be between 1 and %d", maxPreviewDays)
+		}
+		days = n
+	}
+
+	track, err := s.getTrack(r)
+	if err != nil {
+		return err
+	}
+
+	var policy = track.Settings.Backlog
+	if r.Method == "POST" {
+		policy = BacklogPolicy{}
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			return err
+		}
+		if err := checkBacklogPolicy(policy); err != nil {
+			return err
+		}
+	}
+
+	today, err := s.userToday(r)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Policy BacklogPolicy `json:"policy"`
+		Days   []BacklogDay  `json:"days"`
+	}{
+		Policy: policy,
+		Days:   track.previewBacklog(policy, today, days),
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// newBacklogTrack returns a track with a card due on each of the days, as
+// days from testToday, in every direction.
+func newBacklogTrack(policy BacklogPolicy, due []int, stability []float64, suspended []int) Track {
+	track := NewTrack(&CreateTrackRequest{FromLanguage: "Ukrainian", ToLanguage: "English", DaylyTestTries: 3, DaylyTestCards: 1, DaylyStudyCards: 5})
+	track.Settings.Backlog = policy
+
+	for i, day := range due {
+		card := newTestCard(i+1, testToday)
+		card.Suspended = slices.Contains(suspended, i)
+		for _, name := range testNames {
+			data, _ := card.getTest(name)
+			data.ReapeatDate = testToday.AddDays(day)
+			if stability != nil {
+				data.Stability = stability[i]
+			}
+		}
+		track.Storage = append(track.Storage, card)
+	}
+	return track
+}
+
+func TestPlanBacklog(t *testing.T) {
+	var tests = []struct {
+		name      string
+		policy    BacklogPolicy
+		due       []int
+		stability []float64
+		suspended []int
+		want      []int
+	}{
+		{"no policy makes everything due today", BacklogPolicy{}, []int{-3, -1, 0, 2}, nil, nil, []int{0, 0, 0, 2}},
+		{"cap moves the rest to the next days", BacklogPolicy{MaxDueCards: 2}, []int{-3, -2, -1, 0, 0}, nil, nil, []int{0, 0, 1, 1, 2}},
+		{"cap counts cards due later", BacklogPolicy{MaxDueCards: 2}, []int{-1, -1, -1, 1, 1}, nil, nil, []int{0, 0, 2, 1, 1}},
+		{"cap of one", BacklogPolicy{MaxDueCards: 1}, []int{-1, -2, -3}, nil, nil, []int{2, 1, 0}},
+		{"spread over days", BacklogPolicy{SpreadDays: 3}, []int{-5, -4, -3, -2, -1, 0, 0}, nil, nil, []int{0, 0, 1, 1, 2, 0, 0}},
+		{"spread of one day", BacklogPolicy{SpreadDays: 1}, []int{-2, -1}, nil, nil, []int{0, 0}},
+		{"spread and cap", BacklogPolicy{MaxDueCards: 3, SpreadDays: 2}, []int{-4, -3, -2, -1, 0}, nil, nil, []int{0, 0, 1, 1, 0}},
+		{"most overdue first", BacklogPolicy{MaxDueCards: 1}, []int{-3, -1}, []float64{10, 1}, nil, []int{0, 1}},
+		{"least stable first", BacklogPolicy{MaxDueCards: 1, Order: BacklogStability}, []int{-3, -1}, []float64{10, 1}, nil, []int{1, 0}},
+		{"suspended cards stay and don't count", BacklogPolicy{MaxDueCards: 1}, []int{-2, -1}, nil, []int{0}, []int{-2, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			track := newBacklogTrack(test.policy, test.due, test.stability, test.suspended)
+			track.planBacklog(testToday)
+
+			for _, name := range testNames {
+				var got []int
+				for _, card := range track.Storage {
+					data, _ := card.getTest(name)
+					got = append(got, data.ReapeatDate.DaysSince(testToday))
+				}
+				if !slices.Equal(got, test.want) {
+					t.Errorf("%v: cards due on days %v, want %v", name, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPreviewBacklog(t *testing.T) {
+	track := newBacklogTrack(BacklogPolicy{}, []int{-1, -1, -1, 1}, nil, nil)
+
+	var tests = []struct {
+		policy BacklogPolicy
+		want   []int
+	}{
+		{BacklogPolicy{}, []int{3, 1, 0}},
+		{BacklogPolicy{MaxDueCards: 2}, []int{2, 2, 0}},
+		{BacklogPolicy{SpreadDays: 3}, []int{1, 2, 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%+v", test.policy), func(t *testing.T) {
+			preview := track.previewBacklog(test.policy, testToday, len(test.want))
+			if len(preview) != len(test.want) {
+				t.Fatalf("Got %d days, want %d", len(preview), len(test.want))
+			}
+
+			for i, day := range preview {
+				if day.Date != testToday.AddDays(i) {
+					t.Errorf("Day %d is %v, want %v", i, day.Date, testToday.AddDays(i))
+				}
+
+				// Listening and writing aren't used by the track.
+				want := map[string]int{"fromLanguage": test.want[i], "toLanguage": test.want[i]}
+				if len(day.Cards) != len(want) || day.Cards["fromLanguage"] != want["fromLanguage"] || day.Cards["toLanguage"] != want["toLanguage"] || day.Total != 2*test.want[i] {
+					t.Errorf("Day %d: got %v (total %d), want %v", i, day.Cards, day.Total, want)
+				}
+			}
+		})
+	}
+
+	// The preview leaves the track as it is.
+	for _, card := range track.Storage[:3] {
+		if card.FromLanguage.ReapeatDate != testToday.AddDays(-1) {
+			t.Errorf("The preview moved card %d to %v", card.ID, card.FromLanguage.ReapeatDate)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Clock tells the time to the code deciding what is due, so it can be run
+// at any moment instead of only now.
+type Clock interface {
+	Now() time.Time
+}
+
+// ClockFunc makes a function a Clock.
+type ClockFunc func() time.Time
+
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+var systemClock Clock = ClockFunc(time.Now)
+
+// dateLayout is how dates are written, legacyDateLayout how they were
+// written before Date.
+const (
+	dateLayout       = "2006-01-02"
+	legacyDateLayout = "2006.01.02"
+)
+
+// Date is a day in the calendar, without a time or a zone. The zero Date is
+// no day and is written as "".
+type Date struct {
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+// DateOf returns the day of t in its location.
+func DateOf(t time.Time) Date {
+	year, month, day := t.Date()
+	return Date{year, month, day}
+}
+
+// ParseDate reads dates in dateLayout and legacyDateLayout.
+func ParseDate(s string) (Date, error) {
+	if s == "" {
+		return Date{}, nil
+	}
+
+	layout := dateLayout
+	if strings.Contains(s, ".") {
+		layout = legacyDateLayout
+	}
+
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return Date{}, fmt.Errorf("Invalid date %q", s)
+	}
+	return DateOf(t), nil
+}
+
+func (d Date) IsZero() bool {
+	return d == Date{}
+}
+
+func (d Date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.time().Format(dateLayout)
+}
+
+func (d Date) time() time.Time {
+	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, time.UTC)
+}
+
+func (d Date) AddDays(days int) Date {
+	return DateOf(d.time().AddDate(0, 0, days))
+}
+
+// DaysSince counts the days from other to d, negative when d is earlier.
+func (d Date) DaysSince(other Date) int {
+	return int(d.time().Sub(other.time()).Hours() / 24)
+}
+
+func (d Date) Before(other Date) bool {
+	return d.time().Before(other.time())
+}
+
+func (d Date) After(other Date) bool {
+	return d.time().After(other.time())
+}
+
+func (d Date) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Date) UnmarshalText(data []byte) error {
+	date, err := ParseDate(string(data))
+	if err != nil {
+		return err
+	}
+	*d = date
+	return nil
+}
+
+// Value and Scan store dates in text columns.
+func (d Date) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+func (d *Date) Scan(src any) error {
+	switch value := src.(type) {
+	case string:
+		return d.UnmarshalText([]byte(value))
+	case []byte:
+		return d.UnmarshalText(value)
+	case time.Time:
+		*d = DateOf(value)
+		return nil
+	case nil:
+		*d = Date{}
+		return nil
+	}
+	return fmt.Errorf("Unsupported date column type %T", src)
+}
+
+const maxDayStartHour = 23
+
+// Location returns the time zone of the user, the server's when none is
+// set.
+func (s Settings) Location() *time.Location {
+	if s.TimeZone == "" {
+		return time.Local
+	}
+	if location, err := time.LoadLocation(s.TimeZone); err == nil {
+		return location
+	}
+	return time.Local
+}
+
+// Today returns the day of the user at now. Their days begin at DayStartHour
+// on their clock, so late reviews still count for the evening before. The
+// hour is read off the clock rather than counted from midnight, days the
+// clocks change on have fewer or more hours before it.
+func (s Settings) Today(now time.Time) Date {
+	local := now.In(s.Location())
+	if local.Hour() < s.DayStartHour {
+		return DateOf(local).AddDays(-1)
+	}
+	return DateOf(local)
+}
+
+// DayStart returns when the user's day d begins. When the clocks skip the
+// hour it begins once they moved on, when they repeat it at its first time.
+func (s Settings) DayStart(d Date) time.Time {
+	start := time.Date(d.Year, d.Month, d.Day, s.DayStartHour, 0, 0, 0, s.Location())
+
+	// time.Date may put a skipped hour before the change of the clocks.
+	if day := DateOf(start); day.Before(d) || day == d && start.Hour() < s.DayStartHour {
+		_, offset := start.Zone()
+		_, after := start.Add(2 * time.Hour).Zone()
+		return start.Add(time.Duration(after-offset) * time.Second)
+	}
+
+	_, before := start.Add(-2 * time.Hour).Zone()
+	if _, offset := start.Zone(); before > offset {
+		earlier := start.Add(-time.Duration(before-offset) * time.Second)
+		if DateOf(earlier) == d && earlier.Hour() == s.DayStartHour && earlier.Minute() == 0 {
+			return earlier
+		}
+	}
+	return start
+}
+
+func checkSettings(settings Settings) error {
+	if settings.TimeZone != "" {
+		if _, err := time.LoadLocation(settings.TimeZone); err != nil {
+			return fmt.Errorf("Unknown time zone %v", settings.TimeZone)
+		}
+	}
+
+	if settings.DayStartHour < 0 || settings.DayStartHour > maxDayStartHour {
+		return fmt.Errorf("Day start hour has to be between 0 and %d", maxDayStartHour)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("No time zone data for %v: %v", name, err)
+	}
+	return location
+}
+
+func TestSettingsToday(t *testing.T) {
+	kyiv := mustLoadLocation(t, "Europe/Kyiv")
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	var tests = []struct {
+		name     string
+		zone     string
+		location *time.Location
+		startAt  int
+		now      time.Time
+		want     Date
+	}{
+		{"midnight start, just before", "Europe/Kyiv", kyiv, 0, time.Date(2024, time.March, 9, 23, 59, 0, 0, kyiv), Date{2024, time.March, 9}},
+		{"midnight start, at midnight", "Europe/Kyiv", kyiv, 0, time.Date(2024, time.March, 10, 0, 0, 0, 0, kyiv), Date{2024, time.March, 10}},
+		{"late start, after midnight", "Europe/Kyiv", kyiv, 4, time.Date(2024, time.March, 10, 3, 59, 0, 0, kyiv), Date{2024, time.March, 9}},
+		{"late start, at the start", "Europe/Kyiv", kyiv, 4, time.Date(2024, time.March, 10, 4, 0, 0, 0, kyiv), Date{2024, time.March, 10}},
+		{"start at 23", "Europe/Kyiv", kyiv, 23, time.Date(2024, time.March, 10, 22, 59, 0, 0, kyiv), Date{2024, time.March, 9}},
+		{"the zone of the user, not of now", "Europe/Kyiv", kyiv, 0, time.Date(2024, time.March, 9, 23, 0, 0, 0, time.UTC), Date{2024, time.March, 10}},
+		{"west of UTC", "America/New_York", newYork, 0, time.Date(2024, time.March, 10, 3, 0, 0, 0, time.UTC), Date{2024, time.March, 9}},
+		{"start on the day clocks go forward", "Europe/Kyiv", kyiv, 4, time.Date(2024, time.March, 31, 4, 0, 0, 0, kyiv), Date{2024, time.March, 31}},
+		{"before the start on the day clocks go forward", "Europe/Kyiv", kyiv, 4, time.Date(2024, time.March, 31, 2, 59, 0, 0, kyiv), Date{2024, time.March, 30}},
+		{"start on the day clocks go back", "Europe/Kyiv", kyiv, 4, time.Date(2024, time.October, 27, 4, 0, 0, 0, kyiv), Date{2024, time.October, 27}},
+		{"before the start on the day clocks go back", "Europe/Kyiv", kyiv, 4, time.Date(2024, time.October, 27, 3, 30, 0, 0, kyiv), Date{2024, time.October, 26}},
+		{"start on the day clocks go forward, west", "America/New_York", newYork, 5, time.Date(2024, time.March, 10, 5, 0, 0, 0, newYork), Date{2024, time.March, 10}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := Settings{TimeZone: test.zone, DayStartHour: test.startAt}
+			if got := settings.Today(test.now); got != test.want {
+				t.Errorf("Today(%v) = %v, want %v", test.now, got, test.want)
+			}
+
+			start := settings.DayStart(test.want)
+			if start.In(test.location).Hour() != test.startAt {
+				t.Errorf("DayStart(%v) = %v, want %d:00", test.want, start, test.startAt)
+			}
+		})
+	}
+}
+
+// Every moment belongs to the day that started last, also on the days the
+// clocks change.
+func TestDayStartBoundsToday(t *testing.T) {
+	for _, zone := range []string{"Europe/Kyiv", "America/New_York", "Australia/Lord_Howe"} {
+		location := mustLoadLocation(t, zone)
+
+		for _, startAt := range []int{0, 1, 2, 3, 4, 23} {
+			settings := Settings{TimeZone: zone, DayStartHour: startAt}
+
+			for _, days := range [][2]time.Time{
+				{time.Date(2024, time.March, 8, 0, 0, 0, 0, location), time.Date(2024, time.April, 9, 0, 0, 0, 0, location)},
+				{time.Date(2024, time.October, 4, 0, 0, 0, 0, location), time.Date(2024, time.November, 5, 0, 0, 0, 0, location)},
+			} {
+				for now := days[0]; now.Before(days[1]); now = now.Add(15 * time.Minute) {
+					today := settings.Today(now)
+					start, next := settings.DayStart(today), settings.DayStart(today.AddDays(1))
+					if now.Before(start) || !now.Before(next) {
+						t.Fatalf("%v, day start %d: Today(%v) = %v, which lasts from %v to %v", zone, startAt, now, today, start, next)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestDate(t *testing.T) {
+	var tests = []struct {
+		date  Date
+		days  int
+		added Date
+	}{
+		{Date{2024, time.March, 10}, 1, Date{2024, time.March, 11}},
+		{Date{2024, time.February, 28}, 1, Date{2024, time.February, 29}},
+		{Date{2023, time.February, 28}, 1, Date{2023, time.March, 1}},
+		{Date{2024, time.December, 31}, 1, Date{2025, time.January, 1}},
+		{Date{2024, time.March, 31}, -31, Date{2024, time.February, 29}},
+		{Date{2024, time.October, 27}, 365, Date{2025, time.October, 27}},
+	}
+
+	for _, test := range tests {
+		added := test.date.AddDays(test.days)
+		if added != test.added {
+			t.Errorf("%v.AddDays(%d) = %v, want %v", test.date, test.days, added, test.added)
+		}
+		if days := added.DaysSince(test.date); days != test.days {
+			t.Errorf("%v.DaysSince(%v) = %d, want %d", added, test.date, days, test.days)
+		}
+	}
+
+	for _, s := range []string{"2024-03-10", "2024.03.10"} {
+		if date, err := ParseDate(s); err != nil || date != (Date{2024, time.March, 10}) {
+			t.Errorf("ParseDate(%q) = %v, %v", s, date, err)
+		}
+	}
+}
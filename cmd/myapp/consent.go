@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+)
+
+// consentCategories are the optional cookie and privacy categories. Strictly
+// necessary cookies need no consent and aren't listed.
+var consentCategories = []string{"preferences", "analytics", "marketing"}
+
+// ConsentRecord is one decision of a user. Records are only appended, the
+// last one is the consent in force and the list is the audit history.
+type ConsentRecord struct {
+	PolicyVersion string    `json:"policyVersion"`
+	Categories    []string  `json:"categories"`
+	Granted       bool      `json:"granted"`
+	At            time.Time `json:"at"`
+	// Source is where the record came from: "api", "acceptCokies" or
+	// "migration" for the old CokiesAccepted flag.
+	Source string `json:"source"`
+}
+
+func (c ConsentRecord) Copy() ConsentRecord {
+	c.Categories = slices.Clone(c.Categories)
+	return c
+}
+
+// policyVersion is the privacy policy users currently have to accept, set
+// with PRIVACY_POLICY_VERSION.
+func policyVersion() string {
+	if version := os.Getenv("PRIVACY_POLICY_VERSION"); version != "" {
+		return version
+	}
+	return "1"
+}
+
+type ConsentStatus struct {
+	PolicyVersion string         `json:"policyVersion"`
+	Categories    []string       `json:"categories"`
+	Current       *ConsentRecord `json:"current"`
+	// UpToDate is false when the user has to be asked again.
+	UpToDate bool `json:"upToDate"`
+}
+
+func consentStatus(user *User) ConsentStatus {
+	var status = ConsentStatus{PolicyVersion: policyVersion(), Categories: consentCategories}
+
+	if len(user.Consents) > 0 {
+		current := user.Consents[len(user.Consents)-1].Copy()
+		status.Current = &current
+		status.UpToDate = !current.Granted || current.PolicyVersion == status.PolicyVersion
+	}
+
+	return status
+}
+
+func (s *APIServer) recordConsent(userID int, record ConsentRecord) (ConsentStatus, error) {
+	for _, category := range record.Categories {
+		if !slices.Contains(consentCategories, category) {
+			return ConsentStatus{}, fmt.Errorf("Unknown consent category: %v", category)
+		}
+	}
+	if record.Categories == nil {
+		record.Categories = []string{}
+	}
+	record.At = time.Now().UTC()
+
+	var status ConsentStatus
+	err := s.dataBase.UpdateUserFunc(userID, func(user *User) error {
+		user.Consents = append(user.Consents, record)
+		status = consentStatus(user)
+		return nil
+	})
+	if err != nil {
+		return ConsentStatus{}, err
+	}
+
+	return status, nil
+}
+
+func (s *APIServer) handleConsent(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "GET":
+		user, err := s.dataBase.GetAccount(id)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, consentStatus(user))
+	case "POST":
+		var req ConsentReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+
+		if req.PolicyVersion != policyVersion() {
+			return fmt.Errorf("Policy version %v isn't current, the current one is %v", req.PolicyVersion, policyVersion())
+		}
+
+		status, err := s.recordConsent(id, ConsentRecord{PolicyVersion: req.PolicyVersion, Categories: req.Categories, Granted: true, Source: "api"})
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, status)
+	case "DELETE":
+		status, err := s.recordConsent(id, ConsentRecord{PolicyVersion: policyVersion(), Granted: false, Source: "api"})
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, status)
+	default:
+		return fmt.Errorf("Method not allowed")
+	}
+}
+
+func (s *APIServer) handleConsentHistory(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	user, err := s.getUser(r)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, consentHistory(user))
+}
+
+func (s *APIServer) handleAdminConsentHistory(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	user, err := s.getAdminTarget(r)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, consentHistory(user))
+}
+
+func consentHistory(user *User) []ConsentRecord {
+	if user.Consents == nil {
+		return []ConsentRecord{}
+	}
+	return user.Consents
+}
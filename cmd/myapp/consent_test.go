@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestConsent(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	handler := newTestServer(t, store).Handler()
+
+	admin := signUpAs(t, handler, store, 0, RoleAdmin)
+	c, err := signUp(handler, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status ConsentStatus
+	if err := c.do("GET", c.path("/consent"), nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != nil || status.UpToDate {
+		t.Errorf("Got %+v before any decision, want no consent and a question", status)
+	}
+
+	for _, req := range []ConsentReq{
+		{PolicyVersion: "0", Categories: []string{"analytics"}},
+		{PolicyVersion: "1", Categories: []string{"tracking"}},
+	} {
+		if code := c.code("POST", c.path("/consent"), req); code != http.StatusBadRequest {
+			t.Errorf("POST %+v: got %d, want %d", req, code, http.StatusBadRequest)
+		}
+	}
+
+	if err := c.do("POST", c.path("/consent"), ConsentReq{PolicyVersion: "1", Categories: []string{"analytics"}}, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Current == nil || !status.Current.Granted || !slices.Equal(status.Current.Categories, []string{"analytics"}) || !status.UpToDate {
+		t.Errorf("Got %+v after granting analytics", status)
+	}
+
+	// A new policy needs a new decision, a withdrawal doesn't.
+	t.Setenv("PRIVACY_POLICY_VERSION", "2")
+	if err := c.do("GET", c.path("/consent"), nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.UpToDate || status.PolicyVersion != "2" {
+		t.Errorf("Got %+v under a new policy, want a question", status)
+	}
+
+	if err := c.do("DELETE", c.path("/consent"), nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Current == nil || status.Current.Granted || len(status.Current.Categories) != 0 || !status.UpToDate {
+		t.Errorf("Got %+v after withdrawing", status)
+	}
+
+	if err := c.do("POST", "/acceptCokies", nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Current.Granted || !slices.Equal(status.Current.Categories, consentCategories) || status.Current.PolicyVersion != "2" {
+		t.Errorf("Got %+v after accepting cookies, want every category", status)
+	}
+
+	var history, adminHistory []ConsentRecord
+	if err := c.do("GET", c.path("/consent/history"), nil, &history); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.do("GET", fmt.Sprintf("/admin/users/%d/consent", c.auth.Id), nil, &adminHistory); err != nil {
+		t.Fatal(err)
+	}
+
+	var want = []struct {
+		version string
+		granted bool
+		source  string
+	}{
+		{"1", true, "api"},
+		{"2", false, "api"},
+		{"2", true, "acceptCokies"},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("The history holds %d records, want %d: %+v", len(history), len(want), history)
+	}
+	for i, record := range history {
+		if record.PolicyVersion != want[i].version || record.Granted != want[i].granted || record.Source != want[i].source {
+			t.Errorf("Record %d is %+v, want %+v", i, record, want[i])
+		}
+		if i > 0 && record.At.Before(history[i-1].At) {
+			t.Errorf("Record %d is older than the one before it", i)
+		}
+	}
+	if len(adminHistory) != len(history) {
+		t.Errorf("The admin sees %d records, the user %d", len(adminHistory), len(history))
+	}
+}
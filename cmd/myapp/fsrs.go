@@ -0,0 +1,251 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// FSRS 4.5 models the memory of each card direction with a stability, the
+// days until the chance of recalling it drops to 90%, and a difficulty
+// between 1 and 10. The 17 weights shape how both change with every answer.
+const (
+	fsrsDecay  = -0.5
+	fsrsFactor = 19.0 / 81.0
+
+	fsrsMaxInterval = 36500
+
+	defaultRetention = 0.9
+	minRetention     = 0.7
+	maxRetention     = 0.97
+
+	// fsrsMinReviews is how many predictable reviews the optimizer needs
+	// before it fits weights to a user.
+	fsrsMinReviews = 100
+)
+
+var fsrsDefaultWeights = []float64{0.4872, 1.4003, 3.7145, 13.8206, 5.1618, 1.2298, 0.8975, 0.031, 1.6474, 0.1367, 1.0461, 2.1072, 0.0793, 0.3246, 1.587, 0.2272, 2.8755}
+
+// fsrsWeightBounds keep the optimizer within the ranges the model is made for.
+var fsrsWeightBounds = [][2]float64{
+	{0.1, 100}, {0.1, 100}, {0.1, 100}, {0.1, 100},
+	{1, 10}, {0.1, 5}, {0.1, 5}, {0, 0.5},
+	{0, 3}, {0.1, 0.8}, {0.01, 2.5}, {0.5, 5},
+	{0.01, 0.2}, {0.01, 0.9}, {0.01, 2}, {0, 1}, {1, 6},
+}
+
+// FSRSScheduler makes a card due when the chance of recalling it has
+// dropped to Retention.
+type FSRSScheduler struct {
+	W         []float64
+	Retention float64
+}
+
+func newFSRSScheduler(user *User, settings TrackSettings) Scheduler {
+	var f = FSRSScheduler{W: fsrsDefaultWeights, Retention: defaultRetention}
+	if len(user.FSRSWeights) == len(fsrsDefaultWeights) {
+		f.W = user.FSRSWeights
+	}
+	if settings.TargetRetention != 0 {
+		f.Retention = settings.TargetRetention
+	}
+	return f
+}
+
+type fsrsState struct {
+	Stability  float64
+	Difficulty float64
+}
+
+func (f FSRSScheduler) Schedule(test *TestData, grade Grade, today Date) {
+	var elapsed int
+	if !test.LastReview.IsZero() {
+		elapsed = today.DaysSince(test.LastReview)
+	}
+
+	g := gradeValue(grade)
+	state := f.next(fsrsState{test.Stability, test.Difficulty}, elapsed, g)
+	test.Stability, test.Difficulty = state.Stability, state.Difficulty
+
+	if g == 1 {
+		test.Repeated = 0
+		test.Lapses++
+	} else {
+		test.Repeated++
+	}
+
+	test.Interval = f.interval(state.Stability)
+	test.ReapeatDate = today.AddDays(test.Interval)
+}
+
+// gradeValue numbers the grades from 1 (again) to 4 (easy).
+func gradeValue(grade Grade) int {
+	return slices.Index(grades, grade) + 1
+}
+
+// next returns the state after answering with g, elapsed days after the
+// previous answer. A zero state is a card answered for the first time.
+func (f FSRSScheduler) next(state fsrsState, elapsed, g int) fsrsState {
+	w := f.W
+
+	if state.Stability == 0 {
+		return fsrsState{Stability: w[g-1], Difficulty: f.initDifficulty(g)}
+	}
+
+	s, d := state.Stability, state.Difficulty
+	r := retrievability(elapsed, s)
+
+	var stability float64
+	if g == 1 {
+		stability = w[11] * math.Pow(d, -w[12]) * (math.Pow(s+1, w[13]) - 1) * math.Exp(w[14]*(1-r))
+		stability = min(stability, s)
+	} else {
+		var bonus = 1.0
+		switch g {
+		case 2:
+			bonus = w[15]
+		case 4:
+			bonus = w[16]
+		}
+		stability = s * (1 + math.Exp(w[8])*(11-d)*math.Pow(s, -w[9])*(math.Exp(w[10]*(1-r))-1)*bonus)
+	}
+
+	difficulty := d - w[6]*float64(g-3)
+	difficulty = w[7]*f.initDifficulty(3) + (1-w[7])*difficulty
+
+	return fsrsState{
+		Stability:  min(max(stability, 0.01), fsrsMaxInterval),
+		Difficulty: min(max(difficulty, 1), 10),
+	}
+}
+
+func (f FSRSScheduler) initDifficulty(g int) float64 {
+	return min(max(f.W[4]-float64(g-3)*f.W[5], 1), 10)
+}
+
+// interval is how many days it takes until the chance of recall drops to
+// the target retention.
+func (f FSRSScheduler) interval(stability float64) int {
+	days := stability / fsrsFactor * (math.Pow(f.Retention, 1/fsrsDecay) - 1)
+	return min(max(int(math.Round(days)), 1), fsrsMaxInterval)
+}
+
+func retrievability(elapsed int, stability float64) float64 {
+	return math.Pow(1+fsrsFactor*float64(elapsed)/stability, fsrsDecay)
+}
+
+// fsrsHistories splits reviews into the answers to each card direction,
+// oldest first.
+func fsrsHistories(reviews []Review) [][]Review {
+	type key struct {
+		track     string
+		cardID    int
+		direction string
+	}
+
+	var index = map[key]int{}
+	var histories [][]Review
+	for _, review := range reviews {
+		k := key{review.Track, review.CardID, review.Direction}
+		i, ok := index[k]
+		if !ok {
+			i = len(histories)
+			index[k] = i
+			histories = append(histories, nil)
+		}
+		histories[i] = append(histories[i], review)
+	}
+
+	for _, history := range histories {
+		slices.SortStableFunc(history, func(a, b Review) int {
+			return cmp.Compare(a.At.UnixNano(), b.At.UnixNano())
+		})
+	}
+	return histories
+}
+
+// fsrsLoss replays the histories with weights w and returns the mean log
+// loss of its recall predictions and how many there were. Only the first
+// answer of a day of the user is predicted and changes the state.
+func fsrsLoss(w []float64, histories [][]Review, settings Settings) (float64, int) {
+	f := FSRSScheduler{W: w}
+
+	var loss float64
+	var n int
+	for _, history := range histories {
+		var state fsrsState
+		var last Date
+
+		for _, review := range history {
+			g := gradeValue(review.Grade)
+			if g == 0 {
+				continue
+			}
+
+			day := settings.Today(review.At)
+			var elapsed int
+			if state.Stability != 0 {
+				if elapsed = day.DaysSince(last); elapsed < 1 {
+					continue
+				}
+
+				r := min(max(retrievability(elapsed, state.Stability), 1e-4), 1-1e-4)
+				if g == 1 {
+					loss -= math.Log(1 - r)
+				} else {
+					loss -= math.Log(r)
+				}
+				n++
+			}
+
+			state = f.next(state, elapsed, g)
+			last = day
+		}
+	}
+
+	if n == 0 {
+		return 0, 0
+	}
+	return loss / float64(n), n
+}
+
+// optimizeFSRS fits the weights to a user's reviews, starting at start. It
+// is a pattern search: every weight is nudged up and down and kept where the
+// loss drops, with smaller nudges once none helps. It returns the weights
+// and the loss before and after.
+func optimizeFSRS(reviews []Review, start []float64, settings Settings) ([]float64, float64, float64, error) {
+	histories := fsrsHistories(reviews)
+
+	var w = slices.Clone(start)
+	for i, bounds := range fsrsWeightBounds {
+		w[i] = min(max(w[i], bounds[0]), bounds[1])
+	}
+
+	initial, n := fsrsLoss(w, histories, settings)
+	if n < fsrsMinReviews {
+		return nil, 0, 0, fmt.Errorf("Only %d reviews to learn from, at least %d are needed", n, fsrsMinReviews)
+	}
+
+	best := initial
+	for step, rounds := 0.2, 0; step > 0.005 && rounds < 100; rounds++ {
+		improved := false
+		for i, bounds := range fsrsWeightBounds {
+			for _, direction := range []float64{1, -1} {
+				var try = slices.Clone(w)
+				try[i] = min(max(w[i]+direction*step*max(math.Abs(w[i]), 0.01), bounds[0]), bounds[1])
+
+				if loss, _ := fsrsLoss(try, histories, settings); loss < best {
+					w, best, improved = try, loss, true
+					break
+				}
+			}
+		}
+
+		if !improved {
+			step /= 2
+		}
+	}
+
+	return w, initial, best, nil
+}
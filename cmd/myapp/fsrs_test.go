@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+// generateReviews simulates a learner whose memory follows fsrs with the
+// weights w, answering every card direction on random days. The seed keeps
+// the histories the same on every run.
+func generateReviews(w []float64, cards, answers int, seed int64) []Review {
+	random := rand.New(rand.NewSource(seed))
+	learner := FSRSScheduler{W: w}
+	start := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	var reviews []Review
+	for id := 1; id <= cards; id++ {
+		var state fsrsState
+		var day, elapsed int
+
+		for i := 0; i < answers; i++ {
+			var g = 3
+			if state.Stability != 0 && random.Float64() > retrievability(elapsed, state.Stability) {
+				g = 1
+			}
+
+			reviews = append(reviews, Review{
+				Track:     testTrack,
+				CardID:    id,
+				Direction: "fromLanguage",
+				At:        start.AddDate(0, 0, day),
+				Grade:     grades[g-1],
+			})
+
+			state = learner.next(state, elapsed, g)
+			elapsed = 1 + random.Intn(20)
+			day += elapsed
+		}
+	}
+	return reviews
+}
+
+func TestOptimizeFSRS(t *testing.T) {
+	// The learner forgets a lot faster than the default weights expect.
+	var learner = slices.Clone(fsrsDefaultWeights)
+	for i := 0; i < 4; i++ {
+		learner[i] *= 0.2
+	}
+	learner[8] -= 1
+	reviews := generateReviews(learner, 60, 8, 1)
+
+	// The start is out of bounds on purpose, the optimizer brings it back.
+	var start = slices.Clone(fsrsDefaultWeights)
+	start[7] = 2
+	start[16] = 10
+
+	w, initial, best, err := optimizeFSRS(reviews, start, Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if best >= initial {
+		t.Errorf("Loss went from %v to %v, want it lower", initial, best)
+	}
+	if loss, _ := fsrsLoss(w, fsrsHistories(reviews), Settings{}); math.Abs(loss-best) > 1e-12 {
+		t.Errorf("The weights have a loss of %v, reported %v", loss, best)
+	}
+	if defaults, _ := fsrsLoss(fsrsDefaultWeights, fsrsHistories(reviews), Settings{}); best >= defaults {
+		t.Errorf("Loss %v isn't lower than the %v of the default weights", best, defaults)
+	}
+
+	if len(w) != len(fsrsWeightBounds) {
+		t.Fatalf("Got %d weights, want %d", len(w), len(fsrsWeightBounds))
+	}
+	for i, bounds := range fsrsWeightBounds {
+		if w[i] < bounds[0] || w[i] > bounds[1] {
+			t.Errorf("Weight %d is %v, out of %v", i, w[i], bounds)
+		}
+	}
+	if start[7] != 2 {
+		t.Error("The start weights were changed")
+	}
+
+	again, _, _, err := optimizeFSRS(reviews, start, Settings{})
+	if err != nil || !slices.Equal(again, w) {
+		t.Errorf("A second run gave %v, %v, want the same weights", again, err)
+	}
+}
+
+func TestOptimizeFSRSTooFewReviews(t *testing.T) {
+	reviews := generateReviews(fsrsDefaultWeights, 10, 5, 1)
+	if _, _, _, err := optimizeFSRS(reviews, fsrsDefaultWeights, Settings{}); err == nil {
+		t.Error("Optimized 40 predictions, want an error")
+	}
+}
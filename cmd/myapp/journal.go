@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+)
+
+// journalCompactEntries is how many changes are appended to the journal
+// before LocalStorage folds them into a new snapshot of the storage file.
+const journalCompactEntries = 200
+
+// journalEntry is one change of the JSON store: the full user after a
+// change ("put") or the removal of a user ("delete"). Version is the storage
+// version the user was written in. Reviews are the reviews the change added,
+// they reach the review file after the entry.
+type journalEntry struct {
+	Op      string   `json:"op"`
+	ID      int      `json:"id"`
+	Version int      `json:"version"`
+	User    *User    `json:"user,omitempty"`
+	Reviews []Review `json:"reviews,omitempty"`
+}
+
+type rawJournalEntry struct {
+	Op      string          `json:"op"`
+	ID      int             `json:"id"`
+	Version int             `json:"version"`
+	User    json.RawMessage `json:"user"`
+	Reviews []Review        `json:"reviews"`
+}
+
+type journal struct {
+	file    *os.File
+	entries int
+}
+
+func openJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{file: file}, nil
+}
+
+func (j *journal) Entries() int {
+	return j.entries
+}
+
+// Append writes entries and syncs them to disk before returning.
+func (j *journal) Append(entries ...journalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var data []byte
+	for _, entry := range entries {
+		entry.Version = storageVersion
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	if _, err := j.file.Write(data); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	j.entries += len(entries)
+	return nil
+}
+
+// Replay applies the journal on top of users and returns how many entries
+// were applied along with the reviews they added, by user. A torn last line,
+// left by a crash during Append, is skipped.
+func (j *journal) Replay(users *[]User) (int, map[int][]Review, error) {
+	var reviews = map[int][]Review{}
+	if _, err := j.file.Seek(0, 0); err != nil {
+		return 0, nil, err
+	}
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(j.file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			lines = append(lines, bytes.Clone(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	for i, line := range lines {
+		var raw rawJournalEntry
+		if err := json.Unmarshal(line, &raw); err != nil {
+			if i == len(lines)-1 {
+				log.Printf("Skipping incomplete journal entry: %v", err)
+				return i, reviews, nil
+			}
+			return 0, nil, fmt.Errorf("Corrupt journal entry %d: %w", i+1, err)
+		}
+
+		var entry = journalEntry{Op: raw.Op, ID: raw.ID, Version: raw.Version}
+		if len(raw.User) > 0 && string(raw.User) != "null" {
+			entry.User = new(User)
+			if err := decodeUser(raw.User, raw.Version, entry.User); err != nil {
+				return 0, nil, fmt.Errorf("Journal entry %d: %w", i+1, err)
+			}
+		}
+
+		entry.apply(users)
+		if len(raw.Reviews) > 0 {
+			reviews[raw.ID] = append(reviews[raw.ID], raw.Reviews...)
+		}
+	}
+
+	return len(lines), reviews, nil
+}
+
+func (entry journalEntry) apply(users *[]User) {
+	index := slices.IndexFunc(*users, func(user User) bool {
+		return user.ID == entry.ID
+	})
+
+	switch {
+	case entry.Op == "put" && entry.User != nil && index == -1:
+		*users = append(*users, *entry.User)
+	case entry.Op == "put" && entry.User != nil:
+		(*users)[index] = *entry.User
+	case entry.Op == "delete" && index != -1:
+		*users = slices.Delete(*users, index, index+1)
+	}
+}
+
+// Truncate empties the journal after its changes reached the storage file.
+func (j *journal) Truncate() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	j.entries = 0
+	return nil
+}
+
+func (j *journal) Close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+const (
+	LeechTag     = "tag"
+	LeechSuspend = "suspend"
+
+	// leechTag is added to the tags of leeches when the policy asks for it.
+	leechTag = "leech"
+
+	defaultLeechThreshold = 8
+)
+
+var leechActions = []string{LeechTag, LeechSuspend}
+
+// LeechPolicy decides when a card failing over and over is a leech and what
+// happens to it. Leeches are always flagged, Action can also tag them or
+// suspend them until the user rewrites the card.
+type LeechPolicy struct {
+	// Threshold is the lapses of a direction that make a card a leech, 0
+	// means defaultLeechThreshold. The card is caught again every half
+	// threshold after that.
+	Threshold int    `json:"threshold"`
+	Action    string `json:"action"`
+}
+
+func checkLeechPolicy(policy LeechPolicy) error {
+	if policy.Threshold < 0 {
+		return fmt.Errorf("Leech threshold can't be negative")
+	}
+
+	if policy.Action != "" && !slices.Contains(leechActions, policy.Action) {
+		return fmt.Errorf("Unknown leech action %v, use tag or suspend", policy.Action)
+	}
+	return nil
+}
+
+func (p LeechPolicy) threshold() int {
+	if p.Threshold == 0 {
+		return defaultLeechThreshold
+	}
+	return p.Threshold
+}
+
+// apply is called after a lapse of the card in a direction, now at lapses,
+// and reports whether it made the card a leech.
+func (p LeechPolicy) apply(card *Card, lapses int) bool {
+	threshold := p.threshold()
+	if lapses < threshold || (lapses-threshold)%max(threshold/2, 1) != 0 {
+		return false
+	}
+
+	card.Leech = true
+	switch p.Action {
+	case LeechTag:
+		if !slices.Contains(card.Tags, leechTag) {
+			card.Tags = append(card.Tags, leechTag)
+		}
+	case LeechSuspend:
+		card.Suspended = true
+	}
+	return true
+}
+
+// Leech is a flagged card with the lapses of each direction.
+type Leech struct {
+	Card   Card           `json:"card"`
+	Lapses map[string]int `json:"lapses"`
+	Total  int            `json:"total"`
+}
+
+// leeches returns the flagged cards of the track, the most lapsed first.
+func (t Track) leeches() []Leech {
+	var leeches = []Leech{}
+	for _, card := range t.Storage {
+		if !card.Leech {
+			continue
+		}
+
+		var leech = Leech{Card: card, Lapses: map[string]int{}}
+		for _, name := range testNames {
+			data, _ := card.getTest(name)
+			leech.Lapses[name] = data.Lapses
+			leech.Total += data.Lapses
+		}
+		leeches = append(leeches, leech)
+	}
+
+	slices.SortStableFunc(leeches, func(a, b Leech) int {
+		return cmp.Compare(b.Total, a.Total)
+	})
+	return leeches
+}
+
+func (s *APIServer) handleLeeches(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	track, err := s.getTrack(r)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, track.leeches())
+}
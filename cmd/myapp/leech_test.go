@@ -0,0 +1,118 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLeechPolicyApply(t *testing.T) {
+	var tests = []struct {
+		name      string
+		threshold int
+		want      []int
+	}{
+		{"default", 0, []int{8, 12, 16, 20}},
+		{"threshold 4", 4, []int{4, 6, 8, 10, 12, 14, 16, 18, 20}},
+		{"threshold 5", 5, []int{5, 7, 9, 11, 13, 15, 17, 19}},
+		{"threshold 1", 1, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var card Card
+			var flagged []int
+			for lapses := 1; lapses <= 20; lapses++ {
+				if (LeechPolicy{Threshold: test.threshold}).apply(&card, lapses) {
+					flagged = append(flagged, lapses)
+				}
+				if card.Leech != (lapses >= test.want[0]) {
+					t.Errorf("Leech is %v after %d lapses", card.Leech, lapses)
+				}
+			}
+
+			if !slices.Equal(flagged, test.want) {
+				t.Errorf("Flagged at %v lapses, want %v", flagged, test.want)
+			}
+		})
+	}
+}
+
+func TestLeechPolicyActions(t *testing.T) {
+	var tests = []struct {
+		name      string
+		action    string
+		tags      []string
+		suspended bool
+	}{
+		{"flag only", "", nil, false},
+		{"tag", LeechTag, []string{leechTag}, false},
+		{"suspend", LeechSuspend, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var card Card
+			policy := LeechPolicy{Threshold: 2, Action: test.action}
+
+			// Caught twice, the tag is added once.
+			policy.apply(&card, 2)
+			policy.apply(&card, 3)
+
+			if !card.Leech || !slices.Equal(card.Tags, test.tags) || card.Suspended != test.suspended {
+				t.Errorf("Got leech %v, tags %v, suspended %v, want tags %v, suspended %v", card.Leech, card.Tags, card.Suspended, test.tags, test.suspended)
+			}
+		})
+	}
+}
+
+// A card suspended as a leech is left out of tests, studies and the backlog
+// until it is unsuspended.
+func TestLeechSuspendExcludesCard(t *testing.T) {
+	track := NewTrack(&CreateTrackRequest{FromLanguage: "Ukrainian", ToLanguage: "English", DaylyTestTries: 3})
+	track.Settings.DaylyTestCards = 5
+	track.Settings.DaylyStudyCards = 5
+	track.Settings.Leeches = LeechPolicy{Threshold: 2, Action: LeechSuspend}
+	for id := 1; id <= 3; id++ {
+		track.Storage = append(track.Storage, newTestCard(id, testToday))
+	}
+
+	scheduler, err := newScheduler(&User{}, track.Settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &CreateTestStatusRequest{IDs: []int{1}, Grades: []CardGrade{{ID: 1, Grade: GradeAgain}}}
+	for i := 0; i < 2; i++ {
+		if _, err := track.updateTestDates("fromLanguage", req, "failed", nil, scheduler, testToday.time(), testToday); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if card := track.Storage[0]; !card.Leech || !card.Suspended || card.FromLanguage.Lapses != 2 {
+		t.Fatalf("Card after 2 lapses: leech %v, suspended %v, lapses %d, want a suspended leech", card.Leech, card.Suspended, card.FromLanguage.Lapses)
+	}
+
+	cards, err := track.GetTest("fromLanguage", testToday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := cardIDs(cards); !slices.Equal(ids, []int{2, 3}) {
+		t.Errorf("Test has cards %v, want 2 and 3", ids)
+	}
+
+	study, err := track.GetStudy(testToday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := cardIDs(study.Cards); containsCard(study.Cards, 1) {
+		t.Errorf("Study has cards %v, want no card 1", ids)
+	}
+
+	overdue := testToday.AddDays(-3)
+	track.Storage[0].FromLanguage.ReapeatDate = overdue
+	track.Storage[1].FromLanguage.ReapeatDate = overdue
+	track.planBacklog(testToday)
+	if track.Storage[0].FromLanguage.ReapeatDate != overdue || track.Storage[1].FromLanguage.ReapeatDate != testToday {
+		t.Errorf("Backlog moved the suspended card to %v and the other to %v, want %v and %v", track.Storage[0].FromLanguage.ReapeatDate, track.Storage[1].FromLanguage.ReapeatDate, overdue, testToday)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer sends the account emails: verification links and password resets.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// NewMailerFromEnv uses SMTP when SMTP_ADDR (host:port) is set, with
+// SMTP_USER, SMTP_PASSWORD and MAIL_FROM. Otherwise mails are written to
+// MAIL_DIR, or only logged when that isn't set either.
+func NewMailerFromEnv() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@vocbl.local"
+	}
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		if _, err := appURL(); err != nil {
+			return nil, err
+		}
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SMTP_ADDR: %w", err)
+		}
+
+		var mailer = &SMTPMailer{addr: addr, from: from}
+		if user := os.Getenv("SMTP_USER"); user != "" {
+			mailer.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return mailer, nil
+	}
+
+	return &FileMailer{dir: os.Getenv("MAIL_DIR"), from: from}, nil
+}
+
+func formatMail(from, to, subject, body string) []byte {
+	var mail strings.Builder
+	fmt.Fprintf(&mail, "From: %s\r\n", from)
+	fmt.Fprintf(&mail, "To: %s\r\n", to)
+	fmt.Fprintf(&mail, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&mail, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	mail.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	mail.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(mail.String())
+}
+
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return fmt.Errorf("Invalid email address")
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, formatMail(m.from, to, subject, body))
+}
+
+// FileMailer is the stand-in for local development: every mail becomes an
+// .eml file in dir, or a log line when dir is empty.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	if m.dir == "" {
+		log.Printf("Mail to %v: %v\n%v", to, subject, body)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, to))
+
+	return os.WriteFile(filepath.Join(m.dir, name), formatMail(m.from, to, subject, body), 0644)
+}
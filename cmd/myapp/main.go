@@ -1,8 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -12,14 +19,245 @@ func main() {
 		port = "3000"
 	}
 
-	store, err := OpenStorage("./storage.json")
-	store.CardsUpToDate()
+	store, err := OpenStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	snapshots, err := NewSnapshotterFromEnv(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		err := runCommand(store, snapshots, os.Args[1:])
+		store.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	go closeOnSignal(store)
 
+	roller, err := NewRollerFromEnv(store, systemClock)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// The first rollover is done before serving, so no request sees the
+	// day before.
+	if _, err := roller.RollOver(); err != nil {
+		log.Fatal(err)
+	}
+
+	tokens, err := NewTokenIssuerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer, err := NewMailerFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	eraser, err := NewEraserFromEnv(store, snapshots)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go snapshots.Run(make(chan struct{}))
+	go eraser.Run(make(chan struct{}))
+	go roller.Run(make(chan struct{}))
+
 	// Use the port from the environment variable
-	server := NewAPISErver(":"+port, store)
+	server := NewAPISErver(":"+port, store, snapshots, eraser, roller, tokens, mailer)
 	server.Run()
 }
+
+// closeOnSignal lets the store write its pending changes before the
+// process exits on Ctrl+C or a stop from the service manager.
+func closeOnSignal(store Store) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	if err := store.Close(); err != nil {
+		log.Println("Closing storage failed:", err)
+	}
+	os.Exit(0)
+}
+
+// OpenStore opens the storage backend selected by the STORAGE environment
+// variable: "json" (default) uses STORAGE_PATH, "postgres" uses DATABASE_URL
+// and "sqlite" uses SQLITE_PATH.
+func OpenStore() (Store, error) {
+	switch backend := os.Getenv("STORAGE"); backend {
+	case "", "json":
+		path := os.Getenv("STORAGE_PATH")
+		if path == "" {
+			path = "./storage.json"
+		}
+		return OpenStorage(path)
+	case "postgres":
+		return OpenPostgresStorage(os.Getenv("DATABASE_URL"))
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "./storage.db"
+		}
+		return OpenSQLiteStorage(path)
+	default:
+		return nil, fmt.Errorf("Unknown storage backend: %v", backend)
+	}
+}
+
+func runCommand(store Store, snapshots *Snapshotter, args []string) error {
+	switch args[0] {
+	case "import":
+		if len(args) != 2 {
+			return fmt.Errorf("Usage: import <storage.json>")
+		}
+
+		sqlStore, ok := store.(*SQLStorage)
+		if !ok {
+			return fmt.Errorf("Import needs STORAGE=sqlite or STORAGE=postgres")
+		}
+
+		users, err := ReadStorageFile(args[1])
+		if err != nil {
+			return err
+		}
+
+		if err := sqlStore.ImportUsers(users); err != nil {
+			return err
+		}
+
+		log.Printf("Imported %d users from %v", len(users), args[1])
+		return nil
+	case "snapshots":
+		return runSnapshotsCommand(snapshots, args[1:])
+	case "fsrs-optimize":
+		return runFSRSOptimize(store, args[1:])
+	case "role":
+		if len(args) != 3 || !slices.Contains(roles, args[2]) {
+			return fmt.Errorf("Usage: role <userName> <%v>", strings.Join(roles, "|"))
+		}
+
+		user, err := store.GetUserByLogin(args[1])
+		if err != nil {
+			return err
+		}
+
+		err = store.UpdateUserFunc(user.ID, func(user *User) error {
+			user.Role = args[2]
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%v is now %v", user.UserName, args[2])
+		return nil
+	default:
+		return fmt.Errorf("Unknown command: %v", args[0])
+	}
+}
+
+func runSnapshotsCommand(snapshots *Snapshotter, args []string) error {
+	const usage = "Usage: snapshots list | create | restore <name> [userID]"
+	if len(args) == 0 {
+		return fmt.Errorf(usage)
+	}
+
+	switch args[0] {
+	case "list":
+		list, err := snapshots.List()
+		if err != nil {
+			return err
+		}
+		for _, info := range list {
+			fmt.Printf("%v\t%v\t%d\n", info.Name, info.CreatedAt.Local().Format(time.DateTime), info.Size)
+		}
+		return nil
+	case "create":
+		info, err := snapshots.Create()
+		if err != nil {
+			return err
+		}
+		log.Println("Snapshot written:", info.Name)
+		return nil
+	case "restore":
+		if len(args) != 2 && len(args) != 3 {
+			return fmt.Errorf(usage)
+		}
+
+		var userID *int
+		if len(args) == 3 {
+			id, err := strconv.Atoi(args[2])
+			if err != nil {
+				return fmt.Errorf("Invalid user ID: %v", args[2])
+			}
+			userID = &id
+		}
+
+		if err := snapshots.Restore(args[1], userID); err != nil {
+			return err
+		}
+		log.Println("Restored", args[1])
+		return nil
+	default:
+		return fmt.Errorf(usage)
+	}
+}
+
+// runFSRSOptimize fits the fsrs weights of one user, or of every user with
+// enough reviews, and stores them on the user.
+func runFSRSOptimize(store Store, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Usage: fsrs-optimize [userName]")
+	}
+
+	var users []User
+	if len(args) == 1 {
+		user, err := store.GetUserByLogin(args[0])
+		if err != nil {
+			return err
+		}
+		users = []User{*user}
+	} else {
+		var err error
+		if users, err = store.GetUsers(); err != nil {
+			return err
+		}
+	}
+
+	for _, user := range users {
+		reviews, err := store.GetReviews(user.ID, ReviewFilter{})
+		if err != nil {
+			return err
+		}
+
+		var start = fsrsDefaultWeights
+		if len(user.FSRSWeights) == len(fsrsDefaultWeights) {
+			start = user.FSRSWeights
+		}
+
+		weights, before, after, err := optimizeFSRS(reviews, start, user.Settings)
+		if err != nil {
+			log.Printf("%v: %v", user.UserName, err)
+			continue
+		}
+
+		err = store.UpdateUserFunc(user.ID, func(user *User) error {
+			user.FSRSWeights = weights
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("%v: log loss %.4f -> %.4f", user.UserName, before, after)
+	}
+
+	return nil
+}
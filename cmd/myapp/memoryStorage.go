@@ -0,0 +1,687 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// MemoryStorage keeps every user in memory. It is used directly in tests and
+// is the base of LocalStorage, which persists the data through OnChange.
+//
+// mu guards the list of users, every user has its own lock guarding its
+// data. When both are needed mu is always taken first.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	users []*userEntry
+	// OnChange is called after every change of a user, once its lock is
+	// released, with what the change did to the reviews of the user.
+	OnChange func(userID int, reviews reviewChange) error
+
+	reviewsMu sync.RWMutex
+	reviews   map[int][]Review
+}
+
+type userEntry struct {
+	id      int
+	mu      sync.RWMutex
+	user    User
+	deleted bool
+}
+
+func NewMemoryStorage(users []User) *MemoryStorage {
+	var s = &MemoryStorage{users: make([]*userEntry, len(users)), reviews: map[int][]Review{}}
+	for i, user := range users {
+		s.users[i] = &userEntry{id: user.ID, user: user}
+	}
+	return s
+}
+
+// reviewChange is what a change of a user did to its reviews: the reviews
+// it added and whether it deleted some.
+type reviewChange struct {
+	added   []Review
+	deleted bool
+}
+
+func (s *MemoryStorage) changed(userID int, reviews reviewChange) error {
+	if s.OnChange == nil {
+		return nil
+	}
+	return s.OnChange(userID, reviews)
+}
+
+func (s *MemoryStorage) entry(id int) (*userEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := slices.IndexFunc(s.users, func(e *userEntry) bool {
+		return e.id == id
+	})
+	if i == -1 {
+		return nil, notFound("User doesn't exist")
+	}
+
+	return s.users[i], nil
+}
+
+// readUser runs f with the user locked for reading.
+func (s *MemoryStorage) readUser(id int, f func(user *User) error) error {
+	e, err := s.entry(id)
+	if err != nil {
+		return err
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.deleted {
+		return notFound("User doesn't exist")
+	}
+	return f(&e.user)
+}
+
+// writeUser runs f with the user locked for writing and reports the change
+// once the lock is released.
+func (s *MemoryStorage) writeUser(id int, f func(user *User) error) error {
+	return s.writeUserReviews(id, func(user *User, _ *reviewChange) error {
+		return f(user)
+	})
+}
+
+// writeUserReviews is writeUser for changes of the reviews, f records them
+// in reviews.
+func (s *MemoryStorage) writeUserReviews(id int, f func(user *User, reviews *reviewChange) error) error {
+	e, err := s.entry(id)
+	if err != nil {
+		return err
+	}
+
+	var reviews reviewChange
+	e.mu.Lock()
+	if e.deleted {
+		e.mu.Unlock()
+		return notFound("User doesn't exist")
+	}
+	err = f(&e.user, &reviews)
+	e.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return s.changed(id, reviews)
+}
+
+// dropReviews deletes the reviews of the user matching drop and records it
+// in change. The caller holds the lock of the user.
+func (s *MemoryStorage) dropReviews(userID int, change *reviewChange, drop func(review Review) bool) {
+	s.reviewsMu.Lock()
+	defer s.reviewsMu.Unlock()
+
+	before := len(s.reviews[userID])
+	s.reviews[userID] = slices.DeleteFunc(s.reviews[userID], drop)
+	if len(s.reviews[userID]) != before {
+		change.deleted = true
+	}
+}
+
+// findUser returns a copy of the first user matching f.
+func (s *MemoryStorage) findUser(f func(user *User) bool) (*User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, e := range s.users {
+		e.mu.RLock()
+		if !e.deleted && f(&e.user) {
+			copy := e.user.Copy()
+			e.mu.RUnlock()
+			return &copy, true
+		}
+		e.mu.RUnlock()
+	}
+
+	return nil, false
+}
+
+func findTrack(user *User, key string) (*Track, error) {
+	i := slices.IndexFunc(user.Tracks, func(t Track) bool {
+		return t.Name == key
+	})
+	if i == -1 {
+		return nil, notFound("Track does't exist")
+	}
+
+	return &user.Tracks[i], nil
+}
+
+func (s *MemoryStorage) readTrack(userID int, key string, f func(track *Track) error) error {
+	return s.readUser(userID, func(user *User) error {
+		track, err := findTrack(user, key)
+		if err != nil {
+			return err
+		}
+		return f(track)
+	})
+}
+
+// writeTrack runs f on the track with the user locked for writing and moves
+// the track to the front of TracksKeys once f succeeded.
+func (s *MemoryStorage) writeTrack(userID int, key string, f func(track *Track) error) error {
+	return s.writeUser(userID, func(user *User) error {
+		track, err := findTrack(user, key)
+		if err != nil {
+			return err
+		}
+		if err := f(track); err != nil {
+			return err
+		}
+
+		user.TracksKeys = keyFirst(user.TracksKeys, key)
+		return nil
+	})
+}
+
+// keyFirst returns keys with key moved to the front.
+func keyFirst(keys []string, key string) []string {
+	if len(keys) > 0 && keys[0] == key {
+		return keys
+	}
+
+	return append([]string{key}, slices.DeleteFunc(keys, func(keyToCheck string) bool {
+		return keyToCheck == key
+	})...)
+}
+
+func (s *MemoryStorage) GetUsers() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users = make([]User, 0, len(s.users))
+	for _, e := range s.users {
+		e.mu.RLock()
+		if !e.deleted {
+			users = append(users, e.user.Copy())
+		}
+		e.mu.RUnlock()
+	}
+	return users, nil
+}
+
+func (s *MemoryStorage) GetUserByID(id int) (*User, error) {
+	var copy User
+	err := s.readUser(id, func(user *User) error {
+		copy = user.Copy()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &copy, nil
+}
+
+func (s *MemoryStorage) GetAccount(id int) (*User, error) {
+	var copy User
+	err := s.readUser(id, func(user *User) error {
+		copy = *user
+		copy.Tracks = nil
+		copy = copy.Copy()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &copy, nil
+}
+
+func (s *MemoryStorage) GetUserByLogin(userNameEMail string) (*User, error) {
+	user, ok := s.findUser(func(user *User) bool {
+		return user.EMail == userNameEMail || user.UserName == userNameEMail
+	})
+	if !ok {
+		return nil, notFound("User does't exist")
+	}
+
+	return user, nil
+}
+
+func (s *MemoryStorage) CreateAccount(newUser User) (*User, error) {
+	s.mu.Lock()
+
+	for _, e := range s.users {
+		e.mu.RLock()
+		taken := e.user.UserName == newUser.UserName
+		e.mu.RUnlock()
+
+		if taken {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("Username taken")
+		}
+	}
+
+	newUser.ID = 0
+	for _, e := range s.users {
+		newUser.ID = max(newUser.ID, e.id+1)
+	}
+
+	s.users = append(s.users, &userEntry{id: newUser.ID, user: newUser.Copy()})
+	s.mu.Unlock()
+
+	if err := s.changed(newUser.ID, reviewChange{}); err != nil {
+		return nil, err
+	}
+
+	return &newUser, nil
+}
+
+func (s *MemoryStorage) UpdateUser(updated User) error {
+	updated = updated.Copy()
+
+	return s.writeUser(updated.ID, func(user *User) error {
+		updated.Tracks = user.Tracks
+		updated.TracksKeys = user.TracksKeys
+		updated.LastRollover = user.LastRollover
+		*user = updated
+		return nil
+	})
+}
+
+func (s *MemoryStorage) UpdateUserFunc(id int, update func(user *User) error) error {
+	return s.writeUser(id, func(user *User) error {
+		var updated = *user
+		updated.Tracks = nil
+		updated = updated.Copy()
+
+		if err := update(&updated); err != nil {
+			return err
+		}
+
+		updated.ID = user.ID
+		updated.Tracks = user.Tracks
+		updated.TracksKeys = user.TracksKeys
+		updated.LastRollover = user.LastRollover
+		*user = updated
+		return nil
+	})
+}
+
+func (s *MemoryStorage) RestoreUsers(users []User, reviews map[int][]Review, all bool) error {
+	ids, err := s.restoreUsers(users, reviews, all, nil)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, id := range ids {
+		errs = append(errs, s.changed(id, reviewChange{}))
+	}
+	return errors.Join(errs...)
+}
+
+// restoreUsers stages copies of users and reviews and swaps them in for the
+// current ones in one step, it returns the IDs of the users it replaced,
+// deleted or added. save, when set, is called with every user and review
+// the store holds after the restore before it swaps them in, so the restore
+// can be written elsewhere first. If save fails nothing changes.
+func (s *MemoryStorage) restoreUsers(users []User, reviews map[int][]Review, all bool, save func(users []User, reviews map[int][]Review) error) ([]int, error) {
+	var restored = map[int]bool{}
+	var staged = make([]*userEntry, len(users))
+	var stagedReviews = map[int][]Review{}
+	for i, user := range users {
+		if restored[user.ID] {
+			return nil, fmt.Errorf("User %d is restored twice", user.ID)
+		}
+		restored[user.ID] = true
+		staged[i] = &userEntry{id: user.ID, user: user.Copy()}
+		if len(reviews[user.ID]) > 0 {
+			stagedReviews[user.ID] = slices.Clone(reviews[user.ID])
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kept, replaced []*userEntry
+	for _, e := range s.users {
+		if all || restored[e.id] {
+			replaced = append(replaced, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+
+	var entries = append(slices.Clone(kept), staged...)
+	slices.SortFunc(entries, func(a, b *userEntry) int {
+		return a.id - b.id
+	})
+
+	if save != nil {
+		var saved = make([]User, 0, len(entries))
+		for _, e := range entries {
+			e.mu.RLock()
+			if !e.deleted {
+				saved = append(saved, e.user.Copy())
+			}
+			e.mu.RUnlock()
+		}
+
+		var savedReviews = maps.Clone(stagedReviews)
+		s.reviewsMu.RLock()
+		for _, e := range kept {
+			if userReviews, ok := s.reviews[e.id]; ok {
+				savedReviews[e.id] = userReviews
+			}
+		}
+		err := save(saved, savedReviews)
+		s.reviewsMu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ids []int
+	for _, e := range replaced {
+		e.mu.Lock()
+		e.deleted = true
+		e.mu.Unlock()
+		ids = append(ids, e.id)
+	}
+	for _, e := range staged {
+		if !slices.Contains(ids, e.id) {
+			ids = append(ids, e.id)
+		}
+	}
+	s.users = entries
+
+	s.reviewsMu.Lock()
+	for _, id := range ids {
+		delete(s.reviews, id)
+	}
+	maps.Copy(s.reviews, stagedReviews)
+	s.reviewsMu.Unlock()
+
+	return ids, nil
+}
+
+func (s *MemoryStorage) DeleteUser(id int) error {
+	s.mu.Lock()
+
+	i := slices.IndexFunc(s.users, func(e *userEntry) bool {
+		return e.id == id
+	})
+	if i == -1 {
+		s.mu.Unlock()
+		return notFound("User doesn't exist")
+	}
+
+	e := s.users[i]
+	e.mu.Lock()
+	e.deleted = true
+	e.mu.Unlock()
+
+	s.users = slices.Delete(s.users, i, i+1)
+	s.mu.Unlock()
+
+	s.reviewsMu.Lock()
+	_, hadReviews := s.reviews[id]
+	delete(s.reviews, id)
+	s.reviewsMu.Unlock()
+
+	return s.changed(id, reviewChange{deleted: hadReviews})
+}
+
+func (s *MemoryStorage) GetTracks(userID int) ([]Track, error) {
+	var tracks []Track
+	err := s.readUser(userID, func(user *User) error {
+		tracks = user.Copy().Tracks
+		return nil
+	})
+
+	return tracks, err
+}
+
+func (s *MemoryStorage) GetTrack(userID int, key string) (*Track, error) {
+	var copy Track
+	err := s.readTrack(userID, key, func(track *Track) error {
+		copy = track.Copy()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &copy, nil
+}
+
+func (s *MemoryStorage) CreateTrack(userID int, track Track) error {
+	track = track.Copy()
+
+	return s.writeUser(userID, func(user *User) error {
+		if slices.ContainsFunc(user.Tracks, func(t Track) bool {
+			return t.Name == track.Name
+		}) {
+			return fmt.Errorf("Track already exists")
+		}
+
+		user.Tracks = append([]Track{track}, user.Tracks...)
+		user.TracksKeys = append([]string{track.Name}, user.TracksKeys...)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) UpdateTrackSettings(userID int, key string, settings TrackSettings) error {
+	return s.writeTrack(userID, key, func(track *Track) error {
+		track.Settings = settings
+		return nil
+	})
+}
+
+func (s *MemoryStorage) DeleteTrack(userID int, key string) error {
+	return s.writeUserReviews(userID, func(user *User, reviews *reviewChange) error {
+		if _, err := findTrack(user, key); err != nil {
+			return err
+		}
+
+		user.Tracks = slices.DeleteFunc(user.Tracks, func(t Track) bool { return key == t.Name })
+		user.TracksKeys = slices.DeleteFunc(user.TracksKeys, func(k string) bool {
+			return key == k
+		})
+		s.dropReviews(userID, reviews, func(review Review) bool { return review.Track == key })
+		return nil
+	})
+}
+
+func (s *MemoryStorage) GetCard(userID int, key string, cardID int) (*Card, error) {
+	var copy Card
+	err := s.readTrack(userID, key, func(track *Track) error {
+		i := slices.IndexFunc(track.Storage, func(card Card) bool {
+			return card.ID == cardID
+		})
+		if i == -1 {
+			return notFound("Card does't exist")
+		}
+
+		copy = track.Storage[i].Copy()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &copy, nil
+}
+
+func (s *MemoryStorage) AddCard(userID int, key string, card Card) error {
+	card = card.Copy()
+
+	return s.writeTrack(userID, key, func(track *Track) error {
+		if slices.ContainsFunc(track.Storage, func(c Card) bool {
+			return c.ID == card.ID
+		}) {
+			return fmt.Errorf("Card already exists")
+		}
+
+		track.Storage = append(track.Storage, card)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) UpdateCards(userID int, key string, cards ...Card) error {
+	return s.writeTrack(userID, key, func(track *Track) error {
+		for _, card := range cards {
+			i := slices.IndexFunc(track.Storage, func(c Card) bool {
+				return c.ID == card.ID
+			})
+			if i == -1 {
+				return notFound("Card does't exist")
+			}
+			track.Storage[i] = card.Copy()
+		}
+		return nil
+	})
+}
+
+func (s *MemoryStorage) DeleteCard(userID int, key string, cardID int) error {
+	return s.UpdateTrack(userID, key, func(track *Track) error {
+		if !containsCard(track.Storage, cardID) {
+			return notFound("Card does't exist")
+		}
+
+		track.Storage = slices.DeleteFunc(track.Storage, func(card Card) bool {
+			return card.ID == cardID
+		})
+		return nil
+	})
+}
+
+func (s *MemoryStorage) UpdateTrack(userID int, key string, update func(track *Track) error) error {
+	return s.UpdateTrackReviews(userID, key, func(track *Track) ([]Review, error) {
+		return nil, update(track)
+	})
+}
+
+func (s *MemoryStorage) UpdateTrackReviews(userID int, key string, update func(track *Track) ([]Review, error)) error {
+	return s.writeUserReviews(userID, func(user *User, change *reviewChange) error {
+		track, err := findTrack(user, key)
+		if err != nil {
+			return err
+		}
+
+		// update works on a copy, so a failing one changes nothing.
+		var updated = track.Copy()
+		reviews, err := update(&updated)
+		if err != nil {
+			return err
+		}
+
+		removed := removedCards(*track, updated)
+		if len(removed) > 0 {
+			s.dropReviews(userID, change, func(review Review) bool {
+				return review.Track == key && removed[review.CardID]
+			})
+		}
+
+		if len(reviews) > 0 {
+			s.reviewsMu.Lock()
+			s.reviews[userID] = append(s.reviews[userID], reviews...)
+			s.reviewsMu.Unlock()
+			change.added = reviews
+		}
+
+		*track = updated
+		user.TracksKeys = keyFirst(user.TracksKeys, key)
+		return nil
+	})
+}
+
+// removedCards returns the IDs of the cards of before that after lacks.
+func removedCards(before, after Track) map[int]bool {
+	var removed = map[int]bool{}
+	for _, card := range before.Storage {
+		if !containsCard(after.Storage, card.ID) {
+			removed[card.ID] = true
+		}
+	}
+	return removed
+}
+
+func (s *MemoryStorage) UpdateTests(userID int, key string, tests TestsStatuses) error {
+	return s.writeTrack(userID, key, func(track *Track) error {
+		track.SetTests(tests)
+		return nil
+	})
+}
+
+func (s *MemoryStorage) GetUserDays() ([]UserDay, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var days = make([]UserDay, 0, len(s.users))
+	for _, e := range s.users {
+		e.mu.RLock()
+		if !e.deleted {
+			days = append(days, UserDay{ID: e.id, Settings: e.user.Settings, LastRollover: e.user.LastRollover})
+		}
+		e.mu.RUnlock()
+	}
+	return days, nil
+}
+
+func (s *MemoryStorage) RollOver(userID int, today Date) (bool, error) {
+	// Users already rolled over aren't written, so they aren't journaled.
+	var due bool
+	err := s.readUser(userID, func(user *User) error {
+		due = user.LastRollover.Before(today)
+		return nil
+	})
+	if err != nil || !due {
+		return false, err
+	}
+
+	var rolled bool
+	err = s.writeUser(userID, func(user *User) error {
+		if !user.LastRollover.Before(today) {
+			return nil
+		}
+
+		for i := range user.Tracks {
+			user.Tracks[i].UpToDate(today)
+		}
+		user.LastRollover = today
+		rolled = true
+		return nil
+	})
+	return rolled, err
+}
+
+func (s *MemoryStorage) AppendReviews(userID int, reviews ...Review) error {
+	if _, err := s.entry(userID); err != nil {
+		return err
+	}
+
+	s.reviewsMu.Lock()
+	defer s.reviewsMu.Unlock()
+
+	s.reviews[userID] = append(s.reviews[userID], reviews...)
+	return nil
+}
+
+func (s *MemoryStorage) GetReviews(userID int, filter ReviewFilter) ([]Review, error) {
+	s.reviewsMu.RLock()
+	defer s.reviewsMu.RUnlock()
+
+	var reviews = []Review{}
+	for _, review := range s.reviews[userID] {
+		if filter.Match(review) {
+			reviews = append(reviews, review)
+		}
+	}
+	return reviews, nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresMigrations are applied in order at startup. Never edit a migration
+// that has been released, append a new one instead.
+var postgresMigrations = []string{
+	`CREATE TABLE users (
+		id SERIAL PRIMARY KEY,
+		user_name TEXT NOT NULL UNIQUE,
+		e_mail TEXT NOT NULL DEFAULT '',
+		first_name TEXT NOT NULL DEFAULT '',
+		last_name TEXT NOT NULL DEFAULT '',
+		password TEXT NOT NULL DEFAULT '',
+		token TEXT NOT NULL DEFAULT '',
+		cokies_accepted BOOLEAN NOT NULL DEFAULT FALSE,
+		settings TEXT NOT NULL DEFAULT '{}',
+		tracks_keys TEXT NOT NULL DEFAULT '[]'
+	);
+	CREATE INDEX users_e_mail_idx ON users (e_mail);
+	CREATE INDEX users_token_idx ON users (token);
+
+	CREATE TABLE tracks (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		settings TEXT NOT NULL DEFAULT '{}',
+		UNIQUE (user_id, name)
+	);
+
+	CREATE TABLE tests (
+		track_id INTEGER NOT NULL REFERENCES tracks (id) ON DELETE CASCADE,
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		dayly_test_tries INTEGER NOT NULL DEFAULT 0,
+		last_fail_date TEXT NOT NULL DEFAULT '',
+		last_passed_date TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'missing',
+		failed_cards TEXT NOT NULL DEFAULT 'null',
+		PRIMARY KEY (track_id, kind)
+	);
+
+	CREATE TABLE cards (
+		id SERIAL PRIMARY KEY,
+		track_id INTEGER NOT NULL REFERENCES tracks (id) ON DELETE CASCADE,
+		card_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		translations TEXT NOT NULL DEFAULT 'null',
+		examples TEXT NOT NULL DEFAULT 'null',
+		notes TEXT NOT NULL DEFAULT '',
+		creation_date TEXT NOT NULL DEFAULT '',
+		pronunciation TEXT NOT NULL DEFAULT '',
+		UNIQUE (track_id, card_id)
+	);
+
+	CREATE TABLE test_data (
+		card_id INTEGER NOT NULL REFERENCES cards (id) ON DELETE CASCADE,
+		kind TEXT NOT NULL,
+		test_quize BOOLEAN NOT NULL DEFAULT FALSE,
+		repeat_date TEXT NOT NULL DEFAULT '',
+		repeated INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (card_id, kind)
+	);`,
+	`UPDATE tracks SET settings = REPLACE(settings, '"sumUntesteddCards"', '"sumUntestedCards"');`,
+	`ALTER TABLE users DROP COLUMN token;
+	ALTER TABLE users ADD COLUMN sessions TEXT NOT NULL DEFAULT 'null';`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+	ALTER TABLE users ADD COLUMN suspended BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE users ADD COLUMN e_mail_verified BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE users ADD COLUMN action_tokens TEXT NOT NULL DEFAULT 'null';`,
+	`ALTER TABLE users ADD COLUMN api_keys TEXT NOT NULL DEFAULT 'null';`,
+	`ALTER TABLE users ADD COLUMN consents TEXT NOT NULL DEFAULT 'null';
+	UPDATE users SET consents = '[{"policyVersion":"legacy","categories":[],"granted":true,"at":"' || to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"') || '","source":"migration"}]'
+		WHERE cokies_accepted;
+	ALTER TABLE users DROP COLUMN cokies_accepted;`,
+	`ALTER TABLE users ADD COLUMN erasure TEXT NOT NULL DEFAULT 'null';`,
+	`ALTER TABLE test_data ADD COLUMN ease DOUBLE PRECISION NOT NULL DEFAULT 0;
+	ALTER TABLE test_data ADD COLUMN interval_days INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE test_data ADD COLUMN lapses INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE reviews (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		track TEXT NOT NULL,
+		card_id INTEGER NOT NULL,
+		direction TEXT NOT NULL,
+		at TIMESTAMPTZ NOT NULL,
+		grade TEXT NOT NULL
+	);
+	CREATE INDEX reviews_user_idx ON reviews (user_id, at);
+	ALTER TABLE users ADD COLUMN fsrs_weights TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE test_data ADD COLUMN stability DOUBLE PRECISION NOT NULL DEFAULT 0;
+	ALTER TABLE test_data ADD COLUMN difficulty DOUBLE PRECISION NOT NULL DEFAULT 0;
+	ALTER TABLE test_data ADD COLUMN last_review TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE reviews ADD COLUMN response_ms INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE reviews ADD COLUMN prev_interval INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE reviews ADD COLUMN next_interval INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX reviews_card_idx ON reviews (user_id, track, card_id);`,
+	`UPDATE tests SET last_fail_date = REPLACE(last_fail_date, '.', '-'), last_passed_date = REPLACE(last_passed_date, '.', '-');
+	UPDATE cards SET creation_date = REPLACE(creation_date, '.', '-');
+	UPDATE test_data SET repeat_date = REPLACE(repeat_date, '.', '-'), last_review = REPLACE(last_review, '.', '-');`,
+	`ALTER TABLE users ADD COLUMN last_rollover TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE cards ADD COLUMN leech BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE cards ADD COLUMN suspended BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE cards ADD COLUMN tags TEXT NOT NULL DEFAULT 'null';`,
+	`DELETE FROM reviews WHERE NOT EXISTS (
+		SELECT 1 FROM tracks t JOIN cards c ON c.track_id = t.id
+		WHERE t.user_id = reviews.user_id AND t.name = reviews.track AND c.card_id = reviews.card_id
+	);`,
+}
+
+// migrationLockID is the postgres advisory lock held while migrating, so
+// several API instances starting at once don't run the same migration twice.
+const migrationLockID = 7351902
+
+func OpenPostgresStorage(dsn string) (*SQLStorage, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := migratePostgres(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Migration failed: %w", err)
+	}
+
+	return &SQLStorage{db: db, driver: "postgres"}, nil
+}
+
+func migratePostgres(db *sql.DB) error {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	return migrateSQL(db, postgresMigrations)
+}
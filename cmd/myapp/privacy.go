@@ -0,0 +1,481 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// audioDir holds the pronunciation files served by /audio.
+const audioDir = "./audio"
+
+// Erasure is a pending request to delete an account. The account stays
+// usable, and the request can be cancelled, until DueAt.
+type Erasure struct {
+	RequestedAt time.Time `json:"requestedAt"`
+	DueAt       time.Time `json:"dueAt"`
+	// Done are the erasure steps that already went through.
+	Done []string `json:"done,omitempty"`
+}
+
+// Eraser deletes accounts whose erasure is due, with everything kept about
+// them: the user, its audio files no one else uses, its copies in the
+// snapshots and the storage backups holding it.
+type Eraser struct {
+	store     Store
+	snapshots *Snapshotter
+
+	// Grace is how long an erasure can still be cancelled.
+	Grace time.Duration
+	// Interval between the checks for due erasures.
+	Interval time.Duration
+}
+
+// NewEraserFromEnv reads ERASURE_GRACE (default 7 days) and ERASURE_INTERVAL
+// (default 1h), both as durations like "72h".
+func NewEraserFromEnv(store Store, snapshots *Snapshotter) (*Eraser, error) {
+	var e = &Eraser{store: store, snapshots: snapshots, Grace: 7 * 24 * time.Hour, Interval: time.Hour}
+
+	for env, value := range map[string]*time.Duration{"ERASURE_GRACE": &e.Grace, "ERASURE_INTERVAL": &e.Interval} {
+		if str := os.Getenv(env); str != "" {
+			d, err := time.ParseDuration(str)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("Invalid %v: %v", env, str)
+			}
+			*value = d
+		}
+	}
+
+	return e, nil
+}
+
+// Run erases the due accounts every Interval until stop is closed.
+func (e *Eraser) Run(stop <-chan struct{}) {
+	if e.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.EraseDue(); err != nil {
+			log.Println("Erasing accounts failed:", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// EraseDue erases every account whose erasure is due, including the ones a
+// failed run left half erased.
+func (e *Eraser) EraseDue() error {
+	users, err := e.store.GetUsers()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, user := range users {
+		if user.Erasure == nil || user.Erasure.DueAt.After(time.Now()) {
+			continue
+		}
+
+		if err := e.Erase(user.ID); err != nil {
+			errs = append(errs, fmt.Errorf("User %d: %w", user.ID, err))
+			continue
+		}
+		log.Printf("Erased user %d", user.ID)
+	}
+
+	return errors.Join(errs...)
+}
+
+// erasureSteps run before the user itself is deleted. Each one is recorded in
+// Erasure.Done once it went through, so an erasure that failed half way only
+// runs the rest when EraseDue retries it.
+var erasureSteps = []struct {
+	name string
+	run  func(e *Eraser, user *User) error
+}{
+	{"audio", (*Eraser).eraseAudio},
+	{"snapshots", func(e *Eraser, user *User) error {
+		if e.snapshots == nil {
+			return nil
+		}
+		return e.snapshots.Forget(user.ID)
+	}},
+	{"backups", func(e *Eraser, user *User) error {
+		if backups, ok := e.store.(interface{ DropBackups(userID int) error }); ok {
+			return backups.DropBackups(user.ID)
+		}
+		return nil
+	}},
+}
+
+// Erase deletes the user at once. Until it is done the erasure stays due,
+// so EraseDue finishes it if a step fails.
+func (e *Eraser) Erase(userID int) error {
+	err := e.store.UpdateUserFunc(userID, func(user *User) error {
+		now := time.Now().UTC()
+		if user.Erasure == nil {
+			user.Erasure = &Erasure{RequestedAt: now, DueAt: now}
+		} else if user.Erasure.DueAt.After(now) {
+			user.Erasure.DueAt = now
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	user, err := e.store.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, step := range erasureSteps {
+		if slices.Contains(user.Erasure.Done, step.name) {
+			continue
+		}
+
+		if err := step.run(e, user); err != nil {
+			return fmt.Errorf("Erasing %v failed: %w", step.name, err)
+		}
+
+		err := e.store.UpdateUserFunc(userID, func(user *User) error {
+			user.Erasure.Done = append(user.Erasure.Done, step.name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := e.store.DeleteUser(userID); err != nil {
+		return err
+	}
+
+	// The JSON storage keeps the user in its storage file until the next
+	// write of it. Should that fail, the writer retries it.
+	if flusher, ok := e.store.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// eraseAudio deletes the audio files of the user's cards no other user
+// references.
+func (e *Eraser) eraseAudio(user *User) error {
+	var files = userAudioFiles(user)
+
+	users, err := e.store.GetUsers()
+	if err != nil {
+		return err
+	}
+	for _, other := range users {
+		if other.ID == user.ID {
+			continue
+		}
+		for file := range userAudioFiles(&other) {
+			delete(files, file)
+		}
+	}
+
+	for file := range files {
+		if err := os.Remove(filepath.Join(audioDir, file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// audioFile returns the name of the file in audioDir a card's pronunciation
+// points to.
+func audioFile(card Card) (string, bool) {
+	link, err := url.Parse(card.PronunciationPath)
+	if err != nil || link.Path != "/audio" {
+		return "", false
+	}
+
+	name := filepath.Base(link.Query().Get("filename"))
+	if name == "." || name == "/" || name == ".." {
+		return "", false
+	}
+	return name, true
+}
+
+func userAudioFiles(user *User) map[string]bool {
+	var files = map[string]bool{}
+	for _, track := range user.Tracks {
+		for _, card := range track.Storage {
+			if file, ok := audioFile(card); ok {
+				files[file] = true
+			}
+		}
+	}
+	return files
+}
+
+func (s *APIServer) handleErasure(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		user, err := s.getUser(r)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, user.Erasure)
+	case "POST":
+		return s.handleRequestErasure(w, r)
+	case "DELETE":
+		id, err := getID(r)
+		if err != nil {
+			return err
+		}
+
+		err = s.dataBase.UpdateUserFunc(id, func(user *User) error {
+			if user.Erasure == nil {
+				return fmt.Errorf("No erasure is scheduled")
+			}
+
+			user.Erasure = nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return WriteJSON(w, http.StatusOK, struct {
+			Status string `json:"status"`
+		}{
+			Status: "cancelled",
+		})
+	default:
+		return fmt.Errorf("Method not allowed")
+	}
+}
+
+// handleRequestErasure schedules the erasure of the account. Asking again
+// keeps the first date.
+func (s *APIServer) handleRequestErasure(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var account User
+	var scheduled bool
+	err = s.dataBase.UpdateUserFunc(id, func(user *User) error {
+		if user.Erasure == nil {
+			now := time.Now().UTC()
+			user.Erasure = &Erasure{RequestedAt: now, DueAt: now.Add(s.eraser.Grace)}
+			scheduled = true
+		}
+
+		account = *user
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if scheduled && account.EMail != "" {
+		err := s.mailer.Send(account.EMail, "Your account will be deleted", fmt.Sprintf(
+			"Hi %v,\n\nyour account and all its data will be deleted on %v.\nIf you didn't ask for it, log in and cancel the deletion before then.\n",
+			account.UserName, account.Erasure.DueAt.Format(time.RFC1123)))
+		if err != nil {
+			log.Println("Sending erasure mail failed:", err)
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, account.Erasure)
+}
+
+// handleExport sends everything kept about the user as a zip archive.
+func (s *APIServer) handleExport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.dataBase.GetUserByID(id)
+	if err != nil {
+		return err
+	}
+
+	reviews, err := s.dataBase.GetReviews(user.ID, ReviewFilter{})
+	if err != nil {
+		return err
+	}
+
+	var archive bytes.Buffer
+	if err := writeExport(&archive, user, reviews); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="export-%d-%s.zip"`, user.ID, time.Now().Format("20060102")))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(archive.Bytes())
+	return err
+}
+
+func writeExport(out io.Writer, user *User, reviews []Review) error {
+	zw := zip.NewWriter(out)
+
+	profile := user.Public()
+	profile.Tracks = nil
+	profile.Consents = nil
+
+	type sessionInfo struct {
+		CreatedAt time.Time `json:"createdAt"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}
+	var sessions = make([]sessionInfo, len(user.Sessions))
+	for i, session := range user.Sessions {
+		sessions[i] = sessionInfo{session.CreatedAt, session.ExpiresAt}
+	}
+
+	var keys = make([]APIKey, len(user.APIKeys))
+	for i, key := range user.APIKeys {
+		keys[i] = key.Copy()
+		keys[i].Hash = ""
+	}
+
+	var files = []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{"profile.json", jsonExport(struct {
+			User
+			Sessions []sessionInfo `json:"sessions"`
+			APIKeys  []APIKey      `json:"apiKeys"`
+		}{profile, sessions, keys})},
+		{"consents.json", jsonExport(consentHistory(user))},
+		{"tracks.json", jsonExport(user.Tracks)},
+		{"cards.csv", csvExport(cardRows(user))},
+		{"history.csv", csvExport(historyRows(user))},
+		{"reviews.csv", csvExport(reviewRows(reviews))},
+	}
+
+	for _, file := range files {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if err := file.write(fw); err != nil {
+			return err
+		}
+	}
+
+	for file := range userAudioFiles(user) {
+		data, err := os.ReadFile(filepath.Join(audioDir, file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		fw, err := zw.Create("audio/" + file)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func jsonExport(v any) func(io.Writer) error {
+	return func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+}
+
+func csvExport(rows [][]string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		cw := csv.NewWriter(w)
+		cw.WriteAll(rows)
+		return cw.Error()
+	}
+}
+
+func cardRows(user *User) [][]string {
+	var rows = [][]string{{"track", "id", "name", "translations", "examples", "notes", "creationDate", "pronunciation"}}
+	for _, track := range user.Tracks {
+		for _, card := range track.Storage {
+			rows = append(rows, []string{
+				track.Name,
+				strconv.Itoa(card.ID),
+				card.Data,
+				strings.Join(card.TranslatedData, "; "),
+				strings.Join(card.Examples, "; "),
+				card.Notes,
+				card.CreationDate.String(),
+				card.PronunciationPath,
+			})
+		}
+	}
+	return rows
+}
+
+// historyRows lists the last results of the tests and the state of every
+// card in each of them.
+func historyRows(user *User) [][]string {
+	var rows = [][]string{{"track", "test", "cardID", "repeated", "repeatDate", "status", "lastPassedDate", "lastFailDate"}}
+	for _, track := range user.Tracks {
+		for i, test := range []Test{track.FromLanguage, track.ToLanguage, track.Listening, track.Writing} {
+			rows = append(rows, []string{track.Name, testNames[i], "", "", "", test.Status, test.LastPassedDate.String(), test.LastFailDate.String()})
+		}
+
+		for _, card := range track.Storage {
+			for i, data := range []TestData{card.FromLanguage, card.ToLanguage, card.Listening, card.Writing} {
+				rows = append(rows, []string{track.Name, testNames[i], strconv.Itoa(card.ID), strconv.Itoa(data.Repeated), data.ReapeatDate.String(), "", "", ""})
+			}
+		}
+	}
+	return rows
+}
+
+func reviewRows(reviews []Review) [][]string {
+	var rows = [][]string{{"track", "cardID", "direction", "at", "grade", "responseMs", "prevInterval", "nextInterval"}}
+	for _, review := range reviews {
+		rows = append(rows, []string{
+			review.Track,
+			strconv.Itoa(review.CardID),
+			review.Direction,
+			review.At.Format(time.RFC3339),
+			string(review.Grade),
+			strconv.Itoa(review.ResponseMs),
+			strconv.Itoa(review.PrevInterval),
+			strconv.Itoa(review.NextInterval),
+		})
+	}
+	return rows
+}
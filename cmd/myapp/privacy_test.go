@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	handler := newTestServer(t, store).Handler()
+
+	c, err := signUp(handler, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.newAPIKey(t, CreateAPIKeyReq{Label: "export"})
+	if err := c.createTrack(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.postCard("exported", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := c.serve("GET", c.path("/export"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got %d: %v", w.Code, w.Body)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files = map[string]string{}
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = string(data)
+	}
+
+	for _, name := range []string{"profile.json", "consents.json", "tracks.json", "cards.csv", "history.csv", "reviews.csv"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("The export has no %v", name)
+		}
+	}
+
+	if !strings.Contains(files["profile.json"], "user0@example.com") {
+		t.Errorf("profile.json doesn't hold the email: %v", files["profile.json"])
+	}
+	if !strings.Contains(files["cards.csv"], "exported") {
+		t.Errorf("cards.csv doesn't hold the card: %v", files["cards.csv"])
+	}
+
+	user, err := store.GetUserByID(c.auth.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secrets = []string{user.Password}
+	for _, session := range user.Sessions {
+		secrets = append(secrets, session.RefreshHash)
+	}
+	for _, key := range user.APIKeys {
+		secrets = append(secrets, key.Hash)
+	}
+	for name, data := range files {
+		for _, secret := range secrets {
+			if secret != "" && strings.Contains(data, secret) {
+				t.Errorf("%v holds the secret %v", name, secret)
+			}
+		}
+	}
+}
+
+func TestErasure(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	server := newTestServer(t, store)
+	handler := server.Handler()
+
+	c, err := signUp(handler, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var scheduled Erasure
+	if err := c.do("POST", c.path("/erasure"), nil, &scheduled); err != nil {
+		t.Fatal(err)
+	}
+	if !scheduled.DueAt.After(time.Now()) {
+		t.Errorf("The erasure is due at %v, want it after the grace period", scheduled.DueAt)
+	}
+
+	var again Erasure
+	if err := c.do("POST", c.path("/erasure"), nil, &again); err != nil {
+		t.Fatal(err)
+	}
+	if !again.DueAt.Equal(scheduled.DueAt) {
+		t.Errorf("Asking again moved the erasure from %v to %v", scheduled.DueAt, again.DueAt)
+	}
+
+	if err := server.eraser.EraseDue(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetUserByID(c.auth.Id); err != nil {
+		t.Fatalf("The user was erased before the erasure was due: %v", err)
+	}
+
+	if err := c.do("DELETE", c.path("/erasure"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := store.GetUserByID(c.auth.Id); err != nil || user.Erasure != nil {
+		t.Fatalf("Cancelling left %+v, %v", user.Erasure, err)
+	}
+
+	if err := c.do("POST", c.path("/erasure"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	err = store.UpdateUserFunc(c.auth.Id, func(user *User) error {
+		user.Erasure.DueAt = time.Now().Add(-time.Minute)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.eraser.EraseDue(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetUserByID(c.auth.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got %v after the erasure, want ErrNotFound", err)
+	}
+}
+
+// failingDelete fails DeleteUser until it is told not to.
+type failingDelete struct {
+	Store
+	fail bool
+}
+
+func (s *failingDelete) DeleteUser(id int) error {
+	if s.fail {
+		return errors.New("DeleteUser failed")
+	}
+	return s.Store.DeleteUser(id)
+}
+
+func TestEraseRetry(t *testing.T) {
+	store := &failingDelete{Store: NewMemoryStorage(nil), fail: true}
+	user := newTestUser(t, store, "erased")
+	eraser := &Eraser{store: store}
+
+	if err := eraser.Erase(user.ID); err == nil {
+		t.Fatal("Erase didn't report the failed DeleteUser")
+	}
+
+	got, err := store.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Erasure == nil || got.Erasure.DueAt.After(time.Now()) {
+		t.Fatalf("The failed erasure isn't due: %+v", got.Erasure)
+	}
+	for _, step := range erasureSteps {
+		if !slices.Contains(got.Erasure.Done, step.name) {
+			t.Errorf("Step %v isn't recorded as done: %v", step.name, got.Erasure.Done)
+		}
+	}
+
+	if err := eraser.EraseDue(); err == nil {
+		t.Error("EraseDue didn't report the failed DeleteUser")
+	}
+
+	store.fail = false
+	if err := eraser.EraseDue(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetUserByID(user.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Got %v after the retry, want ErrNotFound", err)
+	}
+}
+
+func TestEraseDropsBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "storage.json")
+
+	data, err := os.ReadFile("testdata/storage.v0.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	backup := path + ".v0.bak"
+	if _, err := os.Stat(backup); err != nil {
+		t.Fatalf("Opening the old storage left no backup: %v", err)
+	}
+
+	// A backup without the user stays.
+	users, err := store.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	others := slices.DeleteFunc(users, func(user User) bool { return user.ID == 1 })
+	otherData, err := encodeStorage(others)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBackup := path + ".v1.bak"
+	if err := os.WriteFile(otherBackup, otherData, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	eraser := &Eraser{store: store}
+	if err := eraser.Erase(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(backup); !os.IsNotExist(err) {
+		t.Errorf("The backup holding the user is still there: %v", err)
+	}
+	if _, err := os.Stat(otherBackup); err != nil {
+		t.Errorf("The backup without the user is gone: %v", err)
+	}
+
+	stored, err := ReadStorageFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.ContainsFunc(stored, func(user User) bool { return user.ID == 1 }) {
+		t.Error("The storage file still holds the user")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// RatePolicy is a token bucket: Burst requests at once, refilled at Rate.
+// ByUser buckets logged in users by account instead of by IP.
+type RatePolicy struct {
+	Name   string
+	Rate   rate.Limit
+	Burst  int
+	ByUser bool
+}
+
+var (
+	// clientPolicy covers every request of an IP.
+	clientPolicy = RatePolicy{Name: "client", Rate: 20, Burst: 100}
+	// authPolicy covers log in, sign up and the mailed token endpoints.
+	authPolicy = RatePolicy{Name: "auth", Rate: rate.Every(6 * time.Second), Burst: 10}
+	// userPolicy covers the routes of a logged in user.
+	userPolicy = RatePolicy{Name: "user", Rate: 10, Burst: 50, ByUser: true}
+	// dictionaryPolicy covers /newCardData, which calls paid APIs.
+	dictionaryPolicy = RatePolicy{Name: "dictionary", Rate: rate.Every(3 * time.Second), Burst: 20, ByUser: true}
+)
+
+const limiterIdleTimeout = 10 * time.Minute
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter keeps one bucket per policy and client. Buckets idle for
+// limiterIdleTimeout are dropped.
+type RateLimiter struct {
+	mu        sync.Mutex
+	limiters  map[string]*limiterEntry
+	lastSweep time.Time
+	// proxyHops is the number of trusted proxies in front of the server.
+	proxyHops int
+}
+
+// NewRateLimiter takes the client IP from X-Forwarded-For when TRUST_PROXY
+// is set to the number of proxies in front of the server, "1" when it is
+// set to anything else.
+func NewRateLimiter() *RateLimiter {
+	var hops int
+	if env := os.Getenv("TRUST_PROXY"); env != "" {
+		if n, err := strconv.Atoi(env); err == nil && n > 0 {
+			hops = n
+		} else {
+			hops = 1
+		}
+	}
+
+	return &RateLimiter{
+		limiters:  map[string]*limiterEntry{},
+		lastSweep: time.Now(),
+		proxyHops: hops,
+	}
+}
+
+// clientIP is the address the first trusted proxy saw the request come from.
+// Every proxy appends to X-Forwarded-For, so that is the entry proxyHops
+// from the right, anything left of it is up to the client.
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	if l.proxyHops > 0 {
+		var entries []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			entries = append(entries, strings.Split(header, ",")...)
+		}
+		if len(entries) > 0 {
+			return strings.TrimSpace(entries[max(len(entries)-l.proxyHops, 0)])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// reserve takes a token from the bucket of key and returns how long the
+// client has to wait when there is none.
+func (l *RateLimiter) reserve(policy RatePolicy, key string) time.Duration {
+	now := time.Now()
+
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for key, entry := range l.limiters {
+			if now.Sub(entry.lastSeen) > limiterIdleTimeout {
+				delete(l.limiters, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	entry, ok := l.limiters[policy.Name+":"+key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(policy.Rate, policy.Burst)}
+		l.limiters[policy.Name+":"+key] = entry
+	}
+	entry.lastSeen = now
+	l.mu.Unlock()
+
+	reservation := entry.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return time.Minute
+	}
+
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// Limit wraps next with the bucket of policy.
+func (l *RateLimiter) Limit(policy RatePolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := "ip:" + l.clientIP(r)
+		if user, ok := userFromContext(r.Context()); ok && policy.ByUser {
+			key = "user:" + strconv.Itoa(user.ID)
+		}
+
+		if wait := l.reserve(policy, key); wait > 0 {
+			writeTooManyRequests(w, wait)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware applies policy to every route of a router.
+func (l *RateLimiter) Middleware(policy RatePolicy) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return l.Limit(policy, next)
+	}
+}
+
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	WriteJSON(w, http.StatusTooManyRequests, APIError{Error: fmt.Sprintf("Too many requests, try again in %v", wait.Round(time.Second))})
+}
+
+const (
+	// maxLoginFailures failed logins in a row lock the account for
+	// loginLockout, and every further lockout lasts twice as long.
+	maxLoginFailures = 5
+	loginLockout     = 15 * time.Minute
+	maxLoginLockout  = 24 * time.Hour
+)
+
+type loginState struct {
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// LoginGuard counts failed logins per account. Only existing accounts are
+// counted, guessing unknown names is left to authPolicy. The counts live in
+// memory, a restart unlocks every account.
+type LoginGuard struct {
+	mu       sync.Mutex
+	accounts map[int]*loginState
+}
+
+func NewLoginGuard() *LoginGuard {
+	return &LoginGuard{accounts: map[int]*loginState{}}
+}
+
+// Attempt starts a login on the account. A locked account returns how long
+// it is still locked in wait and the login is refused. Otherwise the attempt
+// counts as failed until Succeeded is called, and lockout is how long the
+// account stays locked if it does fail. Checking and counting at once keeps
+// concurrent guesses from all getting in before the lockout.
+func (g *LoginGuard) Attempt(account int) (wait, lockout time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	state, ok := g.accounts[account]
+	if !ok {
+		state = &loginState{}
+		g.accounts[account] = state
+	}
+
+	if wait := time.Until(state.lockedUntil); wait > 0 {
+		return wait, 0
+	}
+
+	state.failures++
+	if state.failures < maxLoginFailures {
+		return 0, 0
+	}
+
+	lockout = min(loginLockout<<min(state.lockouts, 10), maxLoginLockout)
+	state.failures = 0
+	state.lockouts++
+	state.lockedUntil = time.Now().Add(lockout)
+	return 0, lockout
+}
+
+func (g *LoginGuard) Succeeded(account int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.accounts, account)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestClientIP(t *testing.T) {
+	var tests = []struct {
+		name      string
+		hops      int
+		forwarded []string
+		want      string
+	}{
+		{"no proxy", 0, []string{"1.1.1.1"}, "10.0.0.1"},
+		{"no header", 1, nil, "10.0.0.1"},
+		{"one proxy", 1, []string{"1.1.1.1"}, "1.1.1.1"},
+		{"spoofed entry", 1, []string{"6.6.6.6, 1.1.1.1"}, "1.1.1.1"},
+		{"two proxies", 2, []string{"6.6.6.6, 1.1.1.1, 2.2.2.2"}, "1.1.1.1"},
+		{"header per proxy", 2, []string{"6.6.6.6", "1.1.1.1", "2.2.2.2"}, "1.1.1.1"},
+		{"fewer entries than proxies", 3, []string{"1.1.1.1, 2.2.2.2"}, "1.1.1.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			for _, header := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+
+			l := &RateLimiter{limiters: map[string]*limiterEntry{}, proxyHops: test.hops}
+			if got := l.clientIP(r); got != test.want {
+				t.Errorf("clientIP() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	l := NewRateLimiter()
+	policy := RatePolicy{Name: "test", Rate: rate.Every(time.Minute), Burst: 2}
+	handler := l.Limit(policy, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < policy.Burst; i++ {
+		if w := request("10.0.0.1"); w.Code != http.StatusOK {
+			t.Fatalf("Request %d: got %d, want %d", i+1, w.Code, http.StatusOK)
+		}
+	}
+
+	w := request("10.0.0.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Request over the burst: got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if after, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || after < 1 || after > 60 {
+		t.Errorf("Retry-After is %q, want 1 to 60 seconds", w.Header().Get("Retry-After"))
+	}
+
+	if w := request("10.0.0.2"); w.Code != http.StatusOK {
+		t.Errorf("Another client: got %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+// logIn logs the user of c in with password.
+func (c *testClient) logIn(t *testing.T, password string) *httptest.ResponseRecorder {
+	w, err := c.serve("PUT", "/register", LogInReq{UsernameEMail: "user0", Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestLoginLockout(t *testing.T) {
+	c, err := signUp(newTestServer(t, NewMemoryStorage(nil)).Handler(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < maxLoginFailures; i++ {
+		if w := c.logIn(t, "wrong"); w.Code != http.StatusBadRequest {
+			t.Fatalf("Failure %d: got %d, want %d", i, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	w := c.logIn(t, "wrong")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != strconv.Itoa(int(loginLockout.Seconds())) {
+		t.Fatalf("Last failure: got %d with Retry-After %q, want %d with %v", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests, loginLockout.Seconds())
+	}
+
+	// Locked, even the right password is refused, from any IP.
+	c.ip = "10.9.9.9"
+	if w := c.logIn(t, "password"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Locked account: got %d with Retry-After %q, want %d", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+}
+
+func TestLoginSuccessResetsFailures(t *testing.T) {
+	c, err := signUp(newTestServer(t, NewMemoryStorage(nil)).Handler(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 2; round++ {
+		for i := 1; i < maxLoginFailures; i++ {
+			if w := c.logIn(t, "wrong"); w.Code != http.StatusBadRequest {
+				t.Fatalf("Round %d, failure %d: got %d, want %d", round, i, w.Code, http.StatusBadRequest)
+			}
+		}
+		if w := c.logIn(t, "password"); w.Code != http.StatusOK {
+			t.Fatalf("Round %d, right password: got %d, want %d", round, w.Code, http.StatusOK)
+		}
+
+		// The rate limit of the IP isn't under test.
+		c.ip = "10.9.9.9"
+	}
+}
+
+// Concurrent guesses can't get past the lockout: only maxLoginFailures of
+// them are let through.
+func TestLoginGuardConcurrentAttempts(t *testing.T) {
+	const attempts = 20
+
+	g := NewLoginGuard()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var allowed, lockouts int
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, lockout := g.Attempt(1)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if wait == 0 {
+				allowed++
+			}
+			if lockout > 0 {
+				lockouts++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != maxLoginFailures || lockouts != 1 {
+		t.Errorf("%d attempts allowed with %d lockouts, want %d with 1", allowed, lockouts, maxLoginFailures)
+	}
+
+	g.Succeeded(1)
+	if wait, _ := g.Attempt(1); wait != 0 {
+		t.Errorf("Attempt after a success waits %v, want 0", wait)
+	}
+}
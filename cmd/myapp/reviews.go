@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+)
+
+// Review is one graded answer to a card in one direction. Reviews are only
+// appended and are kept apart from the user, so they don't grow every copy
+// of it.
+type Review struct {
+	Track     string    `json:"track"`
+	CardID    int       `json:"cardID"`
+	Direction string    `json:"direction"`
+	At        time.Time `json:"at"`
+	Grade     Grade     `json:"grade"`
+	// ResponseMs is how long the answer took, 0 when the client didn't
+	// measure it.
+	ResponseMs int `json:"responseMs"`
+	// PrevInterval and NextInterval are the days the card was scheduled for
+	// before and after the answer. They are the same for the answers of a
+	// tried test, which doesn't schedule the cards.
+	PrevInterval int `json:"prevInterval"`
+	NextInterval int `json:"nextInterval"`
+}
+
+// ReviewFilter selects reviews, empty fields match every review.
+type ReviewFilter struct {
+	Track     string
+	CardID    int
+	Direction string
+}
+
+func (f ReviewFilter) Match(review Review) bool {
+	return (f.Track == "" || f.Track == review.Track) &&
+		(f.CardID == 0 || f.CardID == review.CardID) &&
+		(f.Direction == "" || f.Direction == review.Direction)
+}
+
+type reviewEntry struct {
+	UserID int `json:"userID"`
+	Review
+}
+
+// reviewFile is the review log of LocalStorage: one JSON line per review.
+// The caller serializes the access to it.
+type reviewFile struct {
+	path string
+	file *os.File
+}
+
+// hasReviewedCard reports whether the user still has the card of review.
+func hasReviewedCard(user *User, review Review) bool {
+	track, err := findTrack(user, review.Track)
+	return err == nil && containsCard(track.Storage, review.CardID)
+}
+
+// openReviewFile reads the reviews in path, grouped by user. A torn last
+// line, left by a crash during Append, is skipped.
+func openReviewFile(path string) (*reviewFile, map[int][]Review, error) {
+	var reviews = map[int][]Review{}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var entry reviewEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if i == len(lines)-1 {
+				log.Printf("Skipping incomplete review: %v", err)
+				continue
+			}
+			return nil, nil, fmt.Errorf("Corrupt review on line %d: %w", i+1, err)
+		}
+		reviews[entry.UserID] = append(reviews[entry.UserID], entry.Review)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &reviewFile{path: path, file: file}, reviews, nil
+}
+
+// Append writes the reviews and syncs them to disk before returning.
+func (f *reviewFile) Append(userID int, reviews ...Review) error {
+	var data []byte
+	for _, review := range reviews {
+		line, err := json.Marshal(reviewEntry{UserID: userID, Review: review})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	if _, err := f.file.Write(data); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Rewrite replaces the file with reviews, to drop the reviews of deleted
+// users.
+func (f *reviewFile) Rewrite(reviews map[int][]Review) error {
+	var data []byte
+	for userID, userReviews := range reviews {
+		for _, review := range userReviews {
+			line, err := json.Marshal(reviewEntry{UserID: userID, Review: review})
+			if err != nil {
+				return err
+			}
+			data = append(append(data, line...), '\n')
+		}
+	}
+
+	if err := writeFileAtomic(f.path, data); err != nil {
+		return err
+	}
+
+	// The old handle still points to the replaced file.
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	f.file.Close()
+	f.file = file
+	return nil
+}
+
+func (f *reviewFile) Close() error {
+	return f.file.Close()
+}
+
+// reviewFilter reads the optional ?direction= of a review query.
+func reviewFilter(r *http.Request, key string) (ReviewFilter, error) {
+	var filter = ReviewFilter{Track: key, Direction: r.URL.Query().Get("direction")}
+	if filter.Direction != "" && !slices.Contains(testNames, filter.Direction) {
+		return ReviewFilter{}, fmt.Errorf("Undefined tast name: %v", filter.Direction)
+	}
+	return filter, nil
+}
+
+func (s *APIServer) handleTrackReviews(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	userID, key, err := getTrackPath(r)
+	if err != nil {
+		return err
+	}
+
+	filter, err := reviewFilter(r, key)
+	if err != nil {
+		return err
+	}
+
+	reviews, err := s.dataBase.GetReviews(userID, filter)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, reviews)
+}
+
+func (s *APIServer) handleCardReviews(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	userID, key, err := getTrackPath(r)
+	if err != nil {
+		return err
+	}
+
+	filter, err := reviewFilter(r, key)
+	if err != nil {
+		return err
+	}
+
+	if filter.CardID, err = getCardID(r); err != nil {
+		return err
+	}
+
+	reviews, err := s.dataBase.GetReviews(userID, filter)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, reviews)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rolloverHistorySize is how many runs Roller remembers.
+const rolloverHistorySize = 500
+
+// Roller starts the new day of every user soon after it begins: cards
+// overdue are due again today and the tests of the day before are reset.
+// Rolling a user over twice on the same day changes nothing.
+type Roller struct {
+	store Store
+	clock Clock
+
+	// Interval is the longest wait between two checks. It bounds how late
+	// new users and changed time zones are noticed.
+	Interval time.Duration
+
+	mu      sync.Mutex
+	history []RolloverRun
+}
+
+// RolloverRun is the rollover of one user, kept for debugging.
+type RolloverRun struct {
+	UserID     int       `json:"userID"`
+	Day        Date      `json:"day"`
+	At         time.Time `json:"at"`
+	DurationMs int64     `json:"durationMs"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// UserDay is what Roller needs of a user to know whether their day began
+// since their last rollover.
+type UserDay struct {
+	ID           int
+	Settings     Settings
+	LastRollover Date
+}
+
+// NewRollerFromEnv reads ROLLOVER_INTERVAL (default 15m).
+func NewRollerFromEnv(store Store, clock Clock) (*Roller, error) {
+	var r = &Roller{store: store, clock: clock, Interval: 15 * time.Minute}
+
+	if str := os.Getenv("ROLLOVER_INTERVAL"); str != "" {
+		d, err := time.ParseDuration(str)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid ROLLOVER_INTERVAL: %v", str)
+		}
+		r.Interval = d
+	}
+
+	return r, nil
+}
+
+// Run rolls users over whenever the day of one of them begins, until stop
+// is closed.
+func (r *Roller) Run(stop <-chan struct{}) {
+	for {
+		next, err := r.RollOver()
+		if err != nil {
+			log.Println("Rolling over failed:", err)
+		}
+
+		timer := time.NewTimer(min(next.Sub(r.clock.Now()), r.Interval))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// RollOver rolls over every user whose day changed since their last
+// rollover and returns when the next day of any user begins. Only those
+// users are read in full, by the store as it rolls them over.
+func (r *Roller) RollOver() (time.Time, error) {
+	users, err := r.store.GetUserDays()
+	if err != nil {
+		return r.clock.Now().Add(r.Interval), err
+	}
+
+	var next = r.clock.Now().Add(r.Interval)
+	var failed error
+	for _, user := range users {
+		now := r.clock.Now()
+		today := user.Settings.Today(now)
+		if start := user.Settings.DayStart(today.AddDays(1)); start.Before(next) {
+			next = start
+		}
+
+		if !user.LastRollover.Before(today) {
+			continue
+		}
+
+		rolled, err := r.store.RollOver(user.ID, today)
+		if !rolled && err == nil {
+			continue
+		}
+
+		var run = RolloverRun{UserID: user.ID, Day: today, At: now, DurationMs: r.clock.Now().Sub(now).Milliseconds()}
+		if err != nil {
+			run.Error = err.Error()
+			failed = fmt.Errorf("User %d: %w", user.ID, err)
+		}
+		r.record(run)
+	}
+
+	return next, failed
+}
+
+func (r *Roller) record(run RolloverRun) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.history = append(r.history, run)
+	if len(r.history) > rolloverHistorySize {
+		r.history = r.history[len(r.history)-rolloverHistorySize:]
+	}
+}
+
+// History returns the remembered runs, newest first, only those of userID
+// unless it is -1.
+func (r *Roller) History(userID int) []RolloverRun {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var runs = []RolloverRun{}
+	for i := len(r.history) - 1; i >= 0; i-- {
+		if userID == -1 || r.history[i].UserID == userID {
+			runs = append(runs, r.history[i])
+		}
+	}
+	return runs
+}
+
+func (s *APIServer) handleRollovers(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	var userID = -1
+	if str := r.URL.Query().Get("userID"); str != "" {
+		var err error
+		if userID, err = strconv.Atoi(str); err != nil {
+			return fmt.Errorf("Invalid id given %s", str)
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, s.roller.History(userID))
+}
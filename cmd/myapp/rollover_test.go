@@ -0,0 +1,226 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rollOverCounter counts the users rolled over and refuses reading every
+// user in full.
+type rollOverCounter struct {
+	Store
+	t *testing.T
+
+	mu    sync.Mutex
+	calls map[int]int
+}
+
+func (s *rollOverCounter) GetUsers() ([]User, error) {
+	s.t.Error("The roller read every user in full")
+	return s.Store.GetUsers()
+}
+
+func (s *rollOverCounter) RollOver(userID int, today Date) (bool, error) {
+	s.mu.Lock()
+	s.calls[userID]++
+	s.mu.Unlock()
+	return s.Store.RollOver(userID, today)
+}
+
+func fixedClock(now time.Time) Clock {
+	return ClockFunc(func() time.Time { return now })
+}
+
+func TestRollerOnlyRollsStartedDays(t *testing.T) {
+	memory := NewMemoryStorage(nil)
+	store := &rollOverCounter{Store: memory, t: t, calls: map[int]int{}}
+	now := time.Date(2024, time.March, 10, 10, 0, 0, 0, time.UTC)
+
+	var users = []struct {
+		name         string
+		settings     Settings
+		lastRollover Date
+		rolled       bool
+	}{
+		{"kyiv", Settings{TimeZone: "Europe/Kyiv", DayStartHour: 4}, Date{2024, time.March, 9}, true},
+		{"utc", Settings{TimeZone: "UTC", DayStartHour: 6}, Date{2024, time.March, 10}, false},
+		// Still the 9th in Honolulu, 00:00 there.
+		{"honolulu", Settings{TimeZone: "Pacific/Honolulu", DayStartHour: 1}, Date{2024, time.March, 9}, false},
+	}
+
+	var ids = map[string]int{}
+	for _, u := range users {
+		user := newTestUser(t, memory, u.name)
+		ids[u.name] = user.ID
+		err := memory.UpdateUserFunc(user.ID, func(user *User) error {
+			user.Settings = u.settings
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := memory.RollOver(user.ID, u.lastRollover); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roller := &Roller{store: store, clock: fixedClock(now), Interval: 24 * time.Hour}
+	next, err := roller.RollOver()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range users {
+		want := 0
+		if u.rolled {
+			want = 1
+		}
+		if calls := store.calls[ids[u.name]]; calls != want {
+			t.Errorf("%v was rolled over %d times, want %d", u.name, calls, want)
+		}
+	}
+
+	// The next start is 01:00 in Honolulu, an hour from now.
+	if want := now.Add(time.Hour); !next.Equal(want) {
+		t.Errorf("The next day starts at %v, want %v", next, want)
+	}
+
+	runs := roller.History(-1)
+	if len(runs) != 1 || runs[0].UserID != ids["kyiv"] || runs[0].Day != (Date{2024, time.March, 10}) {
+		t.Errorf("History() = %+v, want the rollover of kyiv on the 10th", runs)
+	}
+}
+
+// Rollers of several instances sharing a database roll every user over
+// once a day, whichever of them claims it first.
+func TestRollerOncePerDayAcrossInstances(t *testing.T) {
+	const instances, users = 8, 5
+	now := time.Date(2024, time.March, 10, 10, 0, 0, 0, time.UTC)
+
+	var backends = []struct {
+		name string
+		open func(t *testing.T) func() Store
+	}{
+		{"memory", func(t *testing.T) func() Store {
+			store := NewMemoryStorage(nil)
+			return func() Store { return store }
+		}},
+		{"sqlite", func(t *testing.T) func() Store {
+			path := filepath.Join(t.TempDir(), "storage.db")
+			return func() Store {
+				store, err := OpenSQLiteStorage(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { store.Close() })
+				return store
+			}
+		}},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			open := backend.open(t)
+
+			first := open()
+			var ids []int
+			for i := 0; i < users; i++ {
+				user := newTestUser(t, first, string(rune('a'+i)))
+				ids = append(ids, user.ID)
+				newTestTrack(t, first, user.ID, newTestCard(1, testToday.AddDays(-3)))
+				err := first.UpdateUserFunc(user.ID, func(user *User) error {
+					user.Settings.TimeZone = "UTC"
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var rollers = make([]*Roller, instances)
+			for i := range rollers {
+				rollers[i] = &Roller{store: open(), clock: fixedClock(now), Interval: time.Hour}
+			}
+
+			// Every instance claims the day before of every user at once,
+			// one claim of each user wins.
+			var mu sync.Mutex
+			var claims = map[int]int{}
+			var start = make(chan struct{})
+			var wg sync.WaitGroup
+			for _, roller := range rollers {
+				for _, id := range ids {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						<-start
+						rolled, err := roller.store.RollOver(id, testToday.AddDays(-1))
+						if err != nil {
+							t.Error(err)
+						}
+						if rolled {
+							mu.Lock()
+							claims[id]++
+							mu.Unlock()
+						}
+					}()
+				}
+			}
+			close(start)
+			wg.Wait()
+
+			for _, id := range ids {
+				if claims[id] != 1 {
+					t.Errorf("The day before of user %d was claimed %d times, want once", id, claims[id])
+				}
+			}
+
+			start = make(chan struct{})
+			for _, roller := range rollers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					if _, err := roller.RollOver(); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			var rolled = map[int]int{}
+			for _, roller := range rollers {
+				for _, run := range roller.History(-1) {
+					rolled[run.UserID]++
+				}
+			}
+			if len(rolled) != users {
+				t.Errorf("%d users were rolled over, want %d", len(rolled), users)
+			}
+			for id, n := range rolled {
+				if n != 1 {
+					t.Errorf("User %d was rolled over %d times", id, n)
+				}
+			}
+
+			// A later run on the same day finds nothing to do.
+			if _, err := rollers[0].RollOver(); err != nil {
+				t.Fatal(err)
+			}
+			if n := countRuns(rollers); n != users {
+				t.Errorf("A second run on the same day made %d rollovers, want none", n-users)
+			}
+		})
+	}
+}
+
+func countRuns(rollers []*Roller) int {
+	var n int
+	for _, roller := range rollers {
+		n += len(roller.History(-1))
+	}
+	return n
+}
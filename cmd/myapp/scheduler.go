@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Grade is how well a card was answered.
+type Grade string
+
+const (
+	GradeAgain Grade = "again"
+	GradeHard  Grade = "hard"
+	GradeGood  Grade = "good"
+	GradeEasy  Grade = "easy"
+)
+
+var grades = []Grade{GradeAgain, GradeHard, GradeGood, GradeEasy}
+
+// CardGrade is the answer to one card of a test. Grade may be left out to
+// only report the response time.
+type CardGrade struct {
+	ID         int   `json:"id"`
+	Grade      Grade `json:"grade"`
+	ResponseMs int   `json:"responseMs"`
+}
+
+// Scheduler decides when a card is tested again. Schedule is called for each
+// card of a finished test with the direction that was tested and the user's
+// day, and updates its repeat date along with whatever state the scheduler
+// keeps in TestData. Every scheduler counts an again answer in Lapses.
+type Scheduler interface {
+	Schedule(test *TestData, grade Grade, today Date)
+}
+
+const defaultScheduler = "ladder"
+
+// schedulers build the algorithm a track chose with TrackSettings.Scheduler
+// for the user owning the track, an empty name means defaultScheduler.
+var schedulers = map[string]func(user *User, settings TrackSettings) Scheduler{
+	"ladder": func(*User, TrackSettings) Scheduler {
+		return LadderScheduler{Days: []int{1, 1, 1, 3, 5, 7, 14, 30, 60, 240}}
+	},
+	"sm2":  func(*User, TrackSettings) Scheduler { return SM2Scheduler{} },
+	"fsrs": newFSRSScheduler,
+}
+
+func newScheduler(user *User, settings TrackSettings) (Scheduler, error) {
+	if err := checkSchedulerSettings(settings); err != nil {
+		return nil, err
+	}
+
+	name := settings.Scheduler
+	if name == "" {
+		name = defaultScheduler
+	}
+	return schedulers[name](user, settings), nil
+}
+
+func checkSchedulerSettings(settings TrackSettings) error {
+	if _, ok := schedulers[settings.Scheduler]; !ok && settings.Scheduler != "" {
+		var names []string
+		for name := range schedulers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("Unknown scheduler %v, use one of %v", settings.Scheduler, strings.Join(names, ", "))
+	}
+
+	if retention := settings.TargetRetention; retention != 0 && (retention < minRetention || retention > maxRetention) {
+		return fmt.Errorf("Target retention has to be between %v and %v", minRetention, maxRetention)
+	}
+	if err := checkBacklogPolicy(settings.Backlog); err != nil {
+		return err
+	}
+	return checkLeechPolicy(settings.Leeches)
+}
+
+// failedIntervalFactor shortens the interval a card of the last failed test
+// earns when it is passed, on tracks with FailedTestCardsPriopity, so it
+// comes back sooner. The interval after a failed answer is short already.
+const failedIntervalFactor = 0.5
+
+func shortenInterval(test *TestData, today Date) {
+	if test.Interval <= 1 {
+		return
+	}
+
+	test.Interval = max(1, int(float64(test.Interval)*failedIntervalFactor))
+	test.ReapeatDate = today.AddDays(test.Interval)
+}
+
+// LadderScheduler waits Days[n] days after the nth pass in a row and starts
+// over on a fail. Every grade but again is a pass. Cards passed more often
+// than the ladder is long are due the same day.
+type LadderScheduler struct {
+	Days []int
+}
+
+func (l LadderScheduler) Schedule(test *TestData, grade Grade, today Date) {
+	if grade != GradeAgain {
+		test.Repeated++
+	} else {
+		test.Repeated = 0
+		test.Lapses++
+	}
+
+	test.Interval = 0
+	if test.Repeated < len(l.Days) {
+		test.Interval = l.Days[test.Repeated]
+	}
+
+	test.ReapeatDate = today.AddDays(test.Interval)
+}
+
+const (
+	sm2StartEase = 2.5
+	sm2MinEase   = 1.3
+	// sm2HardFactor and sm2EasyBonus scale the interval of hard and easy
+	// answers.
+	sm2HardFactor = 1.2
+	sm2EasyBonus  = 1.3
+)
+
+// SM2Scheduler is SuperMemo 2 with four grades: each direction of a card has
+// its own ease, which grows with easy answers and shrinks with hard ones and
+// lapses. After a lapse the card starts over at one day.
+type SM2Scheduler struct{}
+
+func (SM2Scheduler) Schedule(test *TestData, grade Grade, today Date) {
+	if test.Ease == 0 {
+		test.Ease = sm2StartEase
+	}
+
+	switch grade {
+	case GradeAgain:
+		test.Repeated = 0
+		test.Lapses++
+		test.Interval = 1
+		test.Ease -= 0.2
+	case GradeHard:
+		test.Repeated++
+		test.Interval = max(1, int(math.Round(float64(test.Interval)*sm2HardFactor)))
+		test.Ease -= 0.15
+	default:
+		test.Repeated++
+		switch test.Repeated {
+		case 1:
+			test.Interval = 1
+		case 2:
+			test.Interval = 6
+		default:
+			test.Interval = int(math.Round(float64(max(test.Interval, 1)) * test.Ease))
+		}
+
+		if grade == GradeEasy {
+			test.Interval = int(math.Round(float64(test.Interval) * sm2EasyBonus))
+			test.Ease += 0.15
+		}
+	}
+
+	test.Ease = max(test.Ease, sm2MinEase)
+	test.ReapeatDate = today.AddDays(test.Interval)
+}
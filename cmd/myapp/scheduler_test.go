@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSM2Schedule(t *testing.T) {
+	var tests = []struct {
+		grades   string
+		repeated int
+		interval int
+		ease     float64
+		lapses   int
+	}{
+		{"good", 1, 1, 2.5, 0},
+		{"good good", 2, 6, 2.5, 0},
+		{"good good good", 3, 15, 2.5, 0},
+		{"easy", 1, 1, 2.65, 0},
+		{"easy easy easy", 3, 29, 2.95, 0},
+		{"hard", 1, 1, 2.35, 0},
+		{"good good hard", 3, 7, 2.35, 0},
+		{"good good again", 0, 1, 2.3, 1},
+		{"good good again good", 1, 1, 2.3, 1},
+		{"again again again again again again again", 0, 1, sm2MinEase, 7},
+	}
+
+	for _, test := range tests {
+		t.Run(test.grades, func(t *testing.T) {
+			var data TestData
+			for _, grade := range strings.Fields(test.grades) {
+				SM2Scheduler{}.Schedule(&data, Grade(grade), testToday)
+			}
+
+			if data.Repeated != test.repeated || data.Interval != test.interval || math.Abs(data.Ease-test.ease) > 1e-9 || data.Lapses != test.lapses {
+				t.Errorf("Got repeated %d, interval %d, ease %v, lapses %d, want %d, %d, %v, %d", data.Repeated, data.Interval, data.Ease, data.Lapses, test.repeated, test.interval, test.ease, test.lapses)
+			}
+			if want := testToday.AddDays(test.interval); data.ReapeatDate != want {
+				t.Errorf("Due %v, want %v", data.ReapeatDate, want)
+			}
+		})
+	}
+}
+
+func TestSchedulersCountLapses(t *testing.T) {
+	for name, build := range schedulers {
+		t.Run(name, func(t *testing.T) {
+			scheduler := build(&User{}, TrackSettings{})
+
+			var data TestData
+			for _, grade := range []Grade{GradeGood, GradeAgain, GradeHard, GradeAgain, GradeEasy} {
+				scheduler.Schedule(&data, grade, testToday)
+				data.LastReview = testToday
+			}
+
+			if data.Lapses != 2 {
+				t.Errorf("Counted %d lapses, want 2", data.Lapses)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// storageMigration upgrades one stored user from Version-1 to Version. Users
+// are migrated as plain JSON objects, so a migration keeps working after the
+// Go types change again.
+type storageMigration struct {
+	Version     int
+	Description string
+	Migrate     func(user map[string]any) error
+}
+
+// storageMigrations must stay in version order. Files written before
+// versioning was added are version 0: a bare array of users.
+var storageMigrations = []storageMigration{
+	{
+		Version:     1,
+		Description: "Fix misspelled sumUntesteddCards and FailedCards keys",
+		Migrate: func(user map[string]any) error {
+			for _, track := range jsonObjects(user["tracks"]) {
+				if settings, ok := track["settings"].(map[string]any); ok {
+					renameKey(settings, "sumUntesteddCards", "sumUntestedCards")
+				}
+
+				for _, name := range testNames {
+					if test, ok := track[name].(map[string]any); ok {
+						renameKey(test, "FailedCards", "failedCards")
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "Drop username tokens, signed session tokens replace them",
+		Migrate: func(user map[string]any) error {
+			delete(user, "token")
+			return nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "Give every user the user role",
+		Migrate: func(user map[string]any) error {
+			if _, ok := user["role"]; !ok {
+				user["role"] = RoleUser
+			}
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "Turn CokiesAccepted into a consent record",
+		Migrate: func(user map[string]any) error {
+			if accepted, _ := user["cokiesAccepted"].(bool); accepted {
+				user["consents"] = []any{legacyConsent()}
+			}
+			delete(user, "cokiesAccepted")
+			return nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "Write dates as YYYY-MM-DD",
+		Migrate: func(user map[string]any) error {
+			for _, track := range jsonObjects(user["tracks"]) {
+				for _, name := range testNames {
+					if test, ok := track[name].(map[string]any); ok {
+						isoDates(test, "lastFailDate", "lastPassedDate")
+						isoCardDates(jsonObjects(test["failedCards"]))
+					}
+				}
+				isoCardDates(jsonObjects(track["storage"]))
+			}
+			return nil
+		},
+	},
+}
+
+func isoCardDates(cards []map[string]any) {
+	for _, card := range cards {
+		isoDates(card, "creationDate")
+		for _, name := range testNames {
+			if data, ok := card[name].(map[string]any); ok {
+				isoDates(data, "repeatDate", "lastReview")
+			}
+		}
+	}
+}
+
+// isoDates rewrites the legacyDateLayout dates under keys in dateLayout.
+func isoDates(object map[string]any, keys ...string) {
+	for _, key := range keys {
+		if value, ok := object[key].(string); ok {
+			if date, err := ParseDate(value); err == nil {
+				object[key] = date.String()
+			}
+		}
+	}
+}
+
+// legacyConsent stands for an accepted cookie banner from before consent
+// records. Its policy version is never current, so the user is asked again.
+func legacyConsent() map[string]any {
+	return map[string]any{
+		"policyVersion": "legacy",
+		"categories":    []any{},
+		"granted":       true,
+		"at":            time.Now().UTC().Format(time.RFC3339),
+		"source":        "migration",
+	}
+}
+
+// storageVersion is the version written by this build.
+var storageVersion = len(storageMigrations)
+
+// storageDocument is the layout of storage.json.
+type storageDocument struct {
+	Version int             `json:"version"`
+	Users   json.RawMessage `json:"users"`
+}
+
+// decodeStorage reads a storage file of any known version and returns its
+// users upgraded to storageVersion, together with the version it was in.
+func decodeStorage(data []byte) ([]User, int, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return []User{}, storageVersion, nil
+	}
+
+	var doc storageDocument
+	if data[0] == '[' {
+		doc.Users = data
+	} else if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, 0, err
+	}
+
+	var raw []json.RawMessage
+	if len(doc.Users) > 0 {
+		if err := json.Unmarshal(doc.Users, &raw); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var users = make([]User, len(raw))
+	for i, data := range raw {
+		if err := decodeUser(data, doc.Version, &users[i]); err != nil {
+			return nil, 0, fmt.Errorf("User %d: %w", i, err)
+		}
+	}
+
+	return users, doc.Version, nil
+}
+
+func encodeStorage(users []User) ([]byte, error) {
+	data, err := json.Marshal(users)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(storageDocument{Version: storageVersion, Users: data})
+}
+
+// decodeUser upgrades a user stored in version to storageVersion.
+func decodeUser(data []byte, version int, user *User) error {
+	if version > storageVersion {
+		return fmt.Errorf("Storage version %d is newer than this build supports (%d)", version, storageVersion)
+	}
+
+	if version == storageVersion {
+		return json.Unmarshal(data, user)
+	}
+
+	var object map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return err
+	}
+
+	for _, migration := range storageMigrations[version:] {
+		if err := migration.Migrate(object); err != nil {
+			return fmt.Errorf("Migration to version %d: %w", migration.Version, err)
+		}
+	}
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, user)
+}
+
+func jsonObjects(v any) []map[string]any {
+	list, _ := v.([]any)
+
+	var objects []map[string]any
+	for _, item := range list {
+		if object, ok := item.(map[string]any); ok {
+			objects = append(objects, object)
+		}
+	}
+	return objects
+}
+
+func renameKey(object map[string]any, from, to string) {
+	if value, ok := object[from]; ok {
+		if _, exists := object[to]; !exists {
+			object[to] = value
+		}
+		delete(object, from)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The fixtures hold the same two users as they were written in every
+// version before storageVersion, storage.v0.json in the layout of the
+// first builds.
+func readFixture(t *testing.T, version int) []byte {
+	data, err := os.ReadFile(fmt.Sprintf("testdata/storage.v%d.json", version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// migrateFixture runs the migrations on the users of a fixture as plain
+// JSON objects, the way decodeUser does.
+func migrateFixture(t *testing.T, version int) []map[string]any {
+	var doc storageDocument
+	data := readFixture(t, version)
+	if version == 0 {
+		doc.Users = data
+	} else if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	var users []map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(doc.Users))
+	decoder.UseNumber()
+	if err := decoder.Decode(&users); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range users {
+		for _, migration := range storageMigrations[version:] {
+			if err := migration.Migrate(user); err != nil {
+				t.Fatalf("Migration to version %d: %v", migration.Version, err)
+			}
+		}
+	}
+	return users
+}
+
+func TestStorageMigrations(t *testing.T) {
+	for version := 0; version < storageVersion; version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			users := migrateFixture(t, version)
+
+			for _, user := range users {
+				for _, key := range []string{"token", "cokiesAccepted"} {
+					if _, ok := user[key]; ok {
+						t.Errorf("User %v still has %v", user["userName"], key)
+					}
+				}
+			}
+
+			track := jsonObjects(users[0]["tracks"])[0]
+			settings := track["settings"].(map[string]any)
+			if _, ok := settings["sumUntesteddCards"]; ok || settings["sumUntestedCards"] != true {
+				t.Errorf("Settings %v, want sumUntestedCards renamed", settings)
+			}
+
+			test := track["fromLanguage"].(map[string]any)
+			if _, ok := test["FailedCards"]; ok || len(jsonObjects(test["failedCards"])) != 1 {
+				t.Errorf("Test %v, want FailedCards renamed", test)
+			}
+
+			var dates = []struct {
+				object map[string]any
+				key    string
+				want   string
+			}{
+				{test, "lastFailDate", "2024-03-10"},
+				{test, "lastPassedDate", "2024-03-09"},
+				{jsonObjects(test["failedCards"])[0], "creationDate", "2024-03-01"},
+				{jsonObjects(track["storage"])[1], "creationDate", "2024-03-02"},
+				{jsonObjects(track["storage"])[1]["writing"].(map[string]any), "repeatDate", "2024-03-12"},
+				{track["listening"].(map[string]any), "lastFailDate", ""},
+			}
+			for _, date := range dates {
+				if got := date.object[date.key]; got != date.want {
+					t.Errorf("%v is %q, want %q", date.key, got, date.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeStorageFixtures(t *testing.T) {
+	for version := 0; version < storageVersion; version++ {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			users, from, err := decodeStorage(readFixture(t, version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from != version {
+				t.Errorf("Read as version %d, want %d", from, version)
+			}
+
+			if len(users) != 2 {
+				t.Fatalf("Got %d users, want 2", len(users))
+			}
+			nazar, olena := users[0], users[1]
+
+			if nazar.Role != RoleUser || olena.Role != RoleUser {
+				t.Errorf("Roles are %q and %q, want %q", nazar.Role, olena.Role, RoleUser)
+			}
+			if len(nazar.Consents) != 1 || nazar.Consents[0].Source != "migration" || nazar.Consents[0].PolicyVersion != "legacy" || !nazar.Consents[0].Granted {
+				t.Errorf("Accepted cookies became %+v, want one legacy consent", nazar.Consents)
+			}
+			if len(olena.Consents) != 0 {
+				t.Errorf("Declined cookies became %+v, want no consent", olena.Consents)
+			}
+			if nazar.Password != "secret" || !nazar.Settings.DarkTheme {
+				t.Errorf("Account fields were lost: %+v", nazar)
+			}
+
+			track := nazar.Tracks[0]
+			if !track.Settings.SumUntestedCards || !track.Settings.FailedTestCardsPriopity {
+				t.Errorf("Settings %+v, want sumUntestedCards and failedTestCardsPriopity", track.Settings)
+			}
+
+			test := track.FromLanguage
+			if test.LastFailDate != (Date{2024, time.March, 10}) || test.LastPassedDate != (Date{2024, time.March, 9}) {
+				t.Errorf("Test dates %v and %v, want 2024-03-10 and 2024-03-09", test.LastFailDate, test.LastPassedDate)
+			}
+			if len(test.FailedCards) != 1 || test.FailedCards[0].ID != 1 || test.FailedCards[0].CreationDate != (Date{2024, time.March, 1}) {
+				t.Errorf("Failed cards %+v, want card 1", test.FailedCards)
+			}
+			if card := track.Storage[1]; card.CreationDate != (Date{2024, time.March, 2}) || card.Writing.ReapeatDate != (Date{2024, time.March, 12}) {
+				t.Errorf("Card dates %v and %v, want 2024-03-02 and 2024-03-12", card.CreationDate, card.Writing.ReapeatDate)
+			}
+
+			// Written back, the users are read in the current version as they are.
+			data, err := encodeStorage(users)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, from, err := decodeStorage(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from != storageVersion || !reflect.DeepEqual(again, users) {
+				t.Errorf("Read back as version %d with %+v, want version %d with the same users", from, again, storageVersion)
+			}
+		})
+	}
+}
+
+func TestDecodeStorageNewerVersion(t *testing.T) {
+	data := fmt.Sprintf(`{"version": %d, "users": [{"id": 1}]}`, storageVersion+1)
+	if _, _, err := decodeStorage([]byte(data)); err == nil {
+		t.Error("Read a newer version, want an error")
+	}
+}
+
+// Authentification used to be tagged jsom, so its fields were sent under
+// their Go names.
+func TestAuthentificationJSON(t *testing.T) {
+	data, err := json.Marshal(Authentification{Id: 1, UserName: "nazar", EMail: "nazar@example.com", Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{"userName": "nazar", "eMail": "nazar@example.com", "token": "token"} {
+		if fields[key] != want {
+			t.Errorf("%v is %v, want %v in %s", key, fields[key], want, data)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const snapshotTimeFormat = "20060102T150405.000Z"
+
+var snapshotName = regexp.MustCompile(`^snapshot-(\d{8}T\d{6}\.\d{3}Z)\.json\.gz$`)
+
+// Snapshotter writes compressed copies of the whole store to a directory and
+// restores them. It works through Store, so it is the same for every backend.
+type Snapshotter struct {
+	store Store
+	dir   string
+
+	// Interval between scheduled snapshots, 0 disables them.
+	Interval time.Duration
+	// KeepLast is how many of the newest snapshots are always kept.
+	KeepLast int
+	// KeepDays keeps the newest snapshot of each of the last KeepDays days.
+	KeepDays int
+}
+
+// Snapshot is what a snapshot file holds: a storage file with the review log
+// of every user next to the users. Reviews is nil in snapshots written
+// before they held the review log.
+type Snapshot struct {
+	Users   []User
+	Reviews map[int][]Review
+}
+
+type snapshotDocument struct {
+	storageDocument
+	Reviews map[int][]Review `json:"reviews"`
+}
+
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	Size      int64     `json:"size"`
+}
+
+// NewSnapshotterFromEnv reads SNAPSHOT_DIR, SNAPSHOT_INTERVAL (e.g. "6h"),
+// SNAPSHOT_KEEP_LAST and SNAPSHOT_KEEP_DAYS.
+func NewSnapshotterFromEnv(store Store) (*Snapshotter, error) {
+	var s = &Snapshotter{store: store, dir: "./snapshots", KeepLast: 10, KeepDays: 14}
+
+	if dir := os.Getenv("SNAPSHOT_DIR"); dir != "" {
+		s.dir = dir
+	}
+
+	if interval := os.Getenv("SNAPSHOT_INTERVAL"); interval != "" {
+		var err error
+		if s.Interval, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("Invalid SNAPSHOT_INTERVAL: %w", err)
+		}
+	}
+
+	for env, value := range map[string]*int{"SNAPSHOT_KEEP_LAST": &s.KeepLast, "SNAPSHOT_KEEP_DAYS": &s.KeepDays} {
+		if str := os.Getenv(env); str != "" {
+			n, err := strconv.Atoi(str)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid %v: %v", env, str)
+			}
+			*value = n
+		}
+	}
+
+	return s, nil
+}
+
+// Run takes a snapshot every Interval until stop is closed.
+func (s *Snapshotter) Run(stop <-chan struct{}) {
+	if s.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if info, err := s.Create(); err != nil {
+				log.Println("Snapshot failed:", err)
+			} else {
+				log.Println("Snapshot written:", info.Name)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Snapshotter) Create() (SnapshotInfo, error) {
+	users, err := s.store.GetUsers()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	var snapshot = Snapshot{Users: users, Reviews: map[int][]Review{}}
+	for _, user := range users {
+		reviews, err := s.store.GetReviews(user.ID, ReviewFilter{})
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+
+		// Reviews written after the users were read may be of cards the
+		// snapshot doesn't hold.
+		reviews = slices.DeleteFunc(reviews, func(review Review) bool {
+			return !hasReviewedCard(&user, review)
+		})
+		if len(reviews) > 0 {
+			snapshot.Reviews[user.ID] = reviews
+		}
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	createdAt := time.Now().UTC()
+	name := "snapshot-" + createdAt.Format(snapshotTimeFormat) + ".json.gz"
+	path := filepath.Join(s.dir, name)
+
+	if err := writeSnapshot(path, snapshot); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if err := s.prune(); err != nil {
+		log.Println("Pruning snapshots failed:", err)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	return SnapshotInfo{Name: name, CreatedAt: createdAt, Size: stat.Size()}, nil
+}
+
+func writeSnapshot(path string, snapshot Snapshot) error {
+	users, err := json.Marshal(snapshot.Users)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snapshotDocument{
+		storageDocument: storageDocument{Version: storageVersion, Users: users},
+		Reviews:         snapshot.Reviews,
+	})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(file)
+	_, err = zw.Write(data)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+	}
+	return err
+}
+
+// List returns the snapshots, newest first.
+func (s *Snapshotter) List() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots = []SnapshotInfo{}
+	for _, entry := range entries {
+		match := snapshotName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		createdAt, err := time.Parse(snapshotTimeFormat, match[1])
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, SnapshotInfo{Name: entry.Name(), CreatedAt: createdAt, Size: info.Size()})
+	}
+
+	slices.SortFunc(snapshots, func(a, b SnapshotInfo) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return snapshots, nil
+}
+
+// prune removes snapshots that neither belong to the KeepLast newest nor are
+// the newest of one of the last KeepDays days.
+func (s *Snapshotter) prune() error {
+	snapshots, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	var keptDays = map[string]bool{}
+	var oldestDay = time.Now().UTC().AddDate(0, 0, -s.KeepDays)
+
+	for i, snapshot := range snapshots {
+		day := snapshot.CreatedAt.Format("2006.01.02")
+
+		keep := i < s.KeepLast
+		if !keptDays[day] && snapshot.CreatedAt.After(oldestDay) {
+			keptDays[day] = true
+			keep = true
+		}
+
+		if !keep {
+			if err := os.Remove(filepath.Join(s.dir, snapshot.Name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Load reads a snapshot, its users are upgraded to the current storage
+// version.
+func (s *Snapshotter) Load(name string) (*Snapshot, error) {
+	if !snapshotName.MatchString(name) {
+		return nil, fmt.Errorf("Invalid snapshot name: %v", name)
+	}
+
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	users, _, err := decodeStorage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc snapshotDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{Users: users, Reviews: doc.Reviews}, nil
+}
+
+// Restore puts the store back to the state of a snapshot. With userID set
+// only that user is restored, otherwise users missing from the snapshot are
+// deleted as well. The snapshot is read in full and the current state is
+// snapshotted before anything changes, the store then swaps the restored
+// users in at once. Users restored from a snapshot without reviews keep
+// their current ones.
+func (s *Snapshotter) Restore(name string, userID *int) error {
+	snapshot, err := s.Load(name)
+	if err != nil {
+		return err
+	}
+
+	users := snapshot.Users
+	if userID != nil {
+		i := slices.IndexFunc(users, func(user User) bool {
+			return user.ID == *userID
+		})
+		if i == -1 {
+			return fmt.Errorf("User %d isn't in snapshot %v", *userID, name)
+		}
+		users = users[i : i+1]
+	}
+
+	if _, err := s.Create(); err != nil {
+		return fmt.Errorf("Snapshot before restore failed: %w", err)
+	}
+
+	var reviews = snapshot.Reviews
+	if reviews == nil {
+		reviews = map[int][]Review{}
+		for _, user := range users {
+			userReviews, err := s.store.GetReviews(user.ID, ReviewFilter{})
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			reviews[user.ID] = slices.DeleteFunc(userReviews, func(review Review) bool {
+				return !hasReviewedCard(&user, review)
+			})
+		}
+	}
+
+	return s.store.RestoreUsers(users, reviews, userID == nil)
+}
+
+// Forget rewrites every snapshot holding the user without it, so an erased
+// account can't come back with a restore.
+func (s *Snapshotter) Forget(userID int) error {
+	snapshots, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		loaded, err := s.Load(snapshot.Name)
+		if err != nil {
+			return err
+		}
+
+		i := slices.IndexFunc(loaded.Users, func(user User) bool {
+			return user.ID == userID
+		})
+		if i == -1 {
+			continue
+		}
+
+		loaded.Users = slices.Delete(loaded.Users, i, i+1)
+		delete(loaded.Reviews, userID)
+		if err := writeSnapshot(filepath.Join(s.dir, snapshot.Name), *loaded); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestSnapshotter(t *testing.T, store Store) *Snapshotter {
+	return &Snapshotter{store: store, dir: t.TempDir(), KeepLast: 10, KeepDays: 14}
+}
+
+func reviewedCards(t *testing.T, store Store, userID int) []int {
+	reviews, err := store.GetReviews(userID, ReviewFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids = []int{}
+	for _, review := range reviews {
+		ids = append(ids, review.CardID)
+	}
+	return ids
+}
+
+func TestSnapshotPrune(t *testing.T) {
+	s := newTestSnapshotter(t, NewMemoryStorage(nil))
+	s.KeepLast, s.KeepDays = 2, 3
+
+	// Noon of yesterday, so the minutes before it are on the same day.
+	now := time.Now().UTC().Truncate(24 * time.Hour).Add(-12 * time.Hour)
+	var names = map[time.Time]bool{
+		now.Add(-time.Minute):                 true, // the KeepLast newest
+		now.Add(-2 * time.Minute):             true,
+		now.Add(-3 * time.Minute):             false, // not the newest of its day
+		now.AddDate(0, 0, -1):                 true,  // the newest of yesterday
+		now.AddDate(0, 0, -1).Add(-time.Hour): false,
+		now.AddDate(0, 0, -10):                false, // older than KeepDays
+	}
+	for createdAt := range names {
+		name := "snapshot-" + createdAt.Format(snapshotTimeFormat) + ".json.gz"
+		if err := os.WriteFile(filepath.Join(s.dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, "notes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.prune(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept = map[time.Time]bool{}
+	for i, snapshot := range snapshots {
+		kept[snapshot.CreatedAt.Truncate(time.Millisecond)] = true
+		if i > 0 && snapshot.CreatedAt.After(snapshots[i-1].CreatedAt) {
+			t.Errorf("List isn't newest first: %v", snapshots)
+		}
+	}
+	for createdAt, keep := range names {
+		if got := kept[createdAt.Truncate(time.Millisecond)]; got != keep {
+			t.Errorf("Snapshot of %v: kept %v, want %v", createdAt, got, keep)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(s.dir, "notes.txt")); err != nil {
+		t.Errorf("Pruning removed a file that isn't a snapshot: %v", err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		s := newTestSnapshotter(t, store)
+
+		bob := newTestUser(t, store, "bob")
+		ann := newTestUser(t, store, "ann")
+		track := newTestTrack(t, store, bob.ID, newTestCard(1, testToday), newTestCard(2, testToday))
+		at := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+		review := func(cardID int) Review {
+			return Review{Track: track.Name, CardID: cardID, Direction: "toLanguage", At: at, Grade: GradeGood}
+		}
+		if err := store.AppendReviews(bob.ID, review(1), review(2)); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := s.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Changes after the snapshot.
+		if err := store.DeleteCard(bob.ID, track.Name, 2); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AppendReviews(bob.ID, review(1)); err != nil {
+			t.Fatal(err)
+		}
+		ann.FirstName = "Changed"
+		if err := store.UpdateUser(*ann); err != nil {
+			t.Fatal(err)
+		}
+		carl := newTestUser(t, store, "carl")
+
+		if err := s.Restore(info.Name, &bob.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetCard(bob.ID, track.Name, 2); err != nil {
+			t.Errorf("The restored user has no card 2: %v", err)
+		}
+		if ids := reviewedCards(t, store, bob.ID); !slices.Equal(ids, []int{1, 2}) {
+			t.Errorf("The restored user has the reviews of cards %v, want 1 and 2", ids)
+		}
+		if got, err := store.GetUserByID(ann.ID); err != nil || got.FirstName != "Changed" {
+			t.Errorf("Restoring bob changed ann: %+v, %v", got, err)
+		}
+
+		if err := s.Restore(info.Name, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := store.GetUserByID(ann.ID); err != nil || got.FirstName != "First" {
+			t.Errorf("Ann wasn't restored: %+v, %v", got, err)
+		}
+		if _, err := store.GetUserByID(carl.ID); err == nil {
+			t.Error("The user created after the snapshot wasn't deleted")
+		}
+
+		snapshots, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshots) < 2 {
+			t.Errorf("Restoring didn't snapshot the current state first: %v", snapshots)
+		}
+
+		if err := s.Restore(info.Name, &carl.ID); err == nil {
+			t.Error("Restored a user missing from the snapshot")
+		}
+	})
+}
+
+// A restore that fails half way, here on the second of two users with the
+// same ID, leaves the store as it was.
+func TestFailedRestoreChangesNothing(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		bob := newTestUser(t, store, "bob")
+		ann := newTestUser(t, store, "ann")
+		track := newTestTrack(t, store, bob.ID, newTestCard(1, testToday))
+		if err := store.AppendReviews(bob.ID, Review{Track: track.Name, CardID: 1, Direction: "toLanguage", At: time.Now(), Grade: GradeGood}); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := *NewUser("Restored", "Last", "restored@example.com", "restored", "password")
+		restored.ID = ann.ID
+		if err := store.RestoreUsers([]User{restored, restored}, nil, true); err == nil {
+			t.Fatal("Restored the same user twice")
+		}
+
+		users, err := store.GetUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 2 || users[0].UserName != "bob" || users[1].UserName != "ann" || len(users[0].Tracks) != 1 {
+			t.Errorf("The failed restore changed the users: %+v", users)
+		}
+		if ids := reviewedCards(t, store, bob.ID); !slices.Equal(ids, []int{1}) {
+			t.Errorf("The failed restore changed the reviews: %v", ids)
+		}
+	})
+}
+
+// Snapshots written before they held the review log leave the reviews of the
+// restored users as they are.
+func TestRestoreSnapshotWithoutReviews(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	s := newTestSnapshotter(t, store)
+
+	bob := newTestUser(t, store, "bob")
+	track := newTestTrack(t, store, bob.ID, newTestCard(1, testToday))
+	if err := store.AppendReviews(bob.ID, Review{Track: track.Name, CardID: 1, Direction: "toLanguage", At: time.Now(), Grade: GradeGood}); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := store.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := encodeStorage(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "snapshot-" + time.Now().UTC().Add(-time.Hour).Format(snapshotTimeFormat) + ".json.gz"
+	file, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(file)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if err := s.Restore(name, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ids := reviewedCards(t, store, bob.ID); !slices.Equal(ids, []int{1}) {
+		t.Errorf("Got the reviews of cards %v after the restore, want 1", ids)
+	}
+}
+
+// The JSON backend writes a restore to its files before it is answered.
+func TestLocalStorageRestoreIsWritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	store := openTestLocalStorage(t, path)
+	s := newTestSnapshotter(t, store)
+
+	bob := newTestUser(t, store, "bob")
+	track := newTestTrack(t, store, bob.ID, newTestCard(1, testToday))
+	if err := store.AppendReviews(bob.ID, Review{Track: track.Name, CardID: 1, Direction: "toLanguage", At: time.Now(), Grade: GradeGood}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteTrack(bob.ID, track.Name); err != nil {
+		t.Fatal(err)
+	}
+	newTestUser(t, store, "ann")
+
+	if err := s.Restore(info.Name, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	users := readJournaledUsers(t, path)
+	if len(users) != 1 || len(users[0].Tracks) != 1 {
+		t.Errorf("The files hold %+v, want bob with his track", users)
+	}
+	_, reviews, err := openReviewFile(path + ".reviews.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reviews[bob.ID]) != 1 {
+		t.Errorf("The review file holds %v, want the review of bob", reviews)
+	}
+}
+
+func TestSnapshotForget(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	s := newTestSnapshotter(t, store)
+
+	bob := newTestUser(t, store, "bob")
+	ann := newTestUser(t, store, "ann")
+	track := newTestTrack(t, store, bob.ID, newTestCard(1, testToday))
+	if err := store.AppendReviews(bob.ID, Review{Track: track.Name, CardID: 1, Direction: "toLanguage", At: time.Now(), Grade: GradeGood}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Forget(bob.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := s.Load(info.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Users) != 1 || snapshot.Users[0].ID != ann.ID {
+		t.Errorf("The snapshot holds %+v, want only ann", snapshot.Users)
+	}
+	if _, ok := snapshot.Reviews[bob.ID]; ok {
+		t.Error("The snapshot still holds the reviews of the forgotten user")
+	}
+}
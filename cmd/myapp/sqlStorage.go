@@ -0,0 +1,1089 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// SQLStorage is the relational implementation of Store. Users, tracks,
+// cards, the per-direction TestData of cards and the per-track Test state
+// are kept in their own tables so every change only touches its own rows.
+type SQLStorage struct {
+	db     *sql.DB
+	driver string
+}
+
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// jsonColumn stores nested values (settings, string lists) as JSON text.
+type jsonColumn struct {
+	v any
+}
+
+func asJSON(v any) jsonColumn {
+	return jsonColumn{v}
+}
+
+func (c jsonColumn) Value() (driver.Value, error) {
+	data, err := json.Marshal(c.v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (c jsonColumn) Scan(src any) error {
+	switch data := src.(type) {
+	case []byte:
+		return json.Unmarshal(data, c.v)
+	case string:
+		return json.Unmarshal([]byte(data), c.v)
+	case nil:
+		return nil
+	}
+	return fmt.Errorf("Unsupported json column type %T", src)
+}
+
+func (s *SQLStorage) Close() error {
+	return s.db.Close()
+}
+
+// migrateSQL applies every migration newer than the version recorded in
+// schema_migrations, each one in its own transaction.
+func migrateSQL(db *sql.DB, migrations []string) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)"); err != nil {
+		return err
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("version %d: %w", i+1, err)
+		}
+
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES ($1)", i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLStorage) inTx(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// userFieldColumns are the users columns holding the account fields
+// returned by userFields, in the same order.
+const userFieldColumns = "user_name, e_mail, first_name, last_name, password, settings, sessions, role, suspended, e_mail_verified, action_tokens, api_keys, consents, erasure, fsrs_weights"
+
+const userColumns = "id, " + userFieldColumns + ", tracks_keys, last_rollover"
+
+func userFields(user *User) []any {
+	return []any{&user.UserName, &user.EMail, &user.FirstName, &user.LastName, &user.Password, asJSON(&user.Settings), asJSON(&user.Sessions), &user.Role, &user.Suspended, &user.EMailVerified, asJSON(&user.ActionTokens), asJSON(&user.APIKeys), asJSON(&user.Consents), asJSON(&user.Erasure), asJSON(&user.FSRSWeights)}
+}
+
+// placeholders returns "$from, ..., $(from+n-1)".
+func placeholders(from, n int) string {
+	var list = make([]string, n)
+	for i := range list {
+		list[i] = fmt.Sprintf("$%d", from+i)
+	}
+	return strings.Join(list, ", ")
+}
+
+// assignments turns "a, b" into "a = $1, b = $2".
+func assignments(columns string) string {
+	var list = strings.Split(columns, ", ")
+	for i, column := range list {
+		list[i] = fmt.Sprintf("%s = $%d", column, i+1)
+	}
+	return strings.Join(list, ", ")
+}
+
+func scanUser(row scanner) (*User, error) {
+	var user = User{Tracks: []Track{}}
+
+	err := row.Scan(append(append([]any{&user.ID}, userFields(&user)...), asJSON(&user.TracksKeys), &user.LastRollover)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, notFound("User doesn't exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s *SQLStorage) queryUser(where string, args ...any) (*User, error) {
+	user, err := scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE "+where, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	user.Tracks, err = loadTracks(s.db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *SQLStorage) GetUsers() ([]User, error) {
+	rows, err := s.db.Query("SELECT " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	var users = []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range users {
+		if users[i].Tracks, err = loadTracks(s.db, users[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+func (s *SQLStorage) GetUserByID(id int) (*User, error) {
+	return s.queryUser("id = $1", id)
+}
+
+func (s *SQLStorage) GetAccount(id int) (*User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+}
+
+// GetUserByLogin fails with the message logins got from the JSON store.
+func (s *SQLStorage) GetUserByLogin(userNameEMail string) (*User, error) {
+	user, err := s.queryUser("e_mail = $1 OR user_name = $1 ORDER BY id LIMIT 1", userNameEMail)
+	if errors.Is(err, ErrNotFound) {
+		return nil, notFound("User does't exist")
+	}
+	return user, err
+}
+
+func (s *SQLStorage) CreateAccount(newUser User) (*User, error) {
+	err := s.inTx(func(tx *sql.Tx) error {
+		var taken bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE user_name = $1)", newUser.UserName).Scan(&taken); err != nil {
+			return err
+		}
+		if taken {
+			return fmt.Errorf("Username taken")
+		}
+
+		if newUser.TracksKeys == nil {
+			newUser.TracksKeys = []string{}
+		}
+
+		var fields = append(userFields(&newUser), asJSON(newUser.TracksKeys))
+		err := tx.QueryRow("INSERT INTO users ("+userFieldColumns+", tracks_keys) VALUES ("+placeholders(1, len(fields))+") RETURNING id", fields...).Scan(&newUser.ID)
+		if err != nil {
+			return err
+		}
+
+		return insertTracks(tx, newUser.ID, newUser.Tracks)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &newUser, nil
+}
+
+// ImportUsers copies users read from a storage.json file into an empty
+// database, keeping their IDs so existing clients stay valid.
+func (s *SQLStorage) ImportUsers(users []User) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("Database already contains %d users", count)
+		}
+
+		for _, user := range users {
+			if err := insertUserWithID(tx, user); err != nil {
+				return fmt.Errorf("User %v: %w", user.UserName, err)
+			}
+		}
+
+		return s.syncUserIDs(tx)
+	})
+}
+
+// RestoreUsers deletes the users it replaces, their tracks and reviews go
+// with them, and inserts the restored ones in the same transaction.
+func (s *SQLStorage) RestoreUsers(users []User, reviews map[int][]Review, all bool) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if all {
+			if _, err := tx.Exec("DELETE FROM users"); err != nil {
+				return err
+			}
+		}
+
+		for _, user := range users {
+			if !all {
+				if _, err := tx.Exec("DELETE FROM users WHERE id = $1", user.ID); err != nil {
+					return err
+				}
+			}
+
+			if err := insertUserWithID(tx, user); err != nil {
+				return fmt.Errorf("User %v: %w", user.UserName, err)
+			}
+			if err := insertReviews(tx, user.ID, reviews[user.ID]); err != nil {
+				return err
+			}
+		}
+
+		return s.syncUserIDs(tx)
+	})
+}
+
+func insertUserWithID(q querier, user User) error {
+	if user.TracksKeys == nil {
+		user.TracksKeys = []string{}
+	}
+
+	var fields = append(append([]any{user.ID}, userFields(&user)...), asJSON(user.TracksKeys), user.LastRollover)
+	if _, err := q.Exec("INSERT INTO users ("+userColumns+") VALUES ("+placeholders(1, len(fields))+")", fields...); err != nil {
+		return err
+	}
+
+	return insertTracks(q, user.ID, user.Tracks)
+}
+
+// syncUserIDs moves the postgres id sequence past users inserted with an
+// explicit id. SQLite does that on its own.
+func (s *SQLStorage) syncUserIDs(q querier) error {
+	if s.driver != "postgres" {
+		return nil
+	}
+
+	_, err := q.Exec("SELECT setval(pg_get_serial_sequence('users', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM users")
+	return err
+}
+
+func (s *SQLStorage) UpdateUser(user User) error {
+	return updateUser(s.db, user)
+}
+
+func updateUser(q querier, user User) error {
+	var fields = append(userFields(&user), user.ID)
+	result, err := q.Exec("UPDATE users SET "+assignments(userFieldColumns)+fmt.Sprintf(" WHERE id = $%d", len(fields)), fields...)
+	return expectRow(result, err, "User doesn't exist")
+}
+
+// UpdateUserFunc reads the user in the transaction it writes it back in. On
+// postgres the user row stays locked until then.
+func (s *SQLStorage) UpdateUserFunc(id int, update func(user *User) error) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var query = "SELECT " + userColumns + " FROM users WHERE id = $1"
+		if s.driver == "postgres" {
+			query += " FOR UPDATE"
+		}
+
+		user, err := scanUser(tx.QueryRow(query, id))
+		if err != nil {
+			return err
+		}
+
+		if err := update(user); err != nil {
+			return err
+		}
+
+		user.ID = id
+		return updateUser(tx, *user)
+	})
+}
+
+func (s *SQLStorage) DeleteUser(id int) error {
+	result, err := s.db.Exec("DELETE FROM users WHERE id = $1", id)
+	return expectRow(result, err, "User doesn't exist")
+}
+
+func expectRow(result sql.Result, err error, missing string) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound(missing)
+	}
+	return nil
+}
+
+func (s *SQLStorage) GetTracks(userID int) ([]Track, error) {
+	if err := userExists(s.db, userID); err != nil {
+		return nil, err
+	}
+
+	return loadTracks(s.db, userID)
+}
+
+func (s *SQLStorage) GetTrack(userID int, key string) (*Track, error) {
+	var track *Track
+
+	err := s.inTx(func(tx *sql.Tx) error {
+		var trackID int
+		var err error
+		track, trackID, err = queryTrack(tx, userID, key)
+		if err != nil {
+			return err
+		}
+
+		track.Storage, err = loadCards(tx, "c.track_id = $1", trackID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return track, nil
+}
+
+func (s *SQLStorage) CreateTrack(userID int, track Track) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tracks WHERE user_id = $1 AND name = $2)", userID, track.Name).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("Track already exists")
+		}
+
+		if _, err := insertTrack(tx, userID, track); err != nil {
+			return err
+		}
+
+		return updateTracksKeys(tx, userID, func(keys []string) []string {
+			return append([]string{track.Name}, keys...)
+		})
+	})
+}
+
+func (s *SQLStorage) UpdateTrackSettings(userID int, key string, settings TrackSettings) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE tracks SET settings = $1 WHERE user_id = $2 AND name = $3", asJSON(settings), userID, key)
+		if err := expectRow(result, err, "Track does't exist"); err != nil {
+			return err
+		}
+		return trackChanged(tx, userID, key)
+	})
+}
+
+func (s *SQLStorage) DeleteTrack(userID int, key string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM tracks WHERE user_id = $1 AND name = $2", userID, key)
+		if err := expectRow(result, err, "Track does't exist"); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM reviews WHERE user_id = $1 AND track = $2", userID, key); err != nil {
+			return err
+		}
+
+		return updateTracksKeys(tx, userID, func(keys []string) []string {
+			return slices.DeleteFunc(keys, func(k string) bool {
+				return key == k
+			})
+		})
+	})
+}
+
+func (s *SQLStorage) GetCard(userID int, key string, cardID int) (*Card, error) {
+	trackID, err := trackRowID(s.db, userID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cards, err := loadCards(s.db, "c.track_id = $1 AND c.card_id = $2", trackID, cardID)
+	if err != nil {
+		return nil, err
+	}
+	if len(cards) == 0 {
+		return nil, notFound("Card does't exist")
+	}
+
+	return &cards[0], nil
+}
+
+func (s *SQLStorage) AddCard(userID int, key string, card Card) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		trackID, err := trackRowID(tx, userID, key)
+		if err != nil {
+			return err
+		}
+
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM cards WHERE track_id = $1 AND card_id = $2)", trackID, card.ID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("Card already exists")
+		}
+
+		if err := insertCard(tx, trackID, card); err != nil {
+			return err
+		}
+		return trackChanged(tx, userID, key)
+	})
+}
+
+func (s *SQLStorage) UpdateCards(userID int, key string, cards ...Card) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		trackID, err := trackRowID(tx, userID, key)
+		if err != nil {
+			return err
+		}
+
+		for _, card := range cards {
+			if err := updateCard(tx, trackID, card); err != nil {
+				return err
+			}
+		}
+		return trackChanged(tx, userID, key)
+	})
+}
+
+func (s *SQLStorage) DeleteCard(userID int, key string, cardID int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		trackID, err := trackRowID(tx, userID, key)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec("DELETE FROM cards WHERE track_id = $1 AND card_id = $2", trackID, cardID)
+		if err := expectRow(result, err, "Card does't exist"); err != nil {
+			return err
+		}
+		if err := deleteCardReviews(tx, userID, key, cardID); err != nil {
+			return err
+		}
+		return trackChanged(tx, userID, key)
+	})
+}
+
+func deleteCardReviews(q querier, userID int, key string, cardID int) error {
+	_, err := q.Exec("DELETE FROM reviews WHERE user_id = $1 AND track = $2 AND card_id = $3", userID, key, cardID)
+	return err
+}
+
+func (s *SQLStorage) UpdateTrack(userID int, key string, update func(track *Track) error) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if err := s.writeTrack(tx, userID, key, update); err != nil {
+			return err
+		}
+		return trackChanged(tx, userID, key)
+	})
+}
+
+func (s *SQLStorage) UpdateTrackReviews(userID int, key string, update func(track *Track) ([]Review, error)) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var reviews []Review
+		err := s.writeTrack(tx, userID, key, func(track *Track) error {
+			var err error
+			reviews, err = update(track)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := insertReviews(tx, userID, reviews); err != nil {
+			return err
+		}
+		return trackChanged(tx, userID, key)
+	})
+}
+
+// writeTrack runs update on the track inside the transaction of q and
+// writes back only the settings, tests, cards and card directions it
+// changed. On postgres the track row stays locked until the transaction
+// ends, SQLite runs one transaction at a time anyway.
+func (s *SQLStorage) writeTrack(q querier, userID int, key string, update func(track *Track) error) error {
+	if s.driver == "postgres" {
+		var id int
+		err := q.QueryRow("SELECT id FROM tracks WHERE user_id = $1 AND name = $2 FOR UPDATE", userID, key).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return notFound("Track does't exist")
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	track, trackID, err := queryTrack(q, userID, key)
+	if err != nil {
+		return err
+	}
+	if track.Storage, err = loadCards(q, "c.track_id = $1", trackID); err != nil {
+		return err
+	}
+
+	old := track.Copy()
+	if err := update(track); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(old.Settings, track.Settings) {
+		if _, err := q.Exec("UPDATE tracks SET settings = $1 WHERE id = $2", asJSON(track.Settings), trackID); err != nil {
+			return err
+		}
+	}
+
+	if !reflect.DeepEqual(old.TestsStatuses(), track.TestsStatuses()) {
+		if err := updateTests(q, trackID, *track); err != nil {
+			return err
+		}
+	}
+
+	var removed = map[int]Card{}
+	for _, card := range old.Storage {
+		removed[card.ID] = card
+	}
+	for _, card := range track.Storage {
+		delete(removed, card.ID)
+	}
+	for id := range removed {
+		if _, err := q.Exec("DELETE FROM cards WHERE track_id = $1 AND card_id = $2", trackID, id); err != nil {
+			return err
+		}
+		if err := deleteCardReviews(q, userID, key, id); err != nil {
+			return err
+		}
+	}
+
+	for _, card := range track.Storage {
+		i := slices.IndexFunc(old.Storage, func(c Card) bool { return c.ID == card.ID })
+		if i == -1 {
+			if err := insertCard(q, trackID, card); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := updateChangedCard(q, trackID, old.Storage[i], card); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateChangedCard writes the parts of card that differ from before.
+func updateChangedCard(q querier, trackID int, before, card Card) error {
+	var beforeRow, cardRow = before, card
+	for _, name := range testNames {
+		beforeData, _ := beforeRow.getTest(name)
+		cardData, _ := cardRow.getTest(name)
+		*beforeData, *cardData = TestData{}, TestData{}
+	}
+	if !reflect.DeepEqual(beforeRow, cardRow) {
+		if err := updateCardRow(q, trackID, card); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range testNames {
+		beforeData, _ := before.getTest(name)
+		cardData, _ := card.getTest(name)
+		if *beforeData != *cardData {
+			if err := updateTestData(q, trackID, card.ID, name, *cardData); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SQLStorage) UpdateTests(userID int, key string, tests TestsStatuses) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		trackID, err := trackRowID(tx, userID, key)
+		if err != nil {
+			return err
+		}
+
+		var track Track
+		track.SetTests(tests)
+		if err := updateTests(tx, trackID, track); err != nil {
+			return err
+		}
+		return trackChanged(tx, userID, key)
+	})
+}
+
+func (s *SQLStorage) AppendReviews(userID int, reviews ...Review) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if err := userExists(tx, userID); err != nil {
+			return err
+		}
+
+		return insertReviews(tx, userID, reviews)
+	})
+}
+
+func insertReviews(q querier, userID int, reviews []Review) error {
+	for _, review := range reviews {
+		_, err := q.Exec(`INSERT INTO reviews (user_id, track, card_id, direction, at, grade, response_ms, prev_interval, next_interval)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			userID, review.Track, review.CardID, review.Direction, review.At, review.Grade, review.ResponseMs, review.PrevInterval, review.NextInterval)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStorage) GetReviews(userID int, filter ReviewFilter) ([]Review, error) {
+	var where = "user_id = $1"
+	var args = []any{userID}
+	if filter.Track != "" {
+		args = append(args, filter.Track)
+		where += fmt.Sprintf(" AND track = $%d", len(args))
+	}
+	if filter.CardID != 0 {
+		args = append(args, filter.CardID)
+		where += fmt.Sprintf(" AND card_id = $%d", len(args))
+	}
+	if filter.Direction != "" {
+		args = append(args, filter.Direction)
+		where += fmt.Sprintf(" AND direction = $%d", len(args))
+	}
+
+	rows, err := s.db.Query(`SELECT track, card_id, direction, at, grade, response_ms, prev_interval, next_interval
+		FROM reviews WHERE `+where+" ORDER BY at, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reviews = []Review{}
+	for rows.Next() {
+		var review Review
+		if err := rows.Scan(&review.Track, &review.CardID, &review.Direction, &review.At, &review.Grade, &review.ResponseMs, &review.PrevInterval, &review.NextInterval); err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+
+	return reviews, rows.Err()
+}
+
+func (s *SQLStorage) GetUserDays() ([]UserDay, error) {
+	rows, err := s.db.Query("SELECT id, settings, last_rollover FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days = []UserDay{}
+	for rows.Next() {
+		var day UserDay
+		if err := rows.Scan(&day.ID, asJSON(&day.Settings), &day.LastRollover); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+// RollOver claims the day by moving last_rollover forward first, so of
+// several instances only one rolls the user over. Only the tests and the
+// card directions that actually changed are written back.
+func (s *SQLStorage) RollOver(userID int, today Date) (bool, error) {
+	var rolled bool
+	err := s.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("UPDATE users SET last_rollover = $1 WHERE id = $2 AND last_rollover < $1", today, userID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			if err != nil {
+				return err
+			}
+			return userExists(tx, userID)
+		}
+
+		rows, err := tx.Query("SELECT name FROM tracks WHERE user_id = $1 ORDER BY id", userID)
+		if err != nil {
+			return err
+		}
+
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			err := s.writeTrack(tx, userID, name, func(track *Track) error {
+				track.UpToDate(today)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		rolled = true
+		return nil
+	})
+	return rolled, err
+}
+
+// userExists fails with the error of a missing user unless userID exists.
+func userExists(q querier, userID int) error {
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return notFound("User doesn't exist")
+	}
+	return nil
+}
+
+func trackRowID(q querier, userID int, key string) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM tracks WHERE user_id = $1 AND name = $2", userID, key).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, notFound("Track does't exist")
+	}
+	return id, err
+}
+
+func updateTracksKeys(q querier, userID int, update func(keys []string) []string) error {
+	var keys []string
+	err := q.QueryRow("SELECT tracks_keys FROM users WHERE id = $1", userID).Scan(asJSON(&keys))
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound("User doesn't exist")
+	}
+	if err != nil {
+		return err
+	}
+
+	updated := update(slices.Clone(keys))
+	if slices.Equal(updated, keys) {
+		return nil
+	}
+
+	_, err = q.Exec("UPDATE users SET tracks_keys = $1 WHERE id = $2", asJSON(updated), userID)
+	return err
+}
+
+// trackChanged moves the changed track to the front of tracks_keys.
+func trackChanged(q querier, userID int, key string) error {
+	return updateTracksKeys(q, userID, func(keys []string) []string {
+		return keyFirst(keys, key)
+	})
+}
+
+// queryTrack loads a track with its tests but without its cards.
+func queryTrack(q querier, userID int, key string) (*Track, int, error) {
+	var trackID int
+	var track = Track{Name: key}
+
+	err := q.QueryRow("SELECT id, settings FROM tracks WHERE user_id = $1 AND name = $2", userID, key).Scan(&trackID, asJSON(&track.Settings))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, notFound("Track does't exist")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := loadTests(q, trackID, &track); err != nil {
+		return nil, 0, err
+	}
+
+	return &track, trackID, nil
+}
+
+func loadTracks(q querier, userID int) ([]Track, error) {
+	rows, err := q.Query("SELECT id, name, settings FROM tracks WHERE user_id = $1 ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var tracks = []Track{}
+	var trackIDs []int
+	for rows.Next() {
+		var trackID int
+		var track Track
+		if err := rows.Scan(&trackID, &track.Name, asJSON(&track.Settings)); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tracks = append(tracks, track)
+		trackIDs = append(trackIDs, trackID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, trackID := range trackIDs {
+		if err := loadTests(q, trackID, &tracks[i]); err != nil {
+			return nil, err
+		}
+		if tracks[i].Storage, err = loadCards(q, "c.track_id = $1", trackID); err != nil {
+			return nil, err
+		}
+	}
+
+	return tracks, nil
+}
+
+func loadTests(q querier, trackID int, track *Track) error {
+	rows, err := q.Query("SELECT kind, name, dayly_test_tries, last_fail_date, last_passed_date, status, failed_cards FROM tests WHERE track_id = $1", trackID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind string
+		var test Test
+		if err := rows.Scan(&kind, &test.Name, &test.DaylyTestTries, &test.LastFailDate, &test.LastPassedDate, &test.Status, asJSON(&test.FailedCards)); err != nil {
+			return err
+		}
+
+		trackTest, err := track.getTest(kind)
+		if err != nil {
+			return err
+		}
+		*trackTest = test
+	}
+
+	return rows.Err()
+}
+
+func loadCards(q querier, where string, args ...any) ([]Card, error) {
+	rows, err := q.Query(`SELECT c.id, c.card_id, c.name, c.translations, c.examples, c.notes, c.creation_date, c.pronunciation,
+		c.leech, c.suspended, c.tags
+		FROM cards c WHERE `+where+` ORDER BY c.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var cards = []Card{}
+	var index = map[int]int{}
+	for rows.Next() {
+		var rowID int
+		var card Card
+		if err := rows.Scan(&rowID, &card.ID, &card.Data, asJSON(&card.TranslatedData), asJSON(&card.Examples), &card.Notes, &card.CreationDate, &card.PronunciationPath,
+			&card.Leech, &card.Suspended, asJSON(&card.Tags)); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[rowID] = len(cards)
+		cards = append(cards, card)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(cards) == 0 {
+		return cards, nil
+	}
+
+	rows, err = q.Query(`SELECT d.card_id, d.kind, d.test_quize, d.repeat_date, d.repeated, d.ease, d.interval_days, d.lapses, d.stability, d.difficulty, d.last_review
+		FROM test_data d JOIN cards c ON c.id = d.card_id WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rowID int
+		var kind string
+		var data TestData
+		if err := rows.Scan(&rowID, &kind, &data.TestQuize, &data.ReapeatDate, &data.Repeated, &data.Ease, &data.Interval, &data.Lapses, &data.Stability, &data.Difficulty, &data.LastReview); err != nil {
+			return nil, err
+		}
+
+		i, ok := index[rowID]
+		if !ok {
+			continue
+		}
+		test, err := cards[i].getTest(kind)
+		if err != nil {
+			return nil, err
+		}
+		*test = data
+	}
+
+	return cards, rows.Err()
+}
+
+// insertTracks inserts tracks in reverse so the newest track, which comes
+// first in User.Tracks, gets the highest row id.
+func insertTracks(q querier, userID int, tracks []Track) error {
+	for i := len(tracks) - 1; i >= 0; i-- {
+		if _, err := insertTrack(q, userID, tracks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertTrack(q querier, userID int, track Track) (int, error) {
+	var trackID int
+	err := q.QueryRow("INSERT INTO tracks (user_id, name, settings) VALUES ($1, $2, $3) RETURNING id", userID, track.Name, asJSON(track.Settings)).Scan(&trackID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range testNames {
+		test, _ := track.getTest(name)
+		_, err := q.Exec(`INSERT INTO tests (track_id, kind, name, dayly_test_tries, last_fail_date, last_passed_date, status, failed_cards)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			trackID, name, test.Name, test.DaylyTestTries, test.LastFailDate, test.LastPassedDate, test.Status, asJSON(test.FailedCards))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, card := range track.Storage {
+		if err := insertCard(q, trackID, card); err != nil {
+			return 0, err
+		}
+	}
+
+	return trackID, nil
+}
+
+func updateTests(q querier, trackID int, track Track) error {
+	for _, name := range testNames {
+		test, _ := track.getTest(name)
+		_, err := q.Exec(`UPDATE tests SET name = $1, dayly_test_tries = $2, last_fail_date = $3, last_passed_date = $4, status = $5, failed_cards = $6
+			WHERE track_id = $7 AND kind = $8`,
+			test.Name, test.DaylyTestTries, test.LastFailDate, test.LastPassedDate, test.Status, asJSON(test.FailedCards), trackID, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertCard(q querier, trackID int, card Card) error {
+	var rowID int
+	err := q.QueryRow(`INSERT INTO cards (track_id, card_id, name, translations, examples, notes, creation_date, pronunciation, leech, suspended, tags)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		trackID, card.ID, card.Data, asJSON(card.TranslatedData), asJSON(card.Examples), card.Notes, card.CreationDate, card.PronunciationPath,
+		card.Leech, card.Suspended, asJSON(card.Tags),
+	).Scan(&rowID)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range testNames {
+		data, _ := card.getTest(name)
+		_, err := q.Exec(`INSERT INTO test_data (card_id, kind, test_quize, repeat_date, repeated, ease, interval_days, lapses, stability, difficulty, last_review)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+			rowID, name, data.TestQuize, data.ReapeatDate, data.Repeated, data.Ease, data.Interval, data.Lapses, data.Stability, data.Difficulty, data.LastReview)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func updateCard(q querier, trackID int, card Card) error {
+	if err := updateCardRow(q, trackID, card); err != nil {
+		return err
+	}
+
+	for _, name := range testNames {
+		data, _ := card.getTest(name)
+		if err := updateTestData(q, trackID, card.ID, name, *data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateCardRow writes the card without its TestData.
+func updateCardRow(q querier, trackID int, card Card) error {
+	result, err := q.Exec(`UPDATE cards SET name = $1, translations = $2, examples = $3, notes = $4, creation_date = $5, pronunciation = $6,
+		leech = $7, suspended = $8, tags = $9
+		WHERE track_id = $10 AND card_id = $11`,
+		card.Data, asJSON(card.TranslatedData), asJSON(card.Examples), card.Notes, card.CreationDate, card.PronunciationPath,
+		card.Leech, card.Suspended, asJSON(card.Tags), trackID, card.ID)
+	return expectRow(result, err, "Card does't exist")
+}
+
+func updateTestData(q querier, trackID, cardID int, kind string, data TestData) error {
+	_, err := q.Exec(`UPDATE test_data SET test_quize = $1, repeat_date = $2, repeated = $3, ease = $4, interval_days = $5, lapses = $6,
+		stability = $7, difficulty = $8, last_review = $9
+		WHERE kind = $10 AND card_id = (SELECT id FROM cards WHERE track_id = $11 AND card_id = $12)`,
+		data.TestQuize, data.ReapeatDate, data.Repeated, data.Ease, data.Interval, data.Lapses, data.Stability, data.Difficulty, data.LastReview, kind, trackID, cardID)
+	return err
+}
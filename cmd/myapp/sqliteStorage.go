@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations mirror postgresMigrations for the embedded backend.
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_name TEXT NOT NULL UNIQUE,
+		e_mail TEXT NOT NULL DEFAULT '',
+		first_name TEXT NOT NULL DEFAULT '',
+		last_name TEXT NOT NULL DEFAULT '',
+		password TEXT NOT NULL DEFAULT '',
+		token TEXT NOT NULL DEFAULT '',
+		cokies_accepted BOOLEAN NOT NULL DEFAULT FALSE,
+		settings TEXT NOT NULL DEFAULT '{}',
+		tracks_keys TEXT NOT NULL DEFAULT '[]'
+	);
+	CREATE INDEX users_e_mail_idx ON users (e_mail);
+	CREATE INDEX users_token_idx ON users (token);
+
+	CREATE TABLE tracks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		settings TEXT NOT NULL DEFAULT '{}',
+		UNIQUE (user_id, name)
+	);
+
+	CREATE TABLE tests (
+		track_id INTEGER NOT NULL REFERENCES tracks (id) ON DELETE CASCADE,
+		kind TEXT NOT NULL,
+		name TEXT NOT NULL,
+		dayly_test_tries INTEGER NOT NULL DEFAULT 0,
+		last_fail_date TEXT NOT NULL DEFAULT '',
+		last_passed_date TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'missing',
+		failed_cards TEXT NOT NULL DEFAULT 'null',
+		PRIMARY KEY (track_id, kind)
+	);
+
+	CREATE TABLE cards (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		track_id INTEGER NOT NULL REFERENCES tracks (id) ON DELETE CASCADE,
+		card_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		translations TEXT NOT NULL DEFAULT 'null',
+		examples TEXT NOT NULL DEFAULT 'null',
+		notes TEXT NOT NULL DEFAULT '',
+		creation_date TEXT NOT NULL DEFAULT '',
+		pronunciation TEXT NOT NULL DEFAULT '',
+		UNIQUE (track_id, card_id)
+	);
+
+	CREATE TABLE test_data (
+		card_id INTEGER NOT NULL REFERENCES cards (id) ON DELETE CASCADE,
+		kind TEXT NOT NULL,
+		test_quize BOOLEAN NOT NULL DEFAULT FALSE,
+		repeat_date TEXT NOT NULL DEFAULT '',
+		repeated INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (card_id, kind)
+	);`,
+	`UPDATE tracks SET settings = REPLACE(settings, '"sumUntesteddCards"', '"sumUntestedCards"');`,
+	`DROP INDEX users_token_idx;
+	ALTER TABLE users DROP COLUMN token;
+	ALTER TABLE users ADD COLUMN sessions TEXT NOT NULL DEFAULT 'null';`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+	ALTER TABLE users ADD COLUMN suspended BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE users ADD COLUMN e_mail_verified BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE users ADD COLUMN action_tokens TEXT NOT NULL DEFAULT 'null';`,
+	`ALTER TABLE users ADD COLUMN api_keys TEXT NOT NULL DEFAULT 'null';`,
+	`ALTER TABLE users ADD COLUMN consents TEXT NOT NULL DEFAULT 'null';
+	UPDATE users SET consents = '[{"policyVersion":"legacy","categories":[],"granted":true,"at":"' || strftime('%Y-%m-%dT%H:%M:%SZ', 'now') || '","source":"migration"}]'
+		WHERE cokies_accepted;
+	ALTER TABLE users DROP COLUMN cokies_accepted;`,
+	`ALTER TABLE users ADD COLUMN erasure TEXT NOT NULL DEFAULT 'null';`,
+	`ALTER TABLE test_data ADD COLUMN ease REAL NOT NULL DEFAULT 0;
+	ALTER TABLE test_data ADD COLUMN interval_days INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE test_data ADD COLUMN lapses INTEGER NOT NULL DEFAULT 0;`,
+	`CREATE TABLE reviews (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		track TEXT NOT NULL,
+		card_id INTEGER NOT NULL,
+		direction TEXT NOT NULL,
+		at TIMESTAMP NOT NULL,
+		grade TEXT NOT NULL
+	);
+	CREATE INDEX reviews_user_idx ON reviews (user_id, at);
+	ALTER TABLE users ADD COLUMN fsrs_weights TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE test_data ADD COLUMN stability REAL NOT NULL DEFAULT 0;
+	ALTER TABLE test_data ADD COLUMN difficulty REAL NOT NULL DEFAULT 0;
+	ALTER TABLE test_data ADD COLUMN last_review TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE reviews ADD COLUMN response_ms INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE reviews ADD COLUMN prev_interval INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE reviews ADD COLUMN next_interval INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX reviews_card_idx ON reviews (user_id, track, card_id);`,
+	`UPDATE tests SET last_fail_date = REPLACE(last_fail_date, '.', '-'), last_passed_date = REPLACE(last_passed_date, '.', '-');
+	UPDATE cards SET creation_date = REPLACE(creation_date, '.', '-');
+	UPDATE test_data SET repeat_date = REPLACE(repeat_date, '.', '-'), last_review = REPLACE(last_review, '.', '-');`,
+	`ALTER TABLE users ADD COLUMN last_rollover TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE cards ADD COLUMN leech BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE cards ADD COLUMN suspended BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE cards ADD COLUMN tags TEXT NOT NULL DEFAULT 'null';`,
+	`DELETE FROM reviews WHERE NOT EXISTS (
+		SELECT 1 FROM tracks t JOIN cards c ON c.track_id = t.id
+		WHERE t.user_id = reviews.user_id AND t.name = reviews.track AND c.card_id = reviews.card_id
+	);`,
+}
+
+func OpenSQLiteStorage(path string) (*SQLStorage, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL", path))
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, sharing one connection keeps
+	// concurrent requests from failing with "database is locked".
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQL(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Migration failed: %w", err)
+	}
+
+	return &SQLStorage{db: db, driver: "sqlite3"}, nil
+}
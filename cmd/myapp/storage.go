@@ -1,364 +1,515 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
+	"sync"
 
 	"github.com/gorilla/mux"
 )
 
+// LocalStorage is the JSON file implementation of Store. The data lives in
+// memory, every change is appended to a journal next to the storage file
+// before the Store method returns, and the journal is folded into a new
+// snapshot of the file from time to time.
+//
+// Only the writer goroutine rewrites the storage file, so a burst of changes
+// ends up as a single rewrite. The process holds path+".lock" while the
+// store is open, so no other one writes the same files.
 type LocalStorage struct {
-	Config  *os.File
-	Storage []User
+	*MemoryStorage
+	path string
+	lock *os.File
+
+	// journalMu orders the journal entries of concurrent changes and keeps
+	// a rewrite of the storage file from dropping entries appended meanwhile.
+	journalMu sync.Mutex
+	journal   *journal
+
+	// reviewFileMu keeps the review file in step with the reviews in memory.
+	// Every change adding or deleting reviews holds it from the change in
+	// memory until its reviews are in the file.
+	reviewFileMu sync.Mutex
+	reviewFile   *reviewFile
+
+	wake    chan struct{}
+	flushes chan chan error
+	done    chan struct{}
+	stopped chan struct{}
 }
 
-func (s *LocalStorage) CardsUpToDate() {
-
-	for j, _ := range s.Storage {
-
-		user := &s.Storage[j]
-		// todaysDate := time.Now().Format("2006.01.02")
-		for i, _ := range user.Tracks {
-			track := &user.Tracks[i]
-			track.FromLanguage.VerifyTestStatuses(track.Settings.DaylyTestTries)
-			track.ToLanguage.VerifyTestStatuses(track.Settings.DaylyTestTries)
-			track.Writing.VerifyTestStatuses(track.Settings.DaylyTestTries)
-			track.Listening.VerifyTestStatuses(track.Settings.DaylyTestTries)
+// getID returns the ID of the authenticated user. authMiddleware has already
+// checked it against the {id} of the path.
+func getID(r *http.Request) (int, error) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		return 0, fmt.Errorf("Not authenticated")
+	}
+	return user.ID, nil
+}
 
-			for x, _ := range track.Storage {
+func GetKey(r *http.Request) (string, error) {
+	idStr := mux.Vars(r)["key"]
 
-				card := &track.Storage[x]
+	return idStr, nil
 
-				card.ToLanguage.VerifyDates()
-				card.FromLanguage.VerifyDates()
-				card.Writing.VerifyDates()
-				card.Listening.VerifyDates()
+}
 
-			}
+func getTrackPath(r *http.Request) (int, string, error) {
+	id, err := getID(r)
+	if err != nil {
+		return id, "", err
+	}
 
-			track.MissingTests()
+	key, err := GetKey(r)
+	return id, key, err
+}
 
-		}
+func getCardID(r *http.Request) (int, error) {
+	idStr := mux.Vars(r)["cardID"]
+	id, err := strconv.Atoi(idStr)
 
+	if err != nil {
+		return id, fmt.Errorf("Invalid id given %s", idStr)
 	}
+	return id, nil
 
-	s.UpdateData()
 }
 
-func (s *LocalStorage) GetTrack(r *http.Request) (*Track, error) {
-	user, err := s.GetUser(r)
+func OpenStorage(path string) (*LocalStorage, error) {
+	lock, err := lockFile(path + ".lock")
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 
-	key, err := GetKey(r)
+	local, err := openLockedStorage(path)
 	if err != nil {
-		return nil, nil
-	}
-
-	index := slices.IndexFunc(user.Tracks, func(t Track) bool {
-		return t.Name == key
-	})
-
-	if index != -1 {
-
-		user.TracksKeys = append([]string{key}, slices.DeleteFunc(user.TracksKeys, func(keyToCheck string) bool {
-			return keyToCheck == key
-		})...)
-
-		return &user.Tracks[index], nil
+		lock.Close()
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("Track does't exist")
+	local.lock = lock
+	go local.writer()
 
+	return local, nil
 }
 
-func (s *LocalStorage) GetCard(r *http.Request) (*Card, error) {
-	track, err := s.GetTrack(r)
-
-	if err != nil {
-		return nil, err
-	}
+func openLockedStorage(path string) (*LocalStorage, error) {
+	storageData, version, err := readStorageFile(path)
 
-	id, err := getCardID(r)
 	if err != nil {
 		return nil, err
 	}
 
-	i := slices.IndexFunc(track.Storage, func(card Card) bool {
-		return card.ID == id
-	})
-
-	if i == -1 {
-		return nil, fmt.Errorf("Track does't exist")
+	if version < storageVersion {
+		// Keep the file as it was before upgrading it in place.
+		backup := fmt.Sprintf("%s.v%d.bak", path, version)
+		if err := copyFile(path, backup); err != nil {
+			return nil, err
+		}
+		log.Printf("Upgrading storage from version %d to %d, backup in %v", version, storageVersion, backup)
 	}
-	return &track.Storage[i], nil
-}
 
-func (s *LocalStorage) DeleteCard(r *http.Request) (*Card, error) {
+	// A temp file is only left behind by a crash before its rename, the
+	// storage file itself is still complete in that case.
+	os.Remove(path + ".tmp")
 
-	trackKey, err := GetKey(r)
+	journal, err := openJournal(path + ".journal")
 	if err != nil {
-		return nil, fmt.Errorf("Couldn get track key")
+		return nil, err
 	}
 
-	userID, err := getID(r)
+	replayed, journaled, err := journal.Replay(&storageData)
 	if err != nil {
-		return nil, fmt.Errorf("Couldn get user ID")
+		journal.Close()
+		return nil, err
 	}
 
-	cardID, err := getCardID(r)
+	reviewFile, reviews, err := openReviewFile(path + ".reviews.jsonl")
 	if err != nil {
-		return nil, fmt.Errorf("Card wasn't found")
+		journal.Close()
+		return nil, err
 	}
 
-	user := &s.Storage[slices.IndexFunc(s.Storage, func(user User) bool {
-		return user.ID == userID
-	})]
+	if err := reconcileReviews(reviewFile, storageData, reviews, journaled); err != nil {
+		journal.Close()
+		reviewFile.Close()
+		return nil, err
+	}
 
-	track := &user.Tracks[slices.IndexFunc(user.Tracks, func(track Track) bool {
-		return track.Name == trackKey
-	})]
+	local := &LocalStorage{
+		MemoryStorage: NewMemoryStorage(storageData),
+		path:          path,
+		journal:       journal,
+		reviewFile:    reviewFile,
+		wake:          make(chan struct{}, 1),
+		flushes:       make(chan chan error),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	local.OnChange = local.journalUser
+	local.reviews = reviews
 
-	track.Storage = slices.DeleteFunc(track.Storage, func(card Card) bool {
-		return card.ID == cardID
-	})
+	if replayed > 0 {
+		log.Printf("Replayed %d journal entries", replayed)
+	}
 
-	track.MissingTests()
+	if err := local.WriteToStorage(); err != nil {
+		journal.Close()
+		reviewFile.Close()
+		return nil, err
+	}
 
-	s.UpdateData()
-	return nil, nil
+	return local, nil
 }
 
-func (s *LocalStorage) GetUser(r *http.Request) (*User, error) {
-	id, err := getID(r)
+// reconcileReviews brings the review file in line with the users after a
+// crash: it adds the reviews of journal entries that didn't reach the file
+// and drops the reviews of cards deleted before their reviews were.
+func reconcileReviews(file *reviewFile, users []User, reviews, journaled map[int][]Review) error {
+	var changed bool
+	for userID, added := range journaled {
+		var stored = map[Review]bool{}
+		for _, review := range reviews[userID] {
+			stored[reviewKey(review)] = true
+		}
 
-	if err != nil {
-		return nil, err
+		for _, review := range added {
+			if !stored[reviewKey(review)] {
+				reviews[userID] = append(reviews[userID], review)
+				changed = true
+			}
+		}
 	}
 
-	i := slices.IndexFunc(s.Storage, func(user User) bool {
-		return user.ID == id
-	})
-	if i == -1 {
-		return nil, fmt.Errorf("User doesn't exist")
+	for userID, userReviews := range reviews {
+		i := slices.IndexFunc(users, func(user User) bool { return user.ID == userID })
+		kept := slices.DeleteFunc(userReviews, func(review Review) bool {
+			if i == -1 {
+				return true
+			}
+			return !hasReviewedCard(&users[i], review)
+		})
+
+		if len(kept) != len(userReviews) {
+			changed = true
+		}
+		if len(kept) == 0 {
+			delete(reviews, userID)
+		} else {
+			reviews[userID] = kept
+		}
 	}
 
-	return &s.Storage[i], nil
+	if !changed {
+		return nil
+	}
+	log.Println("Repairing the review file")
+	return file.Rewrite(reviews)
 }
 
-func (s *LocalStorage) GetUserByID(id int) (*User, error) {
+// reviewKey makes reviews read from different files comparable.
+func reviewKey(review Review) Review {
+	review.At = review.At.UTC()
+	return review
+}
 
-	i := slices.IndexFunc(s.Storage, func(user User) bool {
-		return user.ID == id
-	})
-	if i == -1 {
-		return nil, fmt.Errorf("User doesn't exist")
+// journalUser appends the user as it is now to the journal and syncs it,
+// or its removal when it was deleted. The user is read under journalMu, so
+// the last entry of a user is never older than the one before it. The
+// reviews the change added are in the same entry, they are written to the
+// review file after it.
+func (s *LocalStorage) journalUser(userID int, reviews reviewChange) error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+
+	var entry = journalEntry{Op: "delete", ID: userID}
+	if user, err := s.GetUserByID(userID); err == nil {
+		entry = journalEntry{Op: "put", ID: userID, User: user, Reviews: reviews.added}
 	}
 
-	return &s.Storage[i], nil
-}
-
-func (s *LocalStorage) GetUserByToken(token string) (*User, error) {
+	if err := s.journal.Append(entry); err != nil {
+		return err
+	}
 
-	i := slices.IndexFunc(s.Storage, func(user User) bool {
-		return user.UserName == token
-	})
-	if i == -1 {
-		return nil, fmt.Errorf("User doesn't exist")
+	// The caller holds reviewFileMu, see the methods below.
+	switch {
+	case reviews.deleted:
+		s.MemoryStorage.reviewsMu.RLock()
+		err := s.reviewFile.Rewrite(s.MemoryStorage.reviews)
+		s.MemoryStorage.reviewsMu.RUnlock()
+		if err != nil {
+			return err
+		}
+	case len(reviews.added) > 0:
+		if err := s.reviewFile.Append(userID, reviews.added...); err != nil {
+			return err
+		}
 	}
 
-	return &s.Storage[i], nil
+	if s.journal.Entries() >= journalCompactEntries {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
 }
 
-func getID(r *http.Request) (int, error) {
-
-	idStr := mux.Vars(r)["id"]
-	id, err := strconv.Atoi(idStr)
+func (s *LocalStorage) writer() {
+	defer close(s.stopped)
 
-	if err != nil {
-		return id, fmt.Errorf("Invalid id given %s", idStr)
+	for {
+		select {
+		case <-s.wake:
+			if err := s.compact(); err != nil {
+				log.Println("Storage write failed:", err)
+			}
+		case reply := <-s.flushes:
+			reply <- s.compact()
+		case <-s.done:
+			if err := s.compact(); err != nil {
+				log.Println("Storage write failed:", err)
+			}
+			return
+		}
 	}
-	return id, nil
-
 }
 
-func testname(r *http.Request) (string, error) {
-
-	name := mux.Vars(r)["testName"]
+// compact folds the journal into a new snapshot of the storage file.
+func (s *LocalStorage) compact() error {
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
 
-	return name, nil
+	if s.journal.Entries() == 0 {
+		return nil
+	}
+	return s.WriteToStorage()
+}
 
+// Flush waits until every change made so far is written to the storage file.
+func (s *LocalStorage) Flush() error {
+	var reply = make(chan error)
+	select {
+	case s.flushes <- reply:
+		return <-reply
+	case <-s.stopped:
+		return fmt.Errorf("Storage is closed")
+	}
 }
 
-func GetKey(r *http.Request) (string, error) {
-	idStr := mux.Vars(r)["key"]
+// Close folds the journal into the storage file, stops the writer and
+// releases the lock.
+func (s *LocalStorage) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	<-s.stopped
 
-	return idStr, nil
+	s.reviewFileMu.Lock()
+	s.reviewFile.Close()
+	s.reviewFileMu.Unlock()
 
+	err := s.journal.Close()
+	s.lock.Close()
+	return err
 }
 
-func getCardID(r *http.Request) (int, error) {
-	idStr := mux.Vars(r)["cardID"]
-	id, err := strconv.Atoi(idStr)
-
-	if err != nil {
-		return id, fmt.Errorf("Invalid id given %s", idStr)
+// AppendReviews writes the reviews to the review file before keeping them.
+func (s *LocalStorage) AppendReviews(userID int, reviews ...Review) error {
+	if _, err := s.entry(userID); err != nil {
+		return err
 	}
-	return id, nil
 
-}
+	s.reviewFileMu.Lock()
+	defer s.reviewFileMu.Unlock()
 
-func (s *LocalStorage) CreateAccount(newUser User) (*User, error) {
-	if len(s.Storage) == 0 {
-		newUser.ID = 0
-	} else {
-
-		newUser.ID = s.Storage[len(s.Storage)-1].ID + 1
+	if err := s.reviewFile.Append(userID, reviews...); err != nil {
+		return err
 	}
+	return s.MemoryStorage.AppendReviews(userID, reviews...)
+}
 
-	index := slices.IndexFunc(s.Storage, func(user User) bool {
+// The changes below add or delete reviews, journalUser writes them to the
+// review file.
 
-		return user.UserName == newUser.UserName
+func (s *LocalStorage) UpdateTrack(userID int, key string, update func(track *Track) error) error {
+	s.reviewFileMu.Lock()
+	defer s.reviewFileMu.Unlock()
+	return s.MemoryStorage.UpdateTrack(userID, key, update)
+}
 
-	})
+func (s *LocalStorage) UpdateTrackReviews(userID int, key string, update func(track *Track) ([]Review, error)) error {
+	s.reviewFileMu.Lock()
+	defer s.reviewFileMu.Unlock()
+	return s.MemoryStorage.UpdateTrackReviews(userID, key, update)
+}
 
-	if index != -1 {
-		return nil, fmt.Errorf("Username taken")
-	}
+func (s *LocalStorage) DeleteCard(userID int, key string, cardID int) error {
+	s.reviewFileMu.Lock()
+	defer s.reviewFileMu.Unlock()
+	return s.MemoryStorage.DeleteCard(userID, key, cardID)
+}
 
-	s.Storage = append(s.Storage, newUser)
-	go s.WriteToStorage()
-	return &s.Storage[slices.IndexFunc(s.Storage, func(user User) bool {
-		return user.ID == newUser.ID
-	})], nil
+func (s *LocalStorage) DeleteTrack(userID int, key string) error {
+	s.reviewFileMu.Lock()
+	defer s.reviewFileMu.Unlock()
+	return s.MemoryStorage.DeleteTrack(userID, key)
+}
 
+func (s *LocalStorage) DeleteUser(id int) error {
+	s.reviewFileMu.Lock()
+	defer s.reviewFileMu.Unlock()
+	return s.MemoryStorage.DeleteUser(id)
 }
 
-func (s *LocalStorage) CreateTrack(track Track, r *http.Request) error {
+// RestoreUsers writes the restored store to the review file and the storage
+// file before swapping it in, the journal is emptied as the storage file
+// holds everything. If the storage file can't be written the review file is
+// put back. A crash between the two leaves the old users with the restored
+// reviews, the next open drops those of cards the users don't have.
+func (s *LocalStorage) RestoreUsers(users []User, reviews map[int][]Review, all bool) error {
+	s.reviewFileMu.Lock()
+	defer s.reviewFileMu.Unlock()
+	s.journalMu.Lock()
+	defer s.journalMu.Unlock()
+
+	_, err := s.restoreUsers(users, reviews, all, func(users []User, reviews map[int][]Review) error {
+		data, err := encodeStorage(users)
+		if err != nil {
+			return err
+		}
 
-	user, err := s.GetUser(r)
+		if err := s.reviewFile.Rewrite(reviews); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.path, data); err != nil {
+			if rollbackErr := s.reviewFile.Rewrite(s.MemoryStorage.reviews); rollbackErr != nil {
+				log.Println("Putting the review file back failed:", rollbackErr)
+			}
+			return err
+		}
+		return s.journal.Truncate()
+	})
+	return err
+}
 
+// DropBackups deletes the backups of older storage versions that hold the
+// user. They are in the format of their version, so they are deleted rather
+// than written again without the user.
+func (s *LocalStorage) DropBackups(userID int) error {
+	backups, err := filepath.Glob(s.path + ".v*.bak")
 	if err != nil {
 		return err
 	}
 
-	user.Tracks = append([]Track{track}, user.Tracks...)
-	user.TracksKeys = append([]string{track.Name}, user.TracksKeys...)
+	for _, backup := range backups {
+		users, _, err := readStorageFile(backup)
+		if err != nil {
+			return err
+		}
 
-	if err := s.WriteToStorage(); err != nil {
-		fmt.Println(err)
+		if slices.ContainsFunc(users, func(user User) bool { return user.ID == userID }) {
+			if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			log.Printf("Deleted %v, it held user %d", backup, userID)
+		}
 	}
 	return nil
 }
 
-func (s *LocalStorage) UpdateData() {
-	s.WriteToStorage()
-	storage, _ := OpenStorage("./storage.json")
-	s = &storage
-
+// ReadStorageFile reads the users of a storage.json file without opening it
+// as a store, e.g. to import them into another backend.
+func ReadStorageFile(path string) ([]User, error) {
+	users, _, err := readStorageFile(path)
+	return users, err
 }
 
-func OpenStorage(path string) (LocalStorage, error) {
-	storage, err := os.OpenFile("./storage.json", os.O_RDWR, 0644)
-
+func readStorageFile(path string) ([]User, int, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return LocalStorage{}, err
+		return nil, 0, err
 	}
 
-	oldStorageData, err := io.ReadAll(storage)
-
-	if err != nil {
-		return LocalStorage{}, err
-	}
-	var storageData []User
-	err = json.Unmarshal(oldStorageData, &storageData)
+	return decodeStorage(data)
+}
 
+func copyFile(from, to string) error {
+	data, err := os.ReadFile(from)
 	if err != nil {
-		return LocalStorage{}, err
+		return err
 	}
 
-	return LocalStorage{
-		Storage: storageData,
-		Config:  storage,
-	}, nil
+	return writeFileAtomic(to, data)
 }
 
+// WriteToStorage writes a full snapshot to a temp file and renames it over
+// the storage file, so a crash leaves either the old or the new file but
+// never a partial one. The journal is emptied once the snapshot is in place.
+// Once the store is open only the writer goroutine may call it, holding
+// journalMu.
 func (s *LocalStorage) WriteToStorage() error {
 
-	users, err := json.Marshal(s.Storage)
-
+	storage, err := s.GetUsers()
 	if err != nil {
 		return err
 	}
-	err = s.Config.Truncate(0)
+
+	users, err := encodeStorage(storage)
 
 	if err != nil {
 		return err
 	}
-	_, err = s.Config.WriteAt(users, 0)
-	if err != nil {
-		return err
-	}
-	err = s.Config.Sync()
 
-	if err != nil {
+	if err := writeFileAtomic(s.path, users); err != nil {
 		return err
 	}
-	return nil
-}
 
-type Authentification struct {
-	Id       int    `json:"id"`
-	UserName string `jsom:"userName"`
-	EMail    string `jsom:"eMail"`
-	Password string `jsom:"password"`
-	Token    string `jsom:"token"`
+	return s.journal.Truncate()
 }
 
-var testUserNames = []string{"userTest", "studyTest", "quizeTest", "routerTest"}
-
-func (s *LocalStorage) SingUp(req SingUp) (Authentification, error) {
-
-	if id := (slices.IndexFunc(s.Storage, func(user User) bool {
-		return user.UserName == req.Username
-	})); id > -1 {
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
 
-		if slices.Contains(testUserNames, req.Username) {
-
-			s.Storage = slices.DeleteFunc(s.Storage, func(user User) bool {
-				return user.UserName == req.Username
-			})
-			s.UpdateData()
-
-		}
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
 	}
 
-	user, err := s.CreateAccount(*NewUser(req.FirstName, req.LastName, req.EMail, req.Username, req.Password))
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
 
-	if err != nil {
-		return Authentification{}, err
+	if err := os.Rename(tmp, path); err != nil {
+		return err
 	}
-	return Authentification{user.ID, req.Username, req.EMail, req.Password, strconv.Itoa(user.ID)}, nil
-}
 
-func (s *LocalStorage) LogIn(req LogInReq) (Authentification, error) {
-	index := slices.IndexFunc(s.Storage, func(user User) bool {
-		return user.EMail == req.UsernameEMail || user.UserName == req.UsernameEMail
-	})
+	return syncDir(filepath.Dir(path))
+}
 
-	if index == -1 {
-		return Authentification{}, fmt.Errorf("User does't exist")
+// syncDir makes a rename inside dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
+	defer d.Close()
 
-	if s.Storage[index].Password == req.Password {
-		user := s.Storage[index]
-		return Authentification{user.ID, user.UserName, user.EMail, user.Password, user.Token}, nil
-	}
-	return Authentification{}, fmt.Errorf("Incorect password")
+	return d.Sync()
 }
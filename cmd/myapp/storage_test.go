@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// readJournaledUsers reads the users as OpenStorage would find them after a
+// crash: the storage file with the journal replayed on top.
+func readJournaledUsers(t *testing.T, path string) []User {
+	users, _, err := readStorageFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := openJournal(path + ".journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	if _, _, err := journal.Replay(&users); err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+func TestLocalStorageJournalsBeforeReturning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	store := openTestLocalStorage(t, path)
+
+	user := newTestUser(t, store, "bob")
+	track := newTestTrack(t, store, user.ID)
+	if err := store.AddCard(user.ID, track.Name, newTestCard(1, testToday)); err != nil {
+		t.Fatal(err)
+	}
+
+	users := readJournaledUsers(t, path)
+	if len(users) != 1 || len(users[0].Tracks) != 1 || len(users[0].Tracks[0].Storage) != 1 {
+		t.Fatalf("The files hold %+v, want bob with one track and card", users)
+	}
+
+	if err := store.DeleteUser(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if users := readJournaledUsers(t, path); len(users) != 0 {
+		t.Errorf("The files still hold %d users after deleting the only one", len(users))
+	}
+}
+
+func TestOpenStorageLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	store := openTestLocalStorage(t, path)
+
+	if second, err := OpenStorage(path); err == nil {
+		second.Close()
+		t.Fatal("Opened the storage twice")
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := OpenStorage(path)
+	if err != nil {
+		t.Fatalf("Reopening after Close failed: %v", err)
+	}
+	second.Close()
+}
+
+// A crash after a change was journaled but before its reviews reached the
+// review file, or before the reviews of a deleted card were dropped from it,
+// is repaired on the next open.
+func TestLocalStorageReviewsAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	store := openTestLocalStorage(t, path)
+
+	user := newTestUser(t, store, "bob")
+	track := newTestTrack(t, store, user.ID, newTestCard(1, testToday), newTestCard(2, testToday))
+	at := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.FixedZone("EET", 2*60*60))
+
+	if err := store.AppendReviews(user.ID, Review{Track: track.Name, CardID: 1, Direction: "toLanguage", At: at, Grade: GradeGood}); err != nil {
+		t.Fatal(err)
+	}
+	reviewFile, err := os.ReadFile(path + ".reviews.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.UpdateTrackReviews(user.ID, track.Name, func(track *Track) ([]Review, error) {
+		return []Review{{Track: track.Name, CardID: 2, Direction: "toLanguage", At: at.Add(time.Minute), Grade: GradeAgain}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files as a crash right after journaling would leave them, with a
+	// review of a card that is gone on top.
+	crashed := filepath.Join(t.TempDir(), "storage.json")
+	for _, suffix := range []string{"", ".journal"} {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(crashed+suffix, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(crashed+".reviews.jsonl", reviewFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	orphans, _, err := openReviewFile(crashed + ".reviews.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := orphans.Append(user.ID, Review{Track: track.Name, CardID: 9, Direction: "toLanguage", At: at, Grade: GradeGood}); err != nil {
+		t.Fatal(err)
+	}
+	orphans.Close()
+
+	for i := 0; i < 2; i++ {
+		store, err := OpenStorage(crashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reviews, err := store.GetReviews(user.ID, ReviewFilter{})
+		store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []int
+		for _, review := range reviews {
+			ids = append(ids, review.CardID)
+		}
+		if !slices.Equal(ids, []int{1, 2}) {
+			t.Errorf("Open #%d: got the reviews of cards %v, want 1 and 2", i+1, ids)
+		}
+	}
+}
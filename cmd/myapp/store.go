@@ -0,0 +1,87 @@
+package main
+
+import "errors"
+
+// ErrNotFound is wrapped by the errors of a Store for users, tracks and cards
+// that don't exist, the message of the error names what is missing.
+var ErrNotFound = errors.New("Not found")
+
+type notFoundError struct {
+	message string
+}
+
+func (e notFoundError) Error() string { return e.message }
+
+func (e notFoundError) Unwrap() error { return ErrNotFound }
+
+func notFound(message string) error {
+	return notFoundError{message}
+}
+
+// Store is the persistence layer used by the API server. Every method works
+// on copies: values returned by a Store can be modified freely and are only
+// written back through the Update/Add/Delete methods. UpdateUser only writes
+// the account fields of a user, tracks are changed through the track methods.
+type Store interface {
+	GetUsers() ([]User, error)
+	GetUserByID(id int) (*User, error)
+	// GetAccount is GetUserByID without the tracks, for the requests that
+	// only need the account.
+	GetAccount(id int) (*User, error)
+	GetUserByLogin(userNameEMail string) (*User, error)
+	CreateAccount(user User) (*User, error)
+	UpdateUser(user User) error
+	// UpdateUserFunc runs update on the account fields of the user while no
+	// other change of the user can happen and writes them back. The user is
+	// passed without its tracks. Every change that depends on the current
+	// account goes through it. update must not call the Store.
+	UpdateUserFunc(id int, update func(user *User) error) error
+	// RestoreUsers puts users back as given, tracks included, in place of
+	// the users with the same IDs, and gives them reviews as their review
+	// log. With all set every other user is deleted. It happens in one
+	// step, a failing restore leaves the store as it was.
+	RestoreUsers(users []User, reviews map[int][]Review, all bool) error
+	DeleteUser(id int) error
+
+	// TracksKeys of a user lists its tracks, the last changed one first.
+	// Reading a track leaves the order as it is.
+	GetTracks(userID int) ([]Track, error)
+	GetTrack(userID int, key string) (*Track, error)
+	CreateTrack(userID int, track Track) error
+	UpdateTrackSettings(userID int, key string, settings TrackSettings) error
+	DeleteTrack(userID int, key string) error
+
+	GetCard(userID int, key string, cardID int) (*Card, error)
+	AddCard(userID int, key string, card Card) error
+	UpdateCards(userID int, key string, cards ...Card) error
+	DeleteCard(userID int, key string, cardID int) error
+
+	UpdateTests(userID int, key string, tests TestsStatuses) error
+
+	// UpdateTrack runs update on the track, cards included, while no other
+	// change of the user can happen, and writes back what it changed. Every
+	// change that depends on the current state of a track goes through it.
+	// update must not call the Store.
+	UpdateTrack(userID int, key string, update func(track *Track) error) error
+	// UpdateTrackReviews is UpdateTrack for answers: the reviews update
+	// returns are added to the review log in the same step as the change of
+	// the track, so neither is kept without the other.
+	UpdateTrackReviews(userID int, key string, update func(track *Track) ([]Review, error)) error
+
+	// AppendReviews adds to the review log of a user, GetReviews returns the
+	// reviews matching filter oldest first. The reviews of a card are
+	// deleted with the card or its track, so a new card taking its ID
+	// starts without them.
+	AppendReviews(userID int, reviews ...Review) error
+	GetReviews(userID int, filter ReviewFilter) ([]Review, error)
+
+	// GetUserDays returns the time settings and last rollover of every
+	// user, so the users whose day began can be found without reading all
+	// of them. RollOver rolls the tracks of the user forward to today unless
+	// it was done already, and reports whether it did. User.LastRollover
+	// records the last day it ran.
+	GetUserDays() ([]UserDay, error)
+	RollOver(userID int, today Date) (bool, error)
+
+	Close() error
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testToday = Date{2024, time.March, 10}
+
+// storeBackends open an empty store of every backend. Postgres only runs
+// when TEST_POSTGRES_URL points at a database the tests may empty.
+var storeBackends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store {
+		return NewMemoryStorage(nil)
+	}},
+	{"json", func(t *testing.T) Store {
+		return openTestLocalStorage(t, filepath.Join(t.TempDir(), "storage.json"))
+	}},
+	{"sqlite", func(t *testing.T) Store {
+		store, err := OpenSQLiteStorage(filepath.Join(t.TempDir(), "storage.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}},
+	{"postgres", func(t *testing.T) Store {
+		dsn := os.Getenv("TEST_POSTGRES_URL")
+		if dsn == "" {
+			t.Skip("TEST_POSTGRES_URL isn't set")
+		}
+
+		store, err := OpenPostgresStorage(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+
+		if _, err := store.db.Exec("TRUNCATE users RESTART IDENTITY CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+}
+
+func openTestLocalStorage(t *testing.T, path string) *LocalStorage {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		data, err := encodeStorage([]User{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := OpenStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// forEachStore runs test against an empty store of every backend.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	for _, backend := range storeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			test(t, backend.open(t))
+		})
+	}
+}
+
+func newTestUser(t *testing.T, store Store, name string) *User {
+	user, err := store.CreateAccount(*NewUser("First", "Last", name+"@example.com", name, "password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func newTestTrack(t *testing.T, store Store, userID int, cards ...Card) Track {
+	track := NewTrack(&CreateTrackRequest{FromLanguage: "Ukrainian", ToLanguage: "English", DaylyTestTries: 3, DaylyTestCards: 1, DaylyStudyCards: 5})
+	track.Storage = cards
+	if err := store.CreateTrack(userID, track); err != nil {
+		t.Fatal(err)
+	}
+	return track
+}
+
+func newTestCard(id int, today Date) Card {
+	return NewCard(id, "word", "", []string{"translation"}, []string{}, "", today)
+}
+
+func TestStoreAccounts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		bob := newTestUser(t, store, "bob")
+		ann := newTestUser(t, store, "ann")
+		if bob.ID == ann.ID {
+			t.Fatalf("Both users got ID %d", bob.ID)
+		}
+
+		for _, login := range []string{"bob", "bob@example.com"} {
+			user, err := store.GetUserByLogin(login)
+			if err != nil || user.ID != bob.ID {
+				t.Errorf("GetUserByLogin(%q) = %v, %v, want user %d", login, user, err, bob.ID)
+			}
+		}
+
+		newTestTrack(t, store, bob.ID)
+
+		// UpdateUser leaves the tracks alone.
+		bob.FirstName = "Robert"
+		bob.Tracks = nil
+		if err := store.UpdateUser(*bob); err != nil {
+			t.Fatal(err)
+		}
+
+		user, err := store.GetUserByID(bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.FirstName != "Robert" || len(user.Tracks) != 1 {
+			t.Errorf("Got %v with %d tracks, want Robert with 1", user.FirstName, len(user.Tracks))
+		}
+
+		// Returned users are copies.
+		user.Tracks[0].Name = "changed"
+		if tracks, _ := store.GetTracks(bob.ID); tracks[0].Name == "changed" {
+			t.Error("Changing a returned user changed the store")
+		}
+
+		if err := store.DeleteUser(bob.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetUserByID(bob.ID); err == nil {
+			t.Error("Deleted user is still there")
+		}
+
+		users, err := store.GetUsers()
+		if err != nil || len(users) != 1 || users[0].ID != ann.ID {
+			t.Errorf("GetUsers() = %v, %v, want only ann", users, err)
+		}
+	})
+}
+
+func TestStoreUpdateUserFunc(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		bob := newTestUser(t, store, "bob")
+		newTestTrack(t, store, bob.ID)
+
+		// update sees the account without the tracks, and what it changes
+		// is written while the tracks stay.
+		err := store.UpdateUserFunc(bob.ID, func(user *User) error {
+			if user.ID != bob.ID || user.UserName != "bob" || len(user.Tracks) != 0 {
+				t.Errorf("update got %d %v with %d tracks, want bob without tracks", user.ID, user.UserName, len(user.Tracks))
+			}
+			user.FirstName = "Robert"
+			user.Sessions = append(user.Sessions, Session{ID: "session"})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A failed update writes nothing.
+		err = store.UpdateUserFunc(bob.ID, func(user *User) error {
+			user.FirstName = "Bobby"
+			return fmt.Errorf("Failed")
+		})
+		if err == nil || err.Error() != "Failed" {
+			t.Errorf("UpdateUserFunc() = %v, want the error of update", err)
+		}
+
+		user, err := store.GetUserByID(bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.FirstName != "Robert" || len(user.Sessions) != 1 || len(user.Tracks) != 1 {
+			t.Errorf("Got %v with %d sessions and %d tracks, want Robert with 1 and 1", user.FirstName, len(user.Sessions), len(user.Tracks))
+		}
+	})
+}
+
+// TestConcurrentUserUpdates adds sessions to one user from many goroutines
+// at once, none of them may get lost. Run it with -race.
+func TestConcurrentUserUpdates(t *testing.T) {
+	const updates = 20
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		bob := newTestUser(t, store, "bob")
+
+		var wg sync.WaitGroup
+		for i := 0; i < updates; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := store.UpdateUserFunc(bob.ID, func(user *User) error {
+					user.Sessions = append(user.Sessions, Session{ID: fmt.Sprint(i)})
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		user, err := store.GetUserByID(bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(user.Sessions) != updates {
+			t.Errorf("User has %d sessions, want %d", len(user.Sessions), updates)
+		}
+	})
+}
+
+func TestStoreErrors(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user := newTestUser(t, store, "bob")
+		track := newTestTrack(t, store, user.ID, newTestCard(1, testToday))
+		missing := user.ID + 100
+
+		var cases = []struct {
+			name string
+			want string
+			call func() error
+		}{
+			{"GetUserByID", "User doesn't exist", func() error {
+				_, err := store.GetUserByID(missing)
+				return err
+			}},
+			{"GetUserByLogin", "User does't exist", func() error {
+				_, err := store.GetUserByLogin("nobody")
+				return err
+			}},
+			{"UpdateUser", "User doesn't exist", func() error {
+				return store.UpdateUser(User{ID: missing})
+			}},
+			{"UpdateUserFunc", "User doesn't exist", func() error {
+				return store.UpdateUserFunc(missing, func(*User) error { return nil })
+			}},
+			{"DeleteUser", "User doesn't exist", func() error {
+				return store.DeleteUser(missing)
+			}},
+			{"GetTracks", "User doesn't exist", func() error {
+				_, err := store.GetTracks(missing)
+				return err
+			}},
+			{"RollOver", "User doesn't exist", func() error {
+				_, err := store.RollOver(missing, testToday)
+				return err
+			}},
+			{"AppendReviews", "User doesn't exist", func() error {
+				return store.AppendReviews(missing, Review{Track: track.Name, CardID: 1, Direction: "toLanguage", At: time.Now(), Grade: GradeGood})
+			}},
+			{"GetTrack", "Track does't exist", func() error {
+				_, err := store.GetTrack(user.ID, "missing")
+				return err
+			}},
+			{"UpdateTrackSettings", "Track does't exist", func() error {
+				return store.UpdateTrackSettings(user.ID, "missing", track.Settings)
+			}},
+			{"DeleteTrack", "Track does't exist", func() error {
+				return store.DeleteTrack(user.ID, "missing")
+			}},
+			{"UpdateTests", "Track does't exist", func() error {
+				return store.UpdateTests(user.ID, "missing", track.TestsStatuses())
+			}},
+			{"AddCard", "Track does't exist", func() error {
+				return store.AddCard(user.ID, "missing", newTestCard(2, testToday))
+			}},
+			{"GetCard", "Card does't exist", func() error {
+				_, err := store.GetCard(user.ID, track.Name, 99)
+				return err
+			}},
+			{"UpdateCards", "Card does't exist", func() error {
+				return store.UpdateCards(user.ID, track.Name, newTestCard(99, testToday))
+			}},
+			{"DeleteCard", "Card does't exist", func() error {
+				return store.DeleteCard(user.ID, track.Name, 99)
+			}},
+			{"CreateAccount", "Username taken", func() error {
+				_, err := store.CreateAccount(*NewUser("First", "Last", "other@example.com", "bob", "password"))
+				return err
+			}},
+			{"CreateTrack", "Track already exists", func() error {
+				return store.CreateTrack(user.ID, track)
+			}},
+			{"AddCard twice", "Card already exists", func() error {
+				return store.AddCard(user.ID, track.Name, newTestCard(1, testToday))
+			}},
+		}
+
+		for _, c := range cases {
+			err := c.call()
+			if err == nil || err.Error() != c.want {
+				t.Errorf("%v: got error %v, want %q", c.name, err, c.want)
+			}
+			if missing := strings.HasSuffix(c.want, "exist"); errors.Is(err, ErrNotFound) != missing {
+				t.Errorf("%v: errors.Is(%v, ErrNotFound) = %v, want %v", c.name, err, !missing, missing)
+			}
+		}
+	})
+}
+
+func TestStoreTracksAndCards(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user := newTestUser(t, store, "bob")
+		first := newTestTrack(t, store, user.ID)
+
+		second := NewTrack(&CreateTrackRequest{FromLanguage: "English", ToLanguage: "German", DaylyTestTries: 3})
+		if err := store.CreateTrack(user.ID, second); err != nil {
+			t.Fatal(err)
+		}
+
+		// Reading a track leaves the order, changing it moves its key to
+		// the front.
+		if _, err := store.GetTrack(user.ID, first.Name); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := store.GetAccount(user.ID); !slices.Equal(got.TracksKeys, []string{second.Name, first.Name}) {
+			t.Errorf("TracksKeys = %v after GetTrack, want %v first", got.TracksKeys, second.Name)
+		}
+
+		settings := first.Settings
+		settings.DaylyTestCards = 7
+		if err := store.UpdateTrackSettings(user.ID, first.Name, settings); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := store.GetAccount(user.ID); len(got.Tracks) != 0 || !slices.Equal(got.TracksKeys, []string{first.Name, second.Name}) {
+			t.Errorf("GetAccount() has %d tracks and keys %v, want none and %v first", len(got.Tracks), got.TracksKeys, first.Name)
+		}
+
+		card := newTestCard(1, testToday)
+		card.Tags = []string{"verb"}
+		if err := store.AddCard(user.ID, first.Name, card); err != nil {
+			t.Fatal(err)
+		}
+
+		card.Data = "changed"
+		card.ToLanguage = TestData{ReapeatDate: testToday.AddDays(3), Repeated: 2, Interval: 3, Lapses: 1, LastReview: testToday}
+		card.Suspended = true
+		if err := store.UpdateCards(user.ID, first.Name, card); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.GetCard(user.ID, first.Name, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Data != "changed" || got.ToLanguage != card.ToLanguage || !got.Suspended || !slices.Equal(got.Tags, card.Tags) {
+			t.Errorf("GetCard() = %+v, want %+v", got, card)
+		}
+
+		got.TranslatedData[0] = "changed"
+		if again, _ := store.GetCard(user.ID, first.Name, 1); again.TranslatedData[0] == "changed" {
+			t.Error("Changing a returned card changed the store")
+		}
+
+		track, err := store.GetTrack(user.ID, first.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if track.Settings.DaylyTestCards != 7 || len(track.Storage) != 1 {
+			t.Errorf("Got %d test cards and %d cards, want 7 and 1", track.Settings.DaylyTestCards, len(track.Storage))
+		}
+
+		if err := store.DeleteCard(user.ID, first.Name, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetCard(user.ID, first.Name, 1); err == nil {
+			t.Error("Deleted card is still there")
+		}
+
+		if err := store.DeleteTrack(user.ID, second.Name); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := store.GetUserByID(user.ID); len(got.Tracks) != 1 || !slices.Equal(got.TracksKeys, []string{first.Name}) {
+			t.Errorf("Got %d tracks and keys %v after deleting %v", len(got.Tracks), got.TracksKeys, second.Name)
+		}
+	})
+}
+
+func TestStoreTests(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user := newTestUser(t, store, "bob")
+		card := newTestCard(1, testToday)
+		track := newTestTrack(t, store, user.ID, card)
+
+		track.ToLanguage.Status = "failed"
+		track.ToLanguage.DaylyTestTries = 0
+		track.ToLanguage.LastFailDate = testToday
+		track.ToLanguage.FailedCards = []Card{card}
+		if err := store.UpdateTests(user.ID, track.Name, track.TestsStatuses()); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.GetTrack(user.ID, track.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test := got.ToLanguage
+		if test.Status != "failed" || test.DaylyTestTries != 0 || test.LastFailDate != testToday || len(test.FailedCards) != 1 || test.FailedCards[0].ID != 1 {
+			t.Errorf("Got test %+v, want it failed with card 1", test)
+		}
+		if got.FromLanguage.Status != "missing" {
+			t.Errorf("Other tests changed: %+v", got.FromLanguage)
+		}
+	})
+}
+
+func TestStoreReviews(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user := newTestUser(t, store, "bob")
+		at := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+		var reviews = []Review{
+			{Track: "a", CardID: 1, Direction: "toLanguage", At: at, Grade: GradeGood, PrevInterval: 1, NextInterval: 3},
+			{Track: "a", CardID: 2, Direction: "toLanguage", At: at.Add(time.Minute), Grade: GradeAgain},
+			{Track: "a", CardID: 1, Direction: "writing", At: at.Add(2 * time.Minute), Grade: GradeHard, ResponseMs: 1500},
+		}
+		if err := store.AppendReviews(user.ID, reviews...); err != nil {
+			t.Fatal(err)
+		}
+
+		all, err := store.GetReviews(user.ID, ReviewFilter{Track: "a"})
+		if err != nil || len(all) != 3 {
+			t.Fatalf("GetReviews() = %v, %v, want 3 reviews", all, err)
+		}
+		for i := range all {
+			if !all[i].At.Equal(reviews[i].At) || all[i].CardID != reviews[i].CardID || all[i].Grade != reviews[i].Grade {
+				t.Errorf("Review %d = %+v, want %+v", i, all[i], reviews[i])
+			}
+		}
+
+		card, err := store.GetReviews(user.ID, ReviewFilter{CardID: 1, Direction: "writing"})
+		if err != nil || len(card) != 1 || card[0].ResponseMs != 1500 {
+			t.Errorf("Filtered reviews = %v, %v, want the writing review of card 1", card, err)
+		}
+	})
+}
+
+func TestStoreUpdateTrackReviews(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user := newTestUser(t, store, "bob")
+		track := newTestTrack(t, store, user.ID, newTestCard(1, testToday))
+		review := Review{Track: track.Name, CardID: 1, Direction: "toLanguage", At: time.Now(), Grade: GradeGood, NextInterval: 3}
+
+		err := store.UpdateTrackReviews(user.ID, track.Name, func(track *Track) ([]Review, error) {
+			track.Storage[0].ToLanguage.Interval = 3
+			return []Review{review}, fmt.Errorf("Failed")
+		})
+		if err == nil {
+			t.Fatal("The failing update returned no error")
+		}
+		if reviews, err := store.GetReviews(user.ID, ReviewFilter{}); err != nil || len(reviews) != 0 {
+			t.Errorf("The failed update kept %v, %v", reviews, err)
+		}
+
+		err = store.UpdateTrackReviews(user.ID, track.Name, func(track *Track) ([]Review, error) {
+			track.Storage[0].ToLanguage.Interval = 3
+			return []Review{review}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		card, err := store.GetCard(user.ID, track.Name, 1)
+		if err != nil || card.ToLanguage.Interval != 3 {
+			t.Errorf("GetCard() = %+v, %v, want the interval written", card, err)
+		}
+		if reviews, err := store.GetReviews(user.ID, ReviewFilter{}); err != nil || len(reviews) != 1 || reviews[0].NextInterval != 3 {
+			t.Errorf("GetReviews() = %v, %v, want the review", reviews, err)
+		}
+	})
+}
+
+// A card taking the ID of a deleted one, or a track the name of a deleted
+// one, starts without reviews.
+func TestStoreDeletesReviews(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user := newTestUser(t, store, "bob")
+		track := newTestTrack(t, store, user.ID, newTestCard(1, testToday), newTestCard(2, testToday), newTestCard(3, testToday))
+
+		at := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.UTC)
+		for id := 1; id <= 3; id++ {
+			review := Review{Track: track.Name, CardID: id, Direction: "toLanguage", At: at, Grade: GradeGood}
+			if err := store.AppendReviews(user.ID, review); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cardReviews := func(id int) int {
+			reviews, err := store.GetReviews(user.ID, ReviewFilter{Track: track.Name, CardID: id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return len(reviews)
+		}
+
+		if err := store.DeleteCard(user.ID, track.Name, 1); err != nil {
+			t.Fatal(err)
+		}
+		if n := cardReviews(1); n != 0 {
+			t.Errorf("The deleted card 1 kept %d reviews", n)
+		}
+
+		err := store.UpdateTrack(user.ID, track.Name, func(track *Track) error {
+			track.Storage = slices.DeleteFunc(track.Storage, func(card Card) bool { return card.ID == 2 })
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := cardReviews(2); n != 0 {
+			t.Errorf("The removed card 2 kept %d reviews", n)
+		}
+		if n := cardReviews(3); n != 1 {
+			t.Errorf("Card 3 has %d reviews, want 1", n)
+		}
+
+		if err := store.DeleteTrack(user.ID, track.Name); err != nil {
+			t.Fatal(err)
+		}
+		newTestTrack(t, store, user.ID, newTestCard(3, testToday))
+		if n := cardReviews(3); n != 0 {
+			t.Errorf("Card 3 of the new track has %d reviews of the deleted one", n)
+		}
+	})
+}
+
+func TestStoreRollOver(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		user := newTestUser(t, store, "bob")
+		track := newTestTrack(t, store, user.ID, newTestCard(1, testToday.AddDays(-3)))
+
+		for i, want := range []bool{true, false} {
+			rolled, err := store.RollOver(user.ID, testToday)
+			if err != nil || rolled != want {
+				t.Fatalf("RollOver() #%d = %v, %v, want %v", i+1, rolled, err, want)
+			}
+		}
+
+		got, err := store.GetUserByID(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.LastRollover != testToday {
+			t.Errorf("LastRollover = %v, want %v", got.LastRollover, testToday)
+		}
+
+		days, err := store.GetUserDays()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(days) != 1 || days[0].ID != user.ID || days[0].LastRollover != testToday || days[0].Settings != got.Settings {
+			t.Errorf("GetUserDays() = %+v, want bob rolled over on %v", days, testToday)
+		}
+
+		// The overdue card is due today again.
+		card, err := store.GetCard(user.ID, track.Name, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if card.ToLanguage.ReapeatDate != testToday {
+			t.Errorf("Overdue card is due %v, want %v", card.ToLanguage.ReapeatDate, testToday)
+		}
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// maxSessions is how many refresh tokens a user may hold at once, logging in
+// on one more device drops the oldest session.
+const maxSessions = 20
+
+// Session is one logged in device. Only a hash of its refresh token is kept.
+type Session struct {
+	ID          string    `json:"id"`
+	RefreshHash string    `json:"refreshHash"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+// TokenIssuer signs access tokens and manages the refresh sessions behind
+// them. Access tokens are short lived JWTs naming their session, so deleting
+// the session revokes them as well.
+//
+// Keys are rotated by putting a new key first in JWT_KEYS: it signs every
+// new token while the older keys still verify tokens signed before. An old
+// key can be removed once AccessTTL has passed.
+type TokenIssuer struct {
+	keys       []signingKey
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+type accessClaims struct {
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// NewTokenIssuerFromEnv reads JWT_KEYS ("kid:secret,kid:secret", the first
+// key signs), JWT_ACCESS_TTL and JWT_REFRESH_TTL.
+func NewTokenIssuerFromEnv() (*TokenIssuer, error) {
+	var t = &TokenIssuer{AccessTTL: 15 * time.Minute, RefreshTTL: 30 * 24 * time.Hour}
+
+	for _, key := range strings.Split(os.Getenv("JWT_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(key, ":")
+		if !ok || id == "" || len(secret) < 32 {
+			return nil, fmt.Errorf("Invalid JWT_KEYS: keys must look like kid:secret with at least 32 characters of secret")
+		}
+		t.keys = append(t.keys, signingKey{id, []byte(secret)})
+	}
+
+	if len(t.keys) == 0 {
+		log.Println("JWT_KEYS isn't set, using a random key: tokens won't survive a restart")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		t.keys = []signingKey{{"random", secret}}
+	}
+
+	for env, ttl := range map[string]*time.Duration{"JWT_ACCESS_TTL": &t.AccessTTL, "JWT_REFRESH_TTL": &t.RefreshTTL} {
+		if str := os.Getenv(env); str != "" {
+			d, err := time.ParseDuration(str)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("Invalid %v: %v", env, str)
+			}
+			*ttl = d
+		}
+	}
+
+	return t, nil
+}
+
+func randomToken(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *TokenIssuer) signAccess(userID int, sessionID string, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(t.AccessTTL)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(userID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	token.Header["kid"] = t.keys[0].id
+
+	signed, err := token.SignedString(t.keys[0].secret)
+	return signed, expiresAt, err
+}
+
+// issue rotates the refresh token of session and signs a new access token.
+// Refresh tokens look like "userID.sessionID.secret": the first two parts
+// find the session, the secret proves the token.
+func (t *TokenIssuer) issue(user *User, session *Session, now time.Time) (Authentification, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return Authentification{}, err
+	}
+
+	session.RefreshHash = hashSecret(secret)
+	session.ExpiresAt = now.Add(t.RefreshTTL)
+
+	access, expiresAt, err := t.signAccess(user.ID, session.ID, now)
+	if err != nil {
+		return Authentification{}, err
+	}
+
+	return Authentification{
+		Id:           user.ID,
+		UserName:     user.UserName,
+		EMail:        user.EMail,
+		Token:        access,
+		ExpiresAt:    expiresAt,
+		RefreshToken: fmt.Sprintf("%d.%s.%s", user.ID, session.ID, secret),
+	}, nil
+}
+
+// NewSession logs the user in on a new device. change, if not nil, runs on
+// the user first, in the same update.
+func (t *TokenIssuer) NewSession(store Store, userID int, change func(user *User) error) (Authentification, error) {
+	id, err := randomToken(12)
+	if err != nil {
+		return Authentification{}, err
+	}
+
+	var auth Authentification
+	err = store.UpdateUserFunc(userID, func(user *User) error {
+		if change != nil {
+			if err := change(user); err != nil {
+				return err
+			}
+		}
+
+		if user.Suspended {
+			return fmt.Errorf("Account suspended")
+		}
+
+		now := time.Now()
+
+		user.Sessions = slices.DeleteFunc(user.Sessions, func(session Session) bool {
+			return !session.ExpiresAt.After(now)
+		})
+		if len(user.Sessions) >= maxSessions {
+			user.Sessions = user.Sessions[len(user.Sessions)-maxSessions+1:]
+		}
+
+		user.Sessions = append(user.Sessions, Session{ID: id, CreatedAt: now})
+		auth, err = t.issue(user, &user.Sessions[len(user.Sessions)-1], now)
+		return err
+	})
+	if err != nil {
+		return Authentification{}, err
+	}
+	return auth, nil
+}
+
+func parseRefreshToken(token string) (int, string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, "", "", fmt.Errorf("Invalid refresh token")
+	}
+
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", "", fmt.Errorf("Invalid refresh token")
+	}
+
+	return userID, parts[1], parts[2], nil
+}
+
+// Refresh trades a refresh token for a new access and refresh token. Every
+// refresh token works once: presenting a used one again means it was stolen,
+// so the whole session is revoked.
+func (t *TokenIssuer) Refresh(store Store, refreshToken string) (Authentification, error) {
+	userID, sessionID, secret, err := parseRefreshToken(refreshToken)
+	if err != nil {
+		return Authentification{}, err
+	}
+
+	// The session is checked and rotated in one update, so a refresh token
+	// presented twice at once still only works once.
+	var auth Authentification
+	var revoked bool
+	err = store.UpdateUserFunc(userID, func(user *User) error {
+		if user.Suspended {
+			return fmt.Errorf("Account suspended")
+		}
+
+		i := slices.IndexFunc(user.Sessions, func(session Session) bool {
+			return session.ID == sessionID
+		})
+		if i == -1 {
+			return fmt.Errorf("Session expired")
+		}
+
+		now := time.Now()
+		session := &user.Sessions[i]
+
+		if subtle.ConstantTimeCompare([]byte(session.RefreshHash), []byte(hashSecret(secret))) != 1 || !session.ExpiresAt.After(now) {
+			user.Sessions = slices.Delete(user.Sessions, i, i+1)
+			revoked = true
+			return nil
+		}
+
+		auth, err = t.issue(user, session, now)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return Authentification{}, fmt.Errorf("Invalid refresh token")
+	}
+	if err != nil {
+		return Authentification{}, err
+	}
+	if revoked {
+		return Authentification{}, fmt.Errorf("Session expired")
+	}
+	return auth, nil
+}
+
+// Revoke ends the session a refresh token belongs to.
+func (t *TokenIssuer) Revoke(store Store, refreshToken string) error {
+	userID, sessionID, secret, err := parseRefreshToken(refreshToken)
+	if err != nil {
+		return err
+	}
+
+	err = store.UpdateUserFunc(userID, func(user *User) error {
+		i := slices.IndexFunc(user.Sessions, func(session Session) bool {
+			return session.ID == sessionID
+		})
+		if i == -1 || subtle.ConstantTimeCompare([]byte(user.Sessions[i].RefreshHash), []byte(hashSecret(secret))) != 1 {
+			return fmt.Errorf("Invalid refresh token")
+		}
+
+		user.Sessions = slices.Delete(user.Sessions, i, i+1)
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("Invalid refresh token")
+	}
+	return err
+}
+
+// Authenticate checks an access token and returns its user, as long as the
+// session it was issued for still exists.
+func (t *TokenIssuer) Authenticate(store Store, accessToken string) (*User, error) {
+	var claims accessClaims
+
+	_, err := jwt.ParseWithClaims(accessToken, &claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range t.keys {
+			if key.id == kid {
+				return key.secret, nil
+			}
+		}
+		return nil, fmt.Errorf("Unknown signing key")
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token")
+	}
+
+	user, err := store.GetAccount(userID)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token")
+	}
+
+	// Suspending clears the sessions too, this also covers a flag set
+	// without them, e.g. straight in the database.
+	if user.Suspended {
+		return nil, fmt.Errorf("Account suspended")
+	}
+
+	if !slices.ContainsFunc(user.Sessions, func(session Session) bool {
+		return session.ID == claims.SessionID && session.ExpiresAt.After(time.Now())
+	}) {
+		return nil, fmt.Errorf("Token revoked")
+	}
+
+	return user, nil
+}
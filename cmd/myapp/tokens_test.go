@@ -0,0 +1,211 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A suspended user is turned away by every way of authenticating, even
+// with sessions left over from before the suspension.
+func TestSuspendedUserTokens(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	tokens := newTestTokens()
+
+	user := newTestUser(t, store, "bob")
+	auth, err := tokens.NewSession(store, user.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tokens.Authenticate(store, auth.Token); err != nil {
+		t.Fatalf("Active user: %v", err)
+	}
+
+	err = store.UpdateUserFunc(user.ID, func(user *User) error {
+		user.Suspended = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tokens.Authenticate(store, auth.Token); err == nil || err.Error() != "Account suspended" {
+		t.Errorf("Authenticate a suspended user: %v, want Account suspended", err)
+	}
+	if _, err := tokens.Refresh(store, auth.RefreshToken); err == nil || err.Error() != "Account suspended" {
+		t.Errorf("Refresh a suspended user: %v, want Account suspended", err)
+	}
+	if _, err := tokens.NewSession(store, user.ID, nil); err == nil {
+		t.Error("Logged a suspended user in")
+	}
+}
+
+// newTestSession signs bob up on a memory store and logs him in.
+func newTestSession(t *testing.T, tokens *TokenIssuer) (Store, Authentification) {
+	store := NewMemoryStorage(nil)
+	user := newTestUser(t, store, "bob")
+
+	auth, err := tokens.NewSession(store, user.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, auth
+}
+
+func TestAccessTokenSignature(t *testing.T) {
+	tokens := newTestTokens()
+	store, auth := newTestSession(t, tokens)
+
+	// The same key id with another secret, as a forger would use.
+	forger := newTestTokens()
+	forger.keys[0].secret = []byte(strings.Repeat("f", 32))
+	forged, _, err := forger.signAccess(auth.Id, "session", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.RegisteredClaims{Subject: "1"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name  string
+		token string
+	}{
+		{"changed signature", auth.Token[:len(auth.Token)-2] + "xx"},
+		{"changed payload", strings.Replace(auth.Token, ".", ".x", 1)},
+		{"other secret", forged},
+		{"no signature", unsigned},
+		{"not a token", "token"},
+	}
+
+	for _, test := range tests {
+		if _, err := tokens.Authenticate(store, test.token); err == nil || err.Error() != "Invalid token" {
+			t.Errorf("%v: got %v, want Invalid token", test.name, err)
+		}
+	}
+}
+
+func TestAccessTokenExpired(t *testing.T) {
+	tokens := newTestTokens()
+	tokens.AccessTTL = -time.Second
+	store, auth := newTestSession(t, tokens)
+
+	if _, err := tokens.Authenticate(store, auth.Token); err == nil || err.Error() != "Invalid token" {
+		t.Errorf("Expired token: got %v, want Invalid token", err)
+	}
+}
+
+// Every refresh rotates the refresh token. Presenting an old one again
+// revokes the session, the tokens of the thief and the owner alike.
+func TestRefreshRotation(t *testing.T) {
+	tokens := newTestTokens()
+	store, first := newTestSession(t, tokens)
+
+	second, err := tokens.Refresh(store, first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("Refresh kept the refresh token")
+	}
+	if _, err := tokens.Authenticate(store, second.Token); err != nil {
+		t.Fatalf("New access token: %v", err)
+	}
+
+	third, err := tokens.Refresh(store, second.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tokens.Refresh(store, first.RefreshToken); err == nil || err.Error() != "Session expired" {
+		t.Errorf("Reused refresh token: got %v, want Session expired", err)
+	}
+	if _, err := tokens.Refresh(store, third.RefreshToken); err == nil {
+		t.Error("The latest refresh token still works after a reuse")
+	}
+	if _, err := tokens.Authenticate(store, third.Token); err == nil || err.Error() != "Token revoked" {
+		t.Errorf("Access token after a reuse: got %v, want Token revoked", err)
+	}
+}
+
+// A refresh token presented twice at once only works once. Run it with
+// -race.
+func TestConcurrentRefresh(t *testing.T) {
+	const refreshes = 8
+
+	tokens := newTestTokens()
+	store, auth := newTestSession(t, tokens)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var refreshed int
+	for i := 0; i < refreshes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tokens.Refresh(store, auth.RefreshToken); err == nil {
+				mu.Lock()
+				refreshed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if refreshed != 1 {
+		t.Errorf("%d of %d refreshes succeeded, want 1", refreshed, refreshes)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	tokens := newTestTokens()
+	store, auth := newTestSession(t, tokens)
+
+	if err := tokens.Revoke(store, auth.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Authenticate(store, auth.Token); err == nil || err.Error() != "Token revoked" {
+		t.Errorf("Access token of a revoked session: got %v, want Token revoked", err)
+	}
+	if err := tokens.Revoke(store, auth.RefreshToken); err == nil || err.Error() != "Invalid refresh token" {
+		t.Errorf("Revoking twice: got %v, want Invalid refresh token", err)
+	}
+}
+
+// A new key put first signs new tokens while the old one still verifies the
+// tokens it signed, until it is removed.
+func TestSigningKeyRotation(t *testing.T) {
+	old := signingKey{"old", []byte(strings.Repeat("o", 32))}
+	next := signingKey{"new", []byte(strings.Repeat("n", 32))}
+
+	before := &TokenIssuer{keys: []signingKey{old}, AccessTTL: time.Hour, RefreshTTL: time.Hour}
+	store, auth := newTestSession(t, before)
+
+	rotated := &TokenIssuer{keys: []signingKey{next, old}, AccessTTL: time.Hour, RefreshTTL: time.Hour}
+	if _, err := rotated.Authenticate(store, auth.Token); err != nil {
+		t.Errorf("Token of the old key after the rotation: %v", err)
+	}
+
+	refreshed, err := rotated.Refresh(store, auth.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(refreshed.Token, &accessClaims{})
+	if err != nil || token.Header["kid"] != "new" {
+		t.Errorf("New token signed with key %v, %v, want new", token.Header["kid"], err)
+	}
+
+	removed := &TokenIssuer{keys: []signingKey{next}, AccessTTL: time.Hour, RefreshTTL: time.Hour}
+	if _, err := removed.Authenticate(store, auth.Token); err == nil {
+		t.Error("Token of a removed key still works")
+	}
+	if _, err := removed.Authenticate(store, refreshed.Token); err != nil {
+		t.Errorf("Token of the new key: %v", err)
+	}
+}
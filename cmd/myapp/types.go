@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net/http"
 	"slices"
-	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -13,18 +12,81 @@ type User struct {
 	ID        int    `json:"id"`
 	FirstName string `json:"firstName"`
 
-	Token          string   `json:"token"`
-	CokiesAccepted bool     `json:"cokiesAccepted"`
-	LastName       string   `json:"lastName"`
-	EMail          string   `json:"eMail"`
-	Tracks         []Track  `json:"tracks"`
-	TracksKeys     []string `json:"tracksKeys"`
-	Settings       Settings `json:"settings"`
-	UserName       string   `json:"userName"`
-	Password       string   `json:"password"`
+	LastName   string    `json:"lastName"`
+	EMail      string    `json:"eMail"`
+	Tracks     []Track   `json:"tracks"`
+	TracksKeys []string  `json:"tracksKeys"`
+	Settings   Settings  `json:"settings"`
+	UserName   string    `json:"userName"`
+	Password   string    `json:"password,omitempty"`
+	Sessions   []Session `json:"sessions,omitempty"`
+	Role       string    `json:"role"`
+	Suspended  bool      `json:"suspended"`
+
+	EMailVerified bool          `json:"eMailVerified"`
+	ActionTokens  []ActionToken `json:"actionTokens,omitempty"`
+	APIKeys       []APIKey      `json:"apiKeys,omitempty"`
+
+	Consents []ConsentRecord `json:"consents,omitempty"`
+	Erasure  *Erasure        `json:"erasure,omitempty"`
+
+	// FSRSWeights are the fsrs parameters fitted to the user's reviews,
+	// nil until the optimizer ran for them.
+	FSRSWeights []float64 `json:"fsrsWeights,omitempty"`
+
+	// LastRollover is the last day of the user the tracks were rolled
+	// over to. Like the tracks it isn't an account field.
+	LastRollover Date `json:"lastRollover"`
+}
+
+const (
+	RoleUser    = "user"
+	RoleTeacher = "teacher"
+	RoleAdmin   = "admin"
+)
+
+var roles = []string{RoleUser, RoleTeacher, RoleAdmin}
+
+// Public returns the user as it may be sent to a client.
+func (u User) Public() User {
+	u.Password = ""
+	u.Sessions = nil
+	u.ActionTokens = nil
+	u.APIKeys = nil
+	return u
 }
 
 func (u User) Copy() User {
+	u.TracksKeys = slices.Clone(u.TracksKeys)
+	u.Sessions = slices.Clone(u.Sessions)
+	u.ActionTokens = slices.Clone(u.ActionTokens)
+	u.FSRSWeights = slices.Clone(u.FSRSWeights)
+	if u.Erasure != nil {
+		erasure := *u.Erasure
+		erasure.Done = slices.Clone(erasure.Done)
+		u.Erasure = &erasure
+	}
+	if u.Consents != nil {
+		var consents = make([]ConsentRecord, len(u.Consents))
+		for i, consent := range u.Consents {
+			consents[i] = consent.Copy()
+		}
+		u.Consents = consents
+	}
+	if u.APIKeys != nil {
+		var keys = make([]APIKey, len(u.APIKeys))
+		for i, key := range u.APIKeys {
+			keys[i] = key.Copy()
+		}
+		u.APIKeys = keys
+	}
+	if u.Tracks != nil {
+		var tracks = make([]Track, len(u.Tracks))
+		for i, track := range u.Tracks {
+			tracks[i] = track.Copy()
+		}
+		u.Tracks = tracks
+	}
 	return u
 }
 
@@ -37,11 +99,11 @@ func NewUser(firstName, lastName, eMail, userName, password string) *User {
 	return &User{
 
 		FirstName: firstName,
-		Token:     userName,
 		LastName:  lastName,
 		EMail:     eMail,
 		UserName:  userName,
 		Password:  password,
+		Role:      RoleUser,
 		Tracks:    []Track{},
 	}
 }
@@ -64,6 +126,7 @@ func NewTrack(req *CreateTrackRequest) Track {
 			DaylyTestTries:  req.DaylyTestTries,
 			DaylyTestCards:  req.DaylyStudyCards,
 			DaylyStudyCards: req.DaylyTestCards,
+			Scheduler:       req.Scheduler,
 		},
 		Storage: []Card{},
 	}
@@ -105,17 +168,27 @@ type CreateTrackRequest struct {
 
 	DaylyTestCards  int `json:"daylyTestCards"`
 	DaylyStudyCards int `json:"daylyStudyCards"`
+
+	Scheduler string `json:"scheduler"`
 }
 
 type CreateTestStatusRequest struct {
 	Passed bool  `json:"passed"`
 	IDs    []int `json:"IDs"`
+	// Grades optionally grade single cards and carry their response times,
+	// cards without a grade get "good" when the test is passed and "again"
+	// when it is failed.
+	Grades []CardGrade `json:"grades"`
 }
 
 type Settings struct {
 	ReminderStatus bool   `json:"reminderStatus"`
 	ReminderDate   string `json:"reminderDate"`
 	DarkTheme      bool   `json:"darkTheme"`
+	// TimeZone is an IANA name like "Europe/Kyiv", empty for the zone of
+	// the server. The user's day begins at DayStartHour in it.
+	TimeZone     string `json:"timeZone"`
+	DayStartHour int    `json:"dayStartHour"`
 }
 
 type Track struct {
@@ -128,13 +201,8 @@ type Track struct {
 	Settings     TrackSettings `json:"settings"`
 }
 
-func (t Track) GetTest(r *http.Request) ([]Card, error) {
-	var name, err = getTestName(r)
-	if err != nil {
-		return []Card{}, err
-	}
-
-	test, err := t.defineTest(r)
+func (t Track) GetTest(name string, todaysDate Date) ([]Card, error) {
+	test, err := t.defineTest(name)
 	if err != nil {
 		return []Card{}, err
 	}
@@ -146,11 +214,23 @@ func (t Track) GetTest(r *http.Request) ([]Card, error) {
 	max := t.Settings.getMaxTestCards()
 	var cards = make([]Card, 0, max)
 	var i int
-	var todaysDate = time.Now().Format("2006.01.02")
+
+	var failed = t.priorityCards(test)
+	for _, card := range failed {
+		if i >= max {
+			break
+		}
+		cards = append(cards, card)
+		i++
+	}
+
 	for _, card := range t.Storage {
 		if i >= max {
 			break
 		}
+		if card.Suspended || containsCard(failed, card.ID) {
+			continue
+		}
 		if card.CreationDate == todaysDate {
 			cards = append(cards, card)
 			i++
@@ -191,13 +271,29 @@ func (t Track) GetTest(r *http.Request) ([]Card, error) {
 	return cards, nil
 }
 
-func (t *Track) GetTestData(r *http.Request) (*Test, error) {
-	test, err := t.defineTest(r)
-	if err != nil {
-		return nil, err
+// priorityCards returns the cards of the last failed run of test that are
+// still in the track, once each, when the track puts them first.
+func (t Track) priorityCards(test *Test) []Card {
+	if !t.Settings.FailedTestCardsPriopity {
+		return nil
+	}
+
+	var cards []Card
+	for _, failed := range test.FailedCards {
+		if containsCard(cards, failed.ID) {
+			continue
+		}
+		if i := slices.IndexFunc(t.Storage, func(c Card) bool { return c.ID == failed.ID }); i != -1 && !t.Storage[i].Suspended {
+			cards = append(cards, t.Storage[i])
+		}
 	}
+	return cards
+}
 
-	return test, nil
+func containsCard(cards []Card, id int) bool {
+	return slices.ContainsFunc(cards, func(c Card) bool {
+		return c.ID == id
+	})
 }
 
 func getTestName(r *http.Request) (string, error) {
@@ -212,22 +308,35 @@ type StudyAnswer struct {
 	FakeAnswers []Card `json:"fakeAnswers"`
 }
 
-func (t Track) GetStudy() (StudyAnswer, error) {
+func (t Track) GetStudy(todaysDate Date) (StudyAnswer, error) {
 
 	var maxCards = t.Settings.getMaxStudyCards()
 	var cards = make([]Card, 0, maxCards)
 
-	var todaysDate = time.Now().Format("2006.01.02")
+	var failed []Card
+	for _, name := range testNames {
+		test, _ := t.getTest(name)
+		for _, card := range t.priorityCards(test) {
+			if !containsCard(failed, card.ID) {
+				failed = append(failed, card)
+			}
+		}
+	}
+	cards = append(cards, failed[:min(len(failed), maxCards)]...)
 
 	for _, card := range t.Storage {
 
-		if card.CreationDate == todaysDate && len(cards) < maxCards {
+		if card.CreationDate == todaysDate && len(cards) < maxCards && !card.Suspended && !containsCard(cards, card.ID) {
 			cards = append(cards, card)
 		}
 
 	}
 
-	cards = append(cards, t.getFailedCardsToStudy()...)
+	for _, card := range t.getFailedCardsToStudy(todaysDate) {
+		if !containsCard(cards, card.ID) {
+			cards = append(cards, card)
+		}
+	}
 
 	if len(cards) == 0 {
 		return StudyAnswer{}, fmt.Errorf("There are no cards to study")
@@ -259,13 +368,16 @@ func (t Track) getFakeAnswers() []Card {
 	return cards
 }
 
-func (t Track) getFailedCardsToStudy() []Card {
+func (t Track) getFailedCardsToStudy(todaysDate Date) []Card {
 
 	var cards = make([]Card, 0)
 
-	var testCards = t.getAllTestCArds()
+	var testCards = t.getAllTestCArds(todaysDate)
 
 	for _, card := range t.Storage {
+		if card.Suspended {
+			continue
+		}
 		if slices.IndexFunc(testCards, func(c Card) bool {
 			return c.ID == card.ID
 		}) == -1 {
@@ -277,11 +389,10 @@ func (t Track) getFailedCardsToStudy() []Card {
 	return cards
 }
 
-func (t Track) getAllTestCArds() []Card {
+func (t Track) getAllTestCArds(todaysDate Date) []Card {
 
 	var cards = make([]Card, 0)
 
-	var todaysDate = time.Now().Format("2006.01.02")
 	for _, card := range t.Storage {
 
 		if card.CreationDate == todaysDate {
@@ -314,12 +425,7 @@ func (t Track) getAllTestCArds() []Card {
 	return cards
 }
 
-func (t *Track) defineTest(r *http.Request) (*Test, error) {
-	name1, err := getTestName(r)
-	if err != nil {
-		return nil, err
-	}
-
+func (t *Track) defineTest(name1 string) (*Test, error) {
 	var test *Test
 	var testUsed error = nil
 	switch name1 {
@@ -348,6 +454,23 @@ func (t *Track) defineTest(r *http.Request) (*Test, error) {
 	return test, testUsed
 }
 
+var testNames = []string{"fromLanguage", "toLanguage", "listening", "writing"}
+
+func (t *Track) getTest(testName string) (*Test, error) {
+	switch testName {
+	case "listening":
+		return &t.Listening, nil
+	case "fromLanguage":
+		return &t.FromLanguage, nil
+	case "toLanguage":
+		return &t.ToLanguage, nil
+	case "writing":
+		return &t.Writing, nil
+	}
+
+	return nil, fmt.Errorf("Undefined test type: %v", testName)
+}
+
 func (t Track) defineTestError(test *Test) error {
 
 	switch test.Status {
@@ -377,9 +500,42 @@ func (s TrackSettings) getMaxStudyCards() int {
 }
 
 func (t Track) Copy() Track {
+	t.FromLanguage = t.FromLanguage.Copy()
+	t.ToLanguage = t.ToLanguage.Copy()
+	t.Listening = t.Listening.Copy()
+	t.Writing = t.Writing.Copy()
+	if t.Storage != nil {
+		var cards = make([]Card, len(t.Storage))
+		for i, card := range t.Storage {
+			cards[i] = card.Copy()
+		}
+		t.Storage = cards
+	}
 	return t
 }
 
+func (t Track) TestsStatuses() TestsStatuses {
+	return TestsStatuses{t.Listening, t.Writing, t.ToLanguage, t.FromLanguage}
+}
+
+func (t *Track) SetTests(tests TestsStatuses) {
+	t.Listening = tests.Listening.Copy()
+	t.Writing = tests.Writing.Copy()
+	t.ToLanguage = tests.ToLanguage.Copy()
+	t.FromLanguage = tests.FromLanguage.Copy()
+}
+
+func (t *Track) UpToDate(todaysDate Date) {
+	t.FromLanguage.VerifyTestStatuses(t.Settings.DaylyTestTries, todaysDate)
+	t.ToLanguage.VerifyTestStatuses(t.Settings.DaylyTestTries, todaysDate)
+	t.Writing.VerifyTestStatuses(t.Settings.DaylyTestTries, todaysDate)
+	t.Listening.VerifyTestStatuses(t.Settings.DaylyTestTries, todaysDate)
+
+	t.planBacklog(todaysDate)
+
+	t.MissingTests(todaysDate)
+}
+
 func (t Track) DefineNewID() int {
 	var id int = 0
 
@@ -392,13 +548,15 @@ func (t Track) DefineNewID() int {
 	return id
 }
 
-func (t *Track) MissingTests() {
-	todaysDate := time.Now().Format("2006.01.02")
+func (t *Track) MissingTests(todaysDate Date) {
 	var fromLg int
 	var toLg int
 	var listening int
 	var writing int
 	for _, card := range t.Storage {
+		if card.Suspended {
+			continue
+		}
 		if card.FromLanguage.ReapeatDate == todaysDate && t.FromLanguage.Status != "failed" && t.FromLanguage.Status != "passed" {
 			fromLg++
 		}
@@ -442,8 +600,8 @@ type TrackSettings struct {
 	Name              string `json:"name"`
 	SumUnstudiedCards bool   `json:"sumUnstudiedCards"`
 
-	SumUntestedCards        bool `json:"sumUntesteddCards"`
-	FailedTestCardsPriopity bool `json:"failedTestCardsPriopity"` //Implement procces!!!!!!
+	SumUntestedCards        bool `json:"sumUntestedCards"`
+	FailedTestCardsPriopity bool `json:"failedTestCardsPriopity"`
 	UseExamples             bool `json:"useExamples"`
 	UseNotes                bool `json:"useNotes"`
 	Writing                 bool `json:"writing"`
@@ -451,52 +609,68 @@ type TrackSettings struct {
 	DaylyTestTries          int  `json:"daylyTestTries"`
 	DaylyTestCards          int  `json:"daylyTestCards"`
 	DaylyStudyCards         int  `json:"daylyStudyCards"`
+	// Scheduler names the entry of schedulers deciding the repeat dates.
+	Scheduler string `json:"scheduler"`
+	// TargetRetention is the chance of remembering a card the fsrs
+	// scheduler aims for when it is due, 0 means defaultRetention.
+	TargetRetention float64 `json:"targetRetention"`
+	// Backlog decides when the cards piled up are due.
+	Backlog BacklogPolicy `json:"backlog"`
+	// Leeches decides when cards failed over and over are leeches.
+	Leeches LeechPolicy `json:"leeches"`
 }
 
 type Test struct {
 	Name           string `json:"name"`
 	DaylyTestTries int    `json:"daylyTestTries"`
-	LastFailDate   string `json:"lastFailDate"`
-	LastPassedDate string `json:"lastPassedDate"`
+	LastFailDate   Date   `json:"lastFailDate"`
+	LastPassedDate Date   `json:"lastPassedDate"`
 	Status         string `json:"status"`
-	FailedCards    []Card
+	// FailedCards are the cards of the last failed run, kept until the test
+	// is passed. With FailedTestCardsPriopity they are tested first.
+	FailedCards []Card `json:"failedCards"`
 }
 
-func (test *Test) VerifyTestStatuses(maxTestTries int) {
-	todaysDate, _ := time.Parse("2006.01.02", time.Now().Format("2006.01.02"))
-
+func (test *Test) VerifyTestStatuses(maxTestTries int, todaysDate Date) {
 	switch test.Status {
 	case "prepared":
 		test.Status = "missing"
-	case "passsed":
-		var date, _ = time.Parse("2006.01.02", test.LastPassedDate)
-		if date.Before(todaysDate) {
+	case "passed":
+		if test.LastPassedDate.Before(todaysDate) {
 			test.DaylyTestTries = maxTestTries
 			test.Status = "missing"
 		}
 	case "tried":
 	case "failed":
-		var date, _ = time.Parse("2006.01.02", test.LastFailDate)
-		if date.Before(todaysDate) {
+		if test.LastFailDate.Before(todaysDate) {
 			test.DaylyTestTries = maxTestTries
 			test.Status = "missing"
-			test.FailedCards = []Card{}
+			// FailedCards are kept over the rollover: they are tested first
+			// the next days and have their interval shortened, until the
+			// test is passed.
 		}
 	}
 
 }
 
 func (t Test) Copy() Test {
+	if t.FailedCards != nil {
+		var cards = make([]Card, len(t.FailedCards))
+		for i, card := range t.FailedCards {
+			cards[i] = card.Copy()
+		}
+		t.FailedCards = cards
+	}
 	return t
 }
 
-func (t *Test) DefineStatusUpdate(req *CreateTestStatusRequest, maxTestTries int, cards []Card) error {
-	var todaysDate = time.Now().Format("2006.01.02")
+func (t *Test) DefineStatusUpdate(req *CreateTestStatusRequest, maxTestTries int, cards []Card, todaysDate Date) error {
 	if req.Passed {
 
 		t.Status = "passed"
 		t.LastPassedDate = todaysDate
 		t.DaylyTestTries = maxTestTries
+		t.FailedCards = []Card{}
 	} else {
 		if t.DaylyTestTries == 0 {
 			return fmt.Errorf("Test is failed")
@@ -526,20 +700,13 @@ type Card struct {
 	ToLanguage        TestData `json:"toLanguage"`
 	Listening         TestData `json:"listening"`
 	Writing           TestData `json:"writing"`
-	CreationDate      string   `json:"creationDate"`
+	CreationDate      Date     `json:"creationDate"`
 	PronunciationPath string   `json:"pronunciation"`
-}
-
-func (test *TestData) VerifyDates() {
-	todaysDate, _ := time.Parse("2006.01.02", time.Now().Format("2006.01.02"))
-	repeatDate, _ := time.Parse("2006.01.02", test.ReapeatDate)
-
-	formatedTodaysDate := todaysDate.Format("2006.01.02")
-	if repeatDate.Before(todaysDate) {
-		test.ReapeatDate = formatedTodaysDate
-
-	}
-
+	// Leech marks cards failed over and over, see LeechPolicy. Suspended
+	// cards are left out of tests and studies until they are unsuspended.
+	Leech     bool     `json:"leech"`
+	Suspended bool     `json:"suspended"`
+	Tags      []string `json:"tags"`
 }
 
 type CardData struct {
@@ -576,8 +743,7 @@ type F struct {
 // 	pronunciationPath: string
 //   }
 
-func NewCard(id int, data, notes string, translatedData, examples []string, pronunciationPath string) Card {
-	var todaysDate = time.Now().Format("2006.01.02")
+func NewCard(id int, data, notes string, translatedData, examples []string, pronunciationPath string, todaysDate Date) Card {
 	return Card{
 		ID:                id,
 		Data:              data,
@@ -594,13 +760,29 @@ func NewCard(id int, data, notes string, translatedData, examples []string, pron
 }
 
 func (c Card) Copy() Card {
+	c.TranslatedData = slices.Clone(c.TranslatedData)
+	c.Examples = slices.Clone(c.Examples)
+	c.Tags = slices.Clone(c.Tags)
 	return c
 }
 
 type TestData struct {
-	TestQuize   bool   `json:"testQuize"`
-	ReapeatDate string `json:"repeatDate"`
-	Repeated    int    `json:"repeated"`
+	TestQuize   bool `json:"testQuize"`
+	ReapeatDate Date `json:"repeatDate"`
+	Repeated    int  `json:"repeated"`
+
+	// Ease and Interval (in days) are kept by the sm2 scheduler, an Ease of
+	// 0 means the card wasn't scheduled by it yet. Lapses counts the failed
+	// answers with every scheduler.
+	Ease     float64 `json:"ease"`
+	Interval int     `json:"interval"`
+	Lapses   int     `json:"lapses"`
+
+	// Stability (in days) and Difficulty are the memory state of the fsrs
+	// scheduler. LastReview is the day of the last graded answer.
+	Stability  float64 `json:"stability"`
+	Difficulty float64 `json:"difficulty"`
+	LastReview Date    `json:"lastReview"`
 }
 
 type LogInReq struct {
@@ -608,6 +790,47 @@ type LogInReq struct {
 	Password      string `json:"password"`
 }
 
+type ChangePasswordReq struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+type SuspendReq struct {
+	Suspended bool `json:"suspended"`
+}
+
+type RoleReq struct {
+	Role string `json:"role"`
+}
+
+type ActionTokenReq struct {
+	Token string `json:"token"`
+}
+
+type PasswordResetRequest struct {
+	EMail string `json:"eMail"`
+}
+
+type ResetPasswordReq struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+type CreateAPIKeyReq struct {
+	Label    string   `json:"label"`
+	ReadOnly bool     `json:"readOnly"`
+	Tracks   []string `json:"tracks"`
+}
+
+type ConsentReq struct {
+	PolicyVersion string   `json:"policyVersion"`
+	Categories    []string `json:"categories"`
+}
+
+type RefreshReq struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
 type SingUp struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
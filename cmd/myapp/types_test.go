@@ -0,0 +1,161 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// newPriorityTrack holds cards 1 to 4 made today and cards 5 and 6 made
+// earlier, not due. The last failed fromLanguage test had cards 5, 3, 5
+// again and the suspended 6, the last failed toLanguage test cards 4 and 5.
+func newPriorityTrack(testCards, studyCards int, priority bool, suspended ...int) Track {
+	track := NewTrack(&CreateTrackRequest{FromLanguage: "Ukrainian", ToLanguage: "English", DaylyTestTries: 3})
+	track.Settings.DaylyTestCards = testCards
+	track.Settings.DaylyStudyCards = studyCards
+	track.Settings.FailedTestCardsPriopity = priority
+
+	for id := 1; id <= 6; id++ {
+		card := newTestCard(id, testToday)
+		if id > 4 {
+			card = newTestCard(id, testToday.AddDays(-10))
+			for _, name := range testNames {
+				data, _ := card.getTest(name)
+				data.ReapeatDate = testToday.AddDays(5)
+			}
+		}
+		card.Suspended = id == 6 || slices.Contains(suspended, id)
+		track.Storage = append(track.Storage, card)
+	}
+
+	for _, id := range []int{5, 3, 5, 6} {
+		track.FromLanguage.FailedCards = append(track.FromLanguage.FailedCards, track.getCardsByIDs([]int{id})...)
+	}
+	track.ToLanguage.FailedCards = track.getCardsByIDs([]int{4, 5})
+	return track
+}
+
+func cardIDs(cards []Card) []int {
+	var ids = []int{}
+	for _, card := range cards {
+		ids = append(ids, card.ID)
+	}
+	return ids
+}
+
+func TestGetTestPriority(t *testing.T) {
+	var tests = []struct {
+		name  string
+		track Track
+		want  []int
+	}{
+		{"priority off", newPriorityTrack(3, 3, false), []int{1, 2, 3}},
+		{"failed first", newPriorityTrack(3, 3, true), []int{5, 3, 1}},
+		{"failed fill the test", newPriorityTrack(1, 3, true), []int{5}},
+		{"suspended skipped", newPriorityTrack(3, 3, true, 1, 5), []int{3, 2, 4}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cards, err := test.track.GetTest("fromLanguage", testToday)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cardIDs(cards); !slices.Equal(got, test.want) {
+				t.Errorf("Got cards %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetStudyPriority(t *testing.T) {
+	var tests = []struct {
+		name  string
+		track Track
+		want  []int
+	}{
+		{"priority off", newPriorityTrack(3, 3, false), []int{1, 2, 3, 5}},
+		{"failed of every test first", newPriorityTrack(3, 4, true), []int{5, 3, 4, 1}},
+		{"failed cut to the limit", newPriorityTrack(3, 2, true), []int{5, 3}},
+		{"suspended skipped", newPriorityTrack(3, 3, true, 3, 5), []int{4, 1, 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			study, err := test.track.GetStudy(testToday)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cardIDs(study.Cards); !slices.Equal(got, test.want) {
+				t.Errorf("Got cards %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// The failed cards outlive the rollover of a failed test, so they are put
+// first on the days after it.
+func TestVerifyFailedTestKeepsCards(t *testing.T) {
+	var test = Test{Status: "failed", LastFailDate: testToday, FailedCards: []Card{newTestCard(1, testToday)}}
+
+	test.VerifyTestStatuses(3, testToday)
+	if test.Status != "failed" || test.DaylyTestTries != 0 {
+		t.Errorf("Same day: test is %v with %d tries, want failed with 0", test.Status, test.DaylyTestTries)
+	}
+
+	test.VerifyTestStatuses(3, testToday.AddDays(1))
+	if test.Status != "missing" || test.DaylyTestTries != 3 {
+		t.Errorf("Next day: test is %v with %d tries, want missing with 3", test.Status, test.DaylyTestTries)
+	}
+	if len(test.FailedCards) != 1 || test.FailedCards[0].ID != 1 {
+		t.Errorf("Failed cards after the rollover %+v, want card 1", test.FailedCards)
+	}
+
+	track := newPriorityTrack(3, 3, true)
+	track.FromLanguage = test
+	if cards, err := track.GetTest("fromLanguage", testToday.AddDays(1)); err != nil || len(cards) == 0 || cards[0].ID != 1 {
+		t.Errorf("Next test starts with %v, %v, want card 1", cardIDs(cards), err)
+	}
+}
+
+// A card of the last failed test earns half the interval when it is passed,
+// cards failed again keep the interval of the failed answer.
+func TestFailedCardsShortenedInterval(t *testing.T) {
+	var tests = []struct {
+		name     string
+		priority bool
+		failed   []int
+		passed   bool
+		want     int
+	}{
+		{"passed again", true, []int{1}, true, 7},
+		{"not failed before", true, []int{2}, true, 14},
+		{"priority off", false, []int{1}, true, 14},
+		{"failed again", true, []int{1}, false, 1},
+	}
+
+	ladder, err := newScheduler(&User{}, TrackSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			track := newPriorityTrack(3, 3, test.priority)
+			track.Storage[0].FromLanguage.Repeated = 5
+
+			status := "failed"
+			if test.passed {
+				status = "passed"
+			}
+
+			req := &CreateTestStatusRequest{Passed: test.passed, IDs: []int{1}}
+			if _, err := track.updateTestDates("fromLanguage", req, status, track.getCardsByIDs(test.failed), ladder, testToday.time(), testToday); err != nil {
+				t.Fatal(err)
+			}
+
+			if data := track.Storage[0].FromLanguage; data.Interval != test.want || data.ReapeatDate != testToday.AddDays(test.want) {
+				t.Errorf("Interval %d due %v, want %d", data.Interval, data.ReapeatDate, test.want)
+			}
+		})
+	}
+}
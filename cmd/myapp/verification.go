@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	purposeVerifyEMail   = "verifyEMail"
+	purposeResetPassword = "resetPassword"
+)
+
+var actionTokenTTL = map[string]time.Duration{
+	purposeVerifyEMail:   48 * time.Hour,
+	purposeResetPassword: time.Hour,
+}
+
+// ActionToken is a single use token mailed to the user. Only its hash is
+// kept, and a new token replaces the previous one with the same purpose.
+type ActionToken struct {
+	Purpose   string    `json:"purpose"`
+	Hash      string    `json:"hash"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// appURL is the frontend the mailed links point to. It has no default, the
+// API itself listens on localhost:3000 and links to it would lead nowhere.
+func appURL() (string, error) {
+	url := os.Getenv("APP_URL")
+	if url == "" {
+		return "", fmt.Errorf("APP_URL isn't set, mailed links need the address of the frontend")
+	}
+	return strings.TrimSuffix(url, "/"), nil
+}
+
+// newActionToken stores a new token for purpose on user and returns it. It
+// runs inside an update of the user.
+func newActionToken(user *User, purpose string) (string, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	user.ActionTokens = slices.DeleteFunc(user.ActionTokens, func(token ActionToken) bool {
+		return token.Purpose == purpose || !token.ExpiresAt.After(time.Now())
+	})
+	user.ActionTokens = append(user.ActionTokens, ActionToken{
+		Purpose:   purpose,
+		Hash:      hashSecret(secret),
+		ExpiresAt: time.Now().Add(actionTokenTTL[purpose]),
+	})
+
+	return fmt.Sprintf("%d.%s", user.ID, secret), nil
+}
+
+// useActionToken finds the user a token was issued to, removes the token
+// and runs use on the user, all in one update, so a token works only once.
+// It returns the user as use left it.
+func useActionToken(store Store, token, purpose string, use func(user *User) error) (User, error) {
+	idStr, secret, ok := strings.Cut(token, ".")
+	id, err := strconv.Atoi(idStr)
+	if !ok || err != nil {
+		return User{}, fmt.Errorf("Invalid token")
+	}
+
+	var account User
+	var expired bool
+	err = store.UpdateUserFunc(id, func(user *User) error {
+		i := slices.IndexFunc(user.ActionTokens, func(t ActionToken) bool {
+			return t.Purpose == purpose && subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashSecret(secret))) == 1
+		})
+		if i == -1 {
+			return fmt.Errorf("Invalid token")
+		}
+
+		expired = !user.ActionTokens[i].ExpiresAt.After(time.Now())
+		user.ActionTokens = slices.Delete(user.ActionTokens, i, i+1)
+		if expired {
+			return nil
+		}
+
+		if err := use(user); err != nil {
+			return err
+		}
+
+		account = *user
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return User{}, fmt.Errorf("Invalid token")
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if expired {
+		return User{}, fmt.Errorf("Token expired")
+	}
+
+	return account, nil
+}
+
+func (s *APIServer) sendVerificationMail(userID int) error {
+	app, err := appURL()
+	if err != nil {
+		return err
+	}
+
+	var account User
+	var token string
+	err = s.dataBase.UpdateUserFunc(userID, func(user *User) error {
+		if user.EMail == "" {
+			return fmt.Errorf("Account has no email")
+		}
+		if user.EMailVerified {
+			return fmt.Errorf("Email already verified")
+		}
+
+		var err error
+		if token, err = newActionToken(user, purposeVerifyEMail); err != nil {
+			return err
+		}
+
+		account = *user
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	link := app + "/verifyEMail?token=" + url.QueryEscape(token)
+	return s.mailer.Send(account.EMail, "Confirm your email", fmt.Sprintf(
+		"Hi %v,\n\nconfirm your email address by opening this link:\n%v\n\nThe link is valid for %v.\n",
+		account.UserName, link, actionTokenTTL[purposeVerifyEMail]))
+}
+
+// handleSendVerification mails a new verification link to the logged in user.
+func (s *APIServer) handleSendVerification(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.sendVerificationMail(id); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{
+		Status: "sent",
+	})
+}
+
+func (s *APIServer) handleVerifyEMail(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	var req ActionTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	user, err := useActionToken(s.dataBase, req.Token, purposeVerifyEMail, func(user *User) error {
+		user.EMailVerified = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, adminView(user))
+}
+
+// handleRequestPasswordReset always answers the same, so it can't be used
+// to find out which emails have an account.
+func (s *APIServer) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	var req PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	if user, err := s.dataBase.GetUserByLogin(req.EMail); err == nil && user.EMail != "" && !user.Suspended {
+		if err := s.sendPasswordReset(user.ID); err != nil {
+			log.Println("Sending password reset failed:", err)
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{
+		Status: "If the account exists, a reset link was sent to its email",
+	})
+}
+
+func (s *APIServer) sendPasswordReset(userID int) error {
+	app, err := appURL()
+	if err != nil {
+		return err
+	}
+
+	var account User
+	var token string
+	err = s.dataBase.UpdateUserFunc(userID, func(user *User) error {
+		var err error
+		if token, err = newActionToken(user, purposeResetPassword); err != nil {
+			return err
+		}
+
+		account = *user
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	link := app + "/resetPassword?token=" + url.QueryEscape(token)
+	return s.mailer.Send(account.EMail, "Reset your password", fmt.Sprintf(
+		"Hi %v,\n\nset a new password by opening this link:\n%v\n\nThe link is valid for %v. If you didn't ask for it, ignore this email.\n",
+		account.UserName, link, actionTokenTTL[purposeResetPassword]))
+}
+
+// handleResetPassword sets the new password and ends every session, the
+// user logs in again with it.
+func (s *APIServer) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("Method not allowed")
+	}
+
+	var req ResetPasswordReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+
+	if req.NewPassword == "" {
+		return fmt.Errorf("Password is empty")
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	_, err = useActionToken(s.dataBase, req.Token, purposeResetPassword, func(user *User) error {
+		user.Password = hash
+
+		// The mail reached the user, so the address is theirs.
+		user.EMailVerified = true
+		user.Sessions = nil
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{
+		Status: "password changed",
+	})
+}
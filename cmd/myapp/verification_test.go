@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var mailedToken = regexp.MustCompile(`(\S+)\?token=(\S+)`)
+
+// lastMail returns the link and token of the newest mail in dir.
+func lastMail(t *testing.T, dir string) (string, string) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No mail was sent: %v", err)
+	}
+
+	data, err := os.ReadFile(files[len(files)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := mailedToken.FindStringSubmatch(string(data))
+	if match == nil {
+		t.Fatalf("The mail has no link: %s", data)
+	}
+	return match[1], match[2]
+}
+
+func TestPasswordReset(t *testing.T) {
+	server := newTestServer(t, NewMemoryStorage(nil))
+	handler := server.Handler()
+
+	c, err := signUp(handler, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.do("POST", "/passwordReset/request", PasswordResetRequest{EMail: "user0@example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	link, token := lastMail(t, server.mailer.(*FileMailer).dir)
+	if link != testAppURL+"/resetPassword" {
+		t.Errorf("The mail links to %v, want the frontend at %v", link, testAppURL)
+	}
+
+	reset := ResetPasswordReq{Token: token, NewPassword: "new password"}
+	if err := c.do("POST", "/passwordReset", reset, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code := c.code("POST", "/passwordReset", ResetPasswordReq{Token: token, NewPassword: "other password"}); code == http.StatusOK {
+		t.Error("The reset token worked twice")
+	}
+
+	if err := c.do("PUT", "/register", LogInReq{UsernameEMail: "user0", Password: "new password"}, nil); err != nil {
+		t.Errorf("Logging in with the new password failed: %v", err)
+	}
+}
+
+func TestActionTokens(t *testing.T) {
+	store := NewMemoryStorage(nil)
+	user := newTestUser(t, store, "bob")
+
+	issue := func(purpose string) string {
+		var token string
+		err := store.UpdateUserFunc(user.ID, func(user *User) error {
+			var err error
+			token, err = newActionToken(user, purpose)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	use := func(token, purpose string) (bool, error) {
+		var used bool
+		_, err := useActionToken(store, token, purpose, func(user *User) error {
+			used = true
+			return nil
+		})
+		return used, err
+	}
+
+	token := issue(purposeVerifyEMail)
+	if used, err := use(token, purposeResetPassword); used || err == nil {
+		t.Error("A verification token reset the password")
+	}
+	if used, err := use(token, purposeVerifyEMail); !used || err != nil {
+		t.Fatalf("Using the token failed: %v", err)
+	}
+	if used, err := use(token, purposeVerifyEMail); used || err == nil {
+		t.Error("The token worked twice")
+	}
+
+	replaced := issue(purposeVerifyEMail)
+	issue(purposeVerifyEMail)
+	if used, _ := use(replaced, purposeVerifyEMail); used {
+		t.Error("A token worked after a new one replaced it")
+	}
+
+	expired := issue(purposeResetPassword)
+	err := store.UpdateUserFunc(user.ID, func(user *User) error {
+		for i := range user.ActionTokens {
+			user.ActionTokens[i].ExpiresAt = time.Now().Add(-time.Second)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used, err := use(expired, purposeResetPassword); used || err == nil || err.Error() != "Token expired" {
+		t.Errorf("Using an expired token: used %v, %v", used, err)
+	}
+	if got, err := store.GetAccount(user.ID); err != nil || len(got.ActionTokens) != 1 {
+		t.Errorf("The expired token wasn't removed: %+v, %v", got, err)
+	}
+}
+
+func TestMailedLinksNeedAppURL(t *testing.T) {
+	t.Setenv("APP_URL", "")
+	server := newTestServer(t, NewMemoryStorage(nil))
+
+	user := newTestUser(t, server.dataBase, "bob")
+	if err := server.sendPasswordReset(user.ID); err == nil {
+		t.Error("Mailed a link without APP_URL")
+	}
+
+	t.Setenv("SMTP_ADDR", "smtp.example.com:25")
+	if _, err := NewMailerFromEnv(); err == nil {
+		t.Error("NewMailerFromEnv accepted SMTP_ADDR without APP_URL")
+	}
+
+	t.Setenv("APP_URL", testAppURL+"/")
+	if url, err := appURL(); err != nil || url != testAppURL {
+		t.Errorf("appURL() = %v, %v", url, err)
+	}
+	if _, err := NewMailerFromEnv(); err != nil {
+		t.Error(err)
+	}
+}